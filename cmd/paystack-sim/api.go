@@ -0,0 +1,412 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// paystackError answers like Paystack does when a request is refused
+func paystackError(c *fiber.Ctx, status int, message string) error {
+	return c.Status(status).JSON(fiber.Map{"status": false, "message": message})
+}
+
+func (s *simulator) requireSecretKey(c *fiber.Ctx) error {
+	key := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(s.cfg.SecretKey)) != 1 {
+		return paystackError(c, 401, "Invalid key")
+	}
+	return c.Next()
+}
+
+// replay answers a repeated Idempotency-Key with the first response
+func (s *simulator) replay(c *fiber.Ctx) (string, bool) {
+	key := c.Get("Idempotency-Key")
+	if key == "" {
+		return "", false
+	}
+	key = c.Path() + "|" + key
+
+	s.mu.Lock()
+	body, ok := s.idempotent[key]
+	s.mu.Unlock()
+	if ok {
+		c.Set("Content-Type", "application/json")
+		c.Send(body)
+	}
+	return key, ok
+}
+
+func (s *simulator) initialize(c *fiber.Ctx) error {
+	key, replayed := s.replay(c)
+	if replayed {
+		return nil
+	}
+
+	var body struct {
+		Email       string      `json:"email"`
+		Amount      json.Number `json:"amount"`
+		Currency    string      `json:"currency"`
+		CallbackURL string      `json:"callback_url"`
+		Reference   string      `json:"reference"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return paystackError(c, 400, "Invalid request body")
+	}
+	amount, err := body.Amount.Int64()
+	if err != nil || amount <= 0 {
+		return paystackError(c, 400, "Invalid Amount Sent")
+	}
+	if body.Email == "" {
+		return paystackError(c, 400, "Invalid Email Address Passed")
+	}
+	if body.Currency == "" {
+		body.Currency = "NGN"
+	}
+	if body.Reference == "" {
+		body.Reference = randomCode("T")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.transactions[body.Reference]; ok {
+		return paystackError(c, 400, "Duplicate Transaction Reference")
+	}
+
+	t := &transaction{
+		ID:          s.nextID(),
+		Reference:   body.Reference,
+		AccessCode:  randomCode(""),
+		Email:       body.Email,
+		Amount:      amount,
+		Currency:    strings.ToUpper(body.Currency),
+		CallbackURL: body.CallbackURL,
+		Status:      "abandoned", // what Paystack reports until the customer pays
+		CreatedAt:   time.Now(),
+	}
+	s.transactions[t.Reference] = t
+	s.accessCodes[t.AccessCode] = t.Reference
+
+	response := fiber.Map{
+		"status":  true,
+		"message": "Authorization URL created",
+		"data": fiber.Map{
+			"authorization_url": s.cfg.PublicURL + "/checkout/" + t.AccessCode,
+			"access_code":       t.AccessCode,
+			"reference":         t.Reference,
+		},
+	}
+	s.remember(key, response)
+	return c.JSON(response)
+}
+
+func (s *simulator) verify(c *fiber.Ctx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.transactions[c.Params("reference")]
+	if !ok {
+		return paystackError(c, 400, "Transaction reference not found")
+	}
+	return c.JSON(fiber.Map{
+		"status":  true,
+		"message": "Verification successful",
+		"data":    chargeData(t),
+	})
+}
+
+// chargeData is a transaction as verify and charge.success describe it
+func chargeData(t *transaction) fiber.Map {
+	amount := t.Amount
+	if t.Status == "success" {
+		amount = t.Charged
+	}
+	data := fiber.Map{
+		"id":               t.ID,
+		"domain":           "test",
+		"status":           t.Status,
+		"reference":        t.Reference,
+		"amount":           amount,
+		"currency":         t.Currency,
+		"gateway_response": t.Gateway,
+		"paid_at":          t.PaidAt,
+		"created_at":       t.CreatedAt,
+		"channel":          "card",
+		"customer":         fiber.Map{"email": t.Email},
+	}
+	if t.Card != nil {
+		data["authorization"] = fiber.Map{
+			"last4":     t.Card.Number[len(t.Card.Number)-4:],
+			"brand":     t.Card.Brand,
+			"card_type": t.Card.Brand,
+			"reusable":  true,
+		}
+	}
+	return data
+}
+
+func (s *simulator) refund(c *fiber.Ctx) error {
+	key, replayed := s.replay(c)
+	if replayed {
+		return nil
+	}
+
+	var body struct {
+		Transaction interface{} `json:"transaction"` // reference or id
+		Amount      json.Number `json:"amount"`      // omitted refunds what is left
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return paystackError(c, 400, "Invalid request body")
+	}
+	var amount int64
+	if body.Amount != "" {
+		n, err := body.Amount.Int64()
+		if err != nil || n <= 0 {
+			return paystackError(c, 400, "Invalid Amount Sent")
+		}
+		amount = n
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ref string
+	switch v := body.Transaction.(type) {
+	case string:
+		ref = v
+	case float64:
+		ref = strconv.FormatInt(int64(v), 10)
+	}
+	t := s.findTransaction(ref)
+	if t == nil {
+		return paystackError(c, 400, "Transaction not found")
+	}
+	if t.Status != "success" {
+		return paystackError(c, 400, "Transaction has not been paid")
+	}
+	left := t.Charged - t.Refunded
+	if amount == 0 {
+		amount = left
+	}
+	if amount > left || left == 0 {
+		return paystackError(c, 400, "Refund amount cannot be greater than the unrefunded amount of the transaction")
+	}
+
+	r := &refund{ID: s.nextID(), Transaction: t.Reference, Amount: amount, Currency: t.Currency, Status: "pending"}
+	s.refunds[r.ID] = r
+	t.Refunded += amount
+
+	go s.settleRefund(r.ID)
+
+	response := fiber.Map{
+		"status":  true,
+		"message": "Refund has been queued for processing",
+		"data": fiber.Map{
+			"id":              r.ID,
+			"status":          r.Status,
+			"amount":          r.Amount,
+			"currency":        r.Currency,
+			"deducted_amount": r.Amount,
+			"transaction":     fiber.Map{"id": t.ID, "reference": t.Reference},
+		},
+	}
+	s.remember(key, response)
+	return c.JSON(response)
+}
+
+// findTransaction finds a transaction by reference or id; s.mu must be held
+func (s *simulator) findTransaction(ref string) *transaction {
+	if t, ok := s.transactions[ref]; ok {
+		return t
+	}
+	if id, err := strconv.ParseInt(ref, 10, 64); err == nil {
+		for _, t := range s.transactions {
+			if t.ID == id {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// settleRefund tells us the refund is pending, then processes it. Cards
+// marked for it fail their refunds, which gives the money back to the merchant.
+func (s *simulator) settleRefund(id int64) {
+	// like Paystack, the webhook comes a moment after the API answered
+	time.Sleep(time.Second)
+	s.mu.Lock()
+	r := *s.refunds[id]
+	s.mu.Unlock()
+	s.webhook.send("refund.pending", refundData(&r))
+
+	time.Sleep(s.cfg.RefundDelay)
+
+	s.mu.Lock()
+	stored := s.refunds[id]
+	t := s.transactions[stored.Transaction]
+	stored.Status = "processed"
+	if t.Card != nil && t.Card.FailsRefunds {
+		stored.Status = "failed"
+		t.Refunded -= stored.Amount
+	}
+	r = *stored
+	s.mu.Unlock()
+	s.webhook.send("refund."+r.Status, refundData(&r))
+}
+
+func refundData(r *refund) fiber.Map {
+	return fiber.Map{
+		"id":                    r.ID,
+		"status":                r.Status,
+		"amount":                r.Amount,
+		"currency":              r.Currency,
+		"transaction_reference": r.Transaction,
+		"domain":                "test",
+	}
+}
+
+func (s *simulator) transfer(c *fiber.Ctx) error {
+	key, replayed := s.replay(c)
+	if replayed {
+		return nil
+	}
+
+	var body struct {
+		Source    string      `json:"source"`
+		Amount    json.Number `json:"amount"`
+		Recipient string      `json:"recipient"` // a code ending in _fail makes the transfer fail
+		Reason    string      `json:"reason"`
+		Reference string      `json:"reference"`
+		Currency  string      `json:"currency"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return paystackError(c, 400, "Invalid request body")
+	}
+	amount, err := body.Amount.Int64()
+	if err != nil || amount <= 0 {
+		return paystackError(c, 400, "Invalid Amount Sent")
+	}
+	if body.Recipient == "" {
+		return paystackError(c, 400, "Recipient specified is invalid")
+	}
+	if body.Currency == "" {
+		body.Currency = "NGN"
+	}
+	if body.Reference == "" {
+		body.Reference = randomCode("TRF_REF_")
+	}
+
+	s.mu.Lock()
+	data := fiber.Map{
+		"id":            s.nextID(),
+		"reference":     body.Reference,
+		"transfer_code": randomCode("TRF_"),
+		"status":        "pending",
+		"reason":        body.Reason,
+		"amount":        amount,
+		"currency":      strings.ToUpper(body.Currency),
+		"recipient":     body.Recipient,
+	}
+	response := fiber.Map{"status": true, "message": "Transfer has been queued", "data": data}
+	s.remember(key, response)
+	s.mu.Unlock()
+
+	go func() {
+		time.Sleep(s.cfg.RefundDelay)
+		done := fiber.Map{}
+		for k, v := range data {
+			done[k] = v
+		}
+		event := "transfer.success"
+		done["status"] = "success"
+		if strings.HasSuffix(body.Recipient, "_fail") {
+			event = "transfer.failed"
+			done["status"] = "failed"
+			done["reason"] = "Recipient account could not be credited"
+		}
+		s.webhook.send(event, done)
+	}()
+
+	return c.JSON(response)
+}
+
+// openDispute has the customer dispute a paid transaction. amount (minor
+// units) defaults to everything charged.
+func (s *simulator) openDispute(c *fiber.Ctx) error {
+	s.mu.Lock()
+	t, ok := s.transactions[c.Params("reference")]
+	if !ok || t.Status != "success" {
+		s.mu.Unlock()
+		return paystackError(c, 400, "Only paid transactions can be disputed")
+	}
+	amount := int64(c.QueryInt("amount", int(t.Charged)))
+	d := &dispute{ID: s.nextID(), Transaction: t.Reference, Amount: amount, Currency: t.Currency, Status: "awaiting-merchant-feedback"}
+	s.disputes[d.ID] = d
+	data := disputeData(d, t, "")
+	s.mu.Unlock()
+
+	s.webhook.send("charge.dispute.create", data)
+	return c.JSON(data)
+}
+
+// resolveDispute closes a dispute: resolution=declined means the merchant
+// won, merchant-accepted (the default) means the customer gets the money
+func (s *simulator) resolveDispute(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return paystackError(c, 400, "Invalid dispute id")
+	}
+	resolution := c.Query("resolution", "merchant-accepted")
+
+	s.mu.Lock()
+	d, ok := s.disputes[id]
+	if !ok || d.Status == "resolved" {
+		s.mu.Unlock()
+		return paystackError(c, 400, "Dispute not found or already resolved")
+	}
+	d.Status = "resolved"
+	data := disputeData(d, s.transactions[d.Transaction], resolution)
+	s.mu.Unlock()
+
+	s.webhook.send("charge.dispute.resolve", data)
+	return c.JSON(data)
+}
+
+func disputeData(d *dispute, t *transaction, resolution string) fiber.Map {
+	data := fiber.Map{
+		"id":            d.ID,
+		"status":        d.Status,
+		"category":      "chargeback",
+		"refund_amount": d.Amount,
+		"currency":      d.Currency,
+		"dueAt":         time.Now().Add(72 * time.Hour).UTC().Format(time.RFC3339),
+		"transaction": fiber.Map{
+			"id":        t.ID,
+			"reference": t.Reference,
+			"amount":    t.Charged,
+			"currency":  t.Currency,
+		},
+	}
+	if resolution != "" {
+		data["resolution"] = resolution
+	}
+	return data
+}
+
+// listTransactions shows what the simulator holds, newest first, for debugging
+func (s *simulator) listTransactions(c *fiber.Ctx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*transaction, 0, len(s.transactions))
+	for _, t := range s.transactions {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return c.JSON(fiber.Map{"transactions": list, "refunds": s.refunds, "disputes": s.disputes})
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// testCard decides how a checkout paid with it ends
+type testCard struct {
+	Number       string
+	Brand        string
+	Label        string
+	Outcome      string // success, failed or pending (succeeds after SIM_PENDING_DELAY)
+	Gateway      string // gateway_response Paystack reports
+	ShortBy      int64  // charged this much less than asked, to exercise the review queue
+	FailsRefunds bool
+}
+
+var testCards = []testCard{
+	{Number: "4084084084084081", Brand: "visa", Label: "Successful payment", Outcome: "success", Gateway: "Approved"},
+	{Number: "5060666666666666666", Brand: "verve", Label: "Successful payment, refunds fail", Outcome: "success", Gateway: "Approved", FailsRefunds: true},
+	{Number: "4000000000000002", Brand: "visa", Label: "Pending, succeeds later", Outcome: "pending", Gateway: "Transaction in progress"},
+	{Number: "4111111111111111", Brand: "visa", Label: "Charges 100 less than asked", Outcome: "success", Gateway: "Approved", ShortBy: 100},
+	{Number: "4084080000005408", Brand: "visa", Label: "Declined", Outcome: "failed", Gateway: "Declined"},
+	{Number: "5078507850785078", Brand: "mastercard", Label: "Insufficient funds", Outcome: "failed", Gateway: "Insufficient Funds"},
+}
+
+func findCard(number string) *testCard {
+	for i := range testCards {
+		if testCards[i].Number == number {
+			return &testCards[i]
+		}
+	}
+	return nil
+}
+
+var checkoutTemplate = template.Must(template.New("checkout").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<title>Paystack simulator checkout</title>
+</head>
+<body style="font-family: sans-serif; max-width: 32rem; margin: 2rem auto;">
+	<h1>Pay {{.Amount}}</h1>
+	<p>{{.Email}} &middot; reference <code>{{.Reference}}</code></p>
+	{{if .Message}}<p style="color:orange;">{{.Message}}</p>{{end}}
+	{{if .Open}}
+	<form method="post">
+		{{range .Cards}}
+		<p><button name="card" value="{{.Number}}" style="width:100%; text-align:left; padding:.6rem;">
+			<strong>{{.Label}}</strong><br><code>{{.Number}}</code> ({{.Brand}})
+		</button></p>
+		{{end}}
+		<p><button name="cancel" value="1" style="padding:.6rem;">Cancel payment</button></p>
+	</form>
+	{{end}}
+</body>
+</html>
+`))
+
+type checkoutView struct {
+	Amount    string
+	Email     string
+	Reference string
+	Message   string
+	Open      bool
+	Cards     []testCard
+}
+
+// checkout finds the transaction behind an access code; s.mu must be held
+func (s *simulator) checkout(code string) *transaction {
+	ref, ok := s.accessCodes[code]
+	if !ok {
+		return nil
+	}
+	return s.transactions[ref]
+}
+
+func (s *simulator) checkoutPage(c *fiber.Ctx) error {
+	s.mu.Lock()
+	t := s.checkout(c.Params("code"))
+	if t == nil {
+		s.mu.Unlock()
+		return c.Status(404).SendString("Checkout not found")
+	}
+	view := checkoutView{
+		Amount:    formatAmount(t.Amount, t.Currency),
+		Email:     t.Email,
+		Reference: t.Reference,
+		Open:      t.Status == "abandoned",
+		Cards:     testCards,
+	}
+	switch t.Status {
+	case "ongoing":
+		view.Message = "This payment is being processed."
+	case "success":
+		view.Message = "This payment is complete."
+	case "failed":
+		view.Message = "This payment failed: " + t.Gateway
+	}
+	s.mu.Unlock()
+
+	var html bytes.Buffer
+	if err := checkoutTemplate.Execute(&html, view); err != nil {
+		return c.Status(500).SendString(err.Error())
+	}
+	c.Set("Content-Type", "text/html")
+	return c.Send(html.Bytes())
+}
+
+// pay charges the chosen test card, or cancels, and sends the customer back
+// to the callback URL like Paystack does
+func (s *simulator) pay(c *fiber.Ctx) error {
+	s.mu.Lock()
+	t := s.checkout(c.Params("code"))
+	if t == nil {
+		s.mu.Unlock()
+		return c.Status(404).SendString("Checkout not found")
+	}
+	if t.Status != "abandoned" {
+		s.mu.Unlock()
+		return c.Redirect("/checkout/"+c.Params("code"), fiber.StatusSeeOther)
+	}
+
+	var success bool
+	if c.FormValue("cancel") == "" {
+		card := findCard(c.FormValue("card"))
+		if card == nil {
+			s.mu.Unlock()
+			return c.Status(400).SendString("Unknown test card")
+		}
+		t.Card = card
+		t.Gateway = card.Gateway
+		switch card.Outcome {
+		case "success":
+			s.charge(t)
+			success = true
+		case "pending":
+			t.Status = "ongoing"
+			go s.completeLater(t.Reference)
+		default:
+			t.Status = "failed"
+		}
+	}
+	var data map[string]interface{}
+	if success {
+		data = chargeData(t)
+	}
+	callback, ref := t.CallbackURL, t.Reference
+	s.mu.Unlock()
+
+	if success {
+		s.webhook.send("charge.success", data)
+	}
+	if callback == "" {
+		return c.Redirect("/checkout/"+c.Params("code"), fiber.StatusSeeOther)
+	}
+	return c.Redirect(withReference(callback, ref), fiber.StatusSeeOther)
+}
+
+// charge marks a transaction paid; s.mu must be held
+func (s *simulator) charge(t *transaction) {
+	now := time.Now()
+	t.Status = "success"
+	t.Charged = t.Amount - t.Card.ShortBy
+	if t.Charged < 1 {
+		t.Charged = 1
+	}
+	t.PaidAt = &now
+}
+
+// completeLater settles a pending checkout, as a slow bank eventually would
+func (s *simulator) completeLater(reference string) {
+	time.Sleep(s.cfg.PendingDelay)
+
+	s.mu.Lock()
+	t := s.transactions[reference]
+	if t.Status != "ongoing" {
+		s.mu.Unlock()
+		return
+	}
+	t.Gateway = "Approved"
+	s.charge(t)
+	data := chargeData(t)
+	s.mu.Unlock()
+
+	s.webhook.send("charge.success", data)
+}
+
+// withReference adds trxref and reference to the callback URL
+func withReference(callback, reference string) string {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return callback
+	}
+	q := u.Query()
+	q.Set("trxref", reference)
+	q.Set("reference", reference)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func formatAmount(amount int64, currency string) string {
+	return fmt.Sprintf("%s %d.%02d", currency, amount/100, amount%100)
+}
@@ -0,0 +1,92 @@
+// Command paystack-sim is a local stand-in for the Paystack API, so the
+// checkout, callback and webhook loop works without network access or keys.
+//
+//	PAYSTACK_SECRET_KEY=sk_test_sim go run ./cmd/paystack-sim
+//	PAYSTACK_SECRET_KEY=sk_test_sim PAYSTACK_BASE_URL=http://localhost:4010 go run .
+//
+// It serves /transaction/initialize, /transaction/verify/:reference, /refund
+// and /transfer like Paystack does, a hosted checkout page with test cards,
+// and sends webhooks signed with the secret key to SIM_WEBHOOK_URL.
+//
+// Settings: SIM_ADDR (:4010), SIM_PUBLIC_URL (http://localhost:4010),
+// SIM_WEBHOOK_URL (http://localhost:8080/v1/payments/webhooks/paystack),
+// SIM_REFUND_DELAY (3s) and SIM_PENDING_DELAY (30s).
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type config struct {
+	Addr         string
+	PublicURL    string        // where browsers reach the checkout page
+	SecretKey    string        // API callers must send it; webhooks are signed with it
+	WebhookURL   string        // our /v1/payments/webhooks/paystack
+	RefundDelay  time.Duration // until a queued refund is processed
+	PendingDelay time.Duration // until a checkout with the pending card succeeds
+}
+
+func configFromEnv() config {
+	return config{
+		Addr:         env("SIM_ADDR", ":4010"),
+		PublicURL:    strings.TrimRight(env("SIM_PUBLIC_URL", "http://localhost:4010"), "/"),
+		SecretKey:    env("PAYSTACK_SECRET_KEY", "sk_test_sim"),
+		WebhookURL:   env("SIM_WEBHOOK_URL", "http://localhost:8080/v1/payments/webhooks/paystack"),
+		RefundDelay:  envDuration("SIM_REFUND_DELAY", 3*time.Second),
+		PendingDelay: envDuration("SIM_PENDING_DELAY", 30*time.Second),
+	}
+}
+
+func env(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Printf("invalid %s=%q, using %s\n", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+func main() {
+	cfg := configFromEnv()
+	sim := newSimulator(cfg)
+
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	registerRoutes(app, sim)
+
+	fmt.Printf("paystack-sim on %s, checkout at %s, webhooks to %s\n", cfg.Addr, cfg.PublicURL, cfg.WebhookURL)
+	log.Fatal(app.Listen(cfg.Addr))
+}
+
+func registerRoutes(app *fiber.App, sim *simulator) {
+	// the Paystack API, behind the secret key
+	app.Post("/transaction/initialize", sim.requireSecretKey, sim.initialize)
+	app.Get("/transaction/verify/:reference", sim.requireSecretKey, sim.verify)
+	app.Post("/refund", sim.requireSecretKey, sim.refund)
+	app.Post("/transfer", sim.requireSecretKey, sim.transfer)
+
+	// the hosted checkout the customer is sent to
+	app.Get("/checkout/:code", sim.checkoutPage)
+	app.Post("/checkout/:code", sim.pay)
+
+	// simulator controls: things a real customer or bank would do
+	app.Post("/sim/transactions/:reference/dispute", sim.openDispute)
+	app.Post("/sim/disputes/:id/resolve", sim.resolveDispute)
+	app.Get("/sim/transactions", sim.listTransactions)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// transaction is a checkout as the simulator keeps it
+type transaction struct {
+	ID          int64      `json:"id"`
+	Reference   string     `json:"reference"`
+	AccessCode  string     `json:"access_code"`
+	Email       string     `json:"email"`
+	Amount      int64      `json:"amount"` // minor units
+	Currency    string     `json:"currency"`
+	CallbackURL string     `json:"callback_url"`
+	Status      string     `json:"status"` // ongoing, success, failed, abandoned
+	Gateway     string     `json:"gateway_response"`
+	Card        *testCard  `json:"-"`
+	Charged     int64      `json:"charged"` // what the card was charged, usually Amount
+	Refunded    int64      `json:"refunded"`
+	PaidAt      *time.Time `json:"paid_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+type refund struct {
+	ID          int64  `json:"id"`
+	Transaction string `json:"transaction_reference"`
+	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency"`
+	Status      string `json:"status"` // pending, processed, failed
+}
+
+type dispute struct {
+	ID          int64  `json:"id"`
+	Transaction string `json:"transaction_reference"`
+	Amount      int64  `json:"refund_amount"`
+	Currency    string `json:"currency"`
+	Status      string `json:"status"` // awaiting-merchant-feedback, resolved
+}
+
+// simulator holds what Paystack would know about our account
+type simulator struct {
+	cfg     config
+	webhook *webhookSender
+
+	mu           sync.Mutex
+	lastID       int64
+	transactions map[string]*transaction // by reference
+	accessCodes  map[string]string       // access code -> reference
+	refunds      map[int64]*refund
+	disputes     map[int64]*dispute
+	idempotent   map[string][]byte // Idempotency-Key -> first response body
+}
+
+func newSimulator(cfg config) *simulator {
+	return &simulator{
+		cfg:          cfg,
+		webhook:      newWebhookSender(cfg.WebhookURL, cfg.SecretKey),
+		transactions: make(map[string]*transaction),
+		accessCodes:  make(map[string]string),
+		refunds:      make(map[int64]*refund),
+		disputes:     make(map[int64]*dispute),
+		idempotent:   make(map[string][]byte),
+	}
+}
+
+// nextID numbers transactions, refunds, disputes and transfers; s.mu must be held
+func (s *simulator) nextID() int64 {
+	s.lastID++
+	return 4000000000 + s.lastID
+}
+
+func randomCode(prefix string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// remember keeps the first response of an Idempotency-Key; s.mu must be held
+func (s *simulator) remember(key string, response interface{}) {
+	if key == "" {
+		return
+	}
+	if body, err := json.Marshal(response); err == nil {
+		s.idempotent[key] = body
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookSender posts events the way Paystack does: the JSON body signed with
+// HMAC-SHA512 of the secret key in x-paystack-signature, retried while the
+// receiver does not answer 200
+type webhookSender struct {
+	url      string
+	secret   string
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+}
+
+func newWebhookSender(url, secret string) *webhookSender {
+	return &webhookSender{
+		url:      url,
+		secret:   secret,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		attempts: 5,
+		backoff:  2 * time.Second,
+	}
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// send delivers an event in the background
+func (w *webhookSender) send(event string, data interface{}) {
+	body, err := json.Marshal(map[string]interface{}{"event": event, "data": data})
+	if err != nil {
+		fmt.Printf("webhook %s: %v\n", event, err)
+		return
+	}
+	go w.deliver(event, body)
+}
+
+func (w *webhookSender) deliver(event string, body []byte) {
+	delay := w.backoff
+	for attempt := 1; attempt <= w.attempts; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			fmt.Printf("webhook %s delivered\n", event)
+			return
+		}
+		fmt.Printf("webhook %s, attempt %d of %d: %v\n", event, attempt, w.attempts, err)
+		if attempt < w.attempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+func (w *webhookSender) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-paystack-signature", sign(w.secret, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("receiver answered %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Package env reads the service settings from the environment. A value that
+// does not parse is reported and replaced by its default.
+package env
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration reads a duration such as "90s" or "15m" from the environment
+func Duration(key string, fallback time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Printf("invalid %s %q, using %s\n", key, v, fallback)
+		return fallback
+	}
+	return d
+}
+
+// Interval reads how often a worker runs; a ticker needs it positive
+func Interval(key string, fallback time.Duration) time.Duration {
+	d := Duration(key, fallback)
+	if d <= 0 {
+		fmt.Printf("invalid %s %s, using %s\n", key, d, fallback)
+		return fallback
+	}
+	return d
+}
+
+// Int reads a whole number such as "50" from the environment
+func Int(key string, fallback int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		fmt.Printf("invalid %s %q, using %d\n", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+// Durations reads a comma separated list such as "1m,5m,15m"
+func Durations(key string, fallback []time.Duration) []time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+
+	var out []time.Duration
+	for _, part := range strings.Split(v, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil {
+			fmt.Printf("invalid %s %q, using defaults\n", key, v)
+			return fallback
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// String reads a setting from the environment, or fallback when it is not set
+func String(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,229 @@
+package flutterwave
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+)
+
+// call sends a request to Flutterwave and decodes a 2xx answer into out
+func (f *FlutterwaveClient) call(ctx context.Context, method, path, idempotencyKey string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("marshal flutterwave request: %w", err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, f.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("create http request: %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+f.secretKey)
+	httpReq.Header.Set("Content-Type", "application/json")
+	if idempotencyKey != "" {
+		httpReq.Header.Set("X-Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := f.http.Do(httpReq)
+	if err != nil {
+		return requestError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errResp errorBody
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return statusError(resp.StatusCode, errResp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode flutterwave response: %w", err)
+	}
+	return nil
+}
+
+type paymentRequest struct {
+	TxRef       string      `json:"tx_ref"`
+	Amount      json.Number `json:"amount"`
+	Currency    string      `json:"currency"`
+	RedirectURL string      `json:"redirect_url"`
+	Customer    struct {
+		Email string `json:"email"`
+	} `json:"customer"`
+}
+
+// Authorize starts a Flutterwave Standard checkout. The payment ID is the
+// tx_ref, which is also what the transaction is verified by.
+func (f *FlutterwaveClient) Authorize(
+	ctx context.Context,
+	req payment.AuthorizeRequest,
+) (payment.AuthorizeResponse, error) {
+
+	payload := paymentRequest{
+		TxRef:       req.PaymentID,
+		Amount:      toMajor(req.Amount),
+		Currency:    string(req.Amount.Currency),
+		RedirectURL: req.CallbackURL,
+	}
+	payload.Customer.Email = req.Email
+
+	var fwResp struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Data    struct {
+			Link string `json:"link"`
+		} `json:"data"`
+	}
+	if err := f.call(ctx, http.MethodPost, "/v3/payments", req.OperationID, payload, &fwResp); err != nil {
+		return payment.AuthorizeResponse{}, err
+	}
+	if fwResp.Status != "success" {
+		return payment.AuthorizeResponse{}, providerError(fwResp.Message)
+	}
+
+	return payment.AuthorizeResponse{
+		Reference:        req.PaymentID,
+		AuthorizationURL: fwResp.Data.Link,
+	}, nil
+}
+
+// transaction is a Flutterwave transaction as verify_by_reference returns it
+type transaction struct {
+	ID       int64       `json:"id"`
+	TxRef    string      `json:"tx_ref"`
+	Status   string      `json:"status"` // see verifyStatus
+	Amount   json.Number `json:"amount"` // what we asked for; charged_amount adds the fees passed on to the customer
+	Currency string      `json:"currency"`
+}
+
+// findTransaction looks a transaction up by tx_ref. Flutterwave only knows
+// it once the customer has opened the checkout; found is false before that.
+// Flutterwave answers an unknown tx_ref with a 400, or a 404 on some versions.
+func (f *FlutterwaveClient) findTransaction(ctx context.Context, reference string) (t transaction, found bool, err error) {
+	var fwResp struct {
+		Status  string      `json:"status"`
+		Message string      `json:"message"`
+		Data    transaction `json:"data"`
+	}
+	path := "/v3/transactions/verify_by_reference?tx_ref=" + url.QueryEscape(reference)
+	if err := f.call(ctx, http.MethodGet, path, "", nil, &fwResp); err != nil {
+		var bankErr *payment.BankError
+		if errors.As(err, &bankErr) && (bankErr.Code == "http_400" || bankErr.Code == "http_404") {
+			return transaction{}, false, nil
+		}
+		return transaction{}, false, err
+	}
+	if fwResp.Status != "success" {
+		return transaction{}, false, providerError(fwResp.Message)
+	}
+	return fwResp.Data, true, nil
+}
+
+func (f *FlutterwaveClient) Verify(
+	ctx context.Context,
+	reference string,
+) (payment.VerifyResponse, error) {
+
+	t, found, err := f.findTransaction(ctx, reference)
+	if err != nil {
+		return payment.VerifyResponse{}, err
+	}
+	if !found {
+		return payment.VerifyResponse{
+			Reference:      reference,
+			Status:         payment.VerifyPending,
+			ProviderStatus: "not_found",
+		}, nil
+	}
+
+	currency := payment.Currency(strings.ToUpper(t.Currency))
+	amount, err := toMinor(t.Amount, currency)
+	if err != nil {
+		return payment.VerifyResponse{}, providerError(err.Error())
+	}
+
+	return payment.VerifyResponse{
+		Reference:      t.TxRef,
+		Status:         verifyStatus(t.Status),
+		ProviderStatus: t.Status,
+		Amount:         payment.Money{Amount: amount, Currency: currency},
+	}, nil
+}
+
+// verifyStatus maps Flutterwave's transaction statuses to checkout outcomes.
+// Anything unknown is treated as still pending so it gets verified again.
+func verifyStatus(status string) payment.VerifyStatus {
+	switch status {
+	case "successful":
+		return payment.VerifySuccess
+	case "cancelled":
+		return payment.VerifyAbandoned
+	case "failed":
+		return payment.VerifyFailed
+	default: // "pending"
+		return payment.VerifyPending
+	}
+}
+
+// Refund refunds a transaction by its Flutterwave id, which is looked up by
+// tx_ref first. Amount 0 refunds the whole transaction.
+func (f *FlutterwaveClient) Refund(
+	ctx context.Context,
+	req payment.RefundRequest,
+) (payment.RefundResponse, error) {
+
+	t, found, err := f.findTransaction(ctx, req.Reference)
+	if err != nil {
+		return payment.RefundResponse{}, err
+	}
+	if !found {
+		return payment.RefundResponse{}, providerError("No transaction was found for " + req.Reference)
+	}
+
+	payload := map[string]interface{}{}
+	if req.Amount.Amount > 0 {
+		payload["amount"] = toMajor(req.Amount)
+	}
+
+	var fwResp struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Data    struct {
+			ID     int64  `json:"id"`
+			Status string `json:"status"` // "completed", "pending", "failed"
+		} `json:"data"`
+	}
+	path := fmt.Sprintf("/v3/transactions/%d/refund", t.ID)
+	if err := f.call(ctx, http.MethodPost, path, req.OperationID, payload, &fwResp); err != nil {
+		return payment.RefundResponse{}, err
+	}
+	if fwResp.Status != "success" {
+		return payment.RefundResponse{}, providerError(fwResp.Message)
+	}
+
+	// the refund id is what Flutterwave's refund webhooks point back to
+	return payment.RefundResponse{
+		Reference: strconv.FormatInt(fwResp.Data.ID, 10),
+		Status:    fwResp.Data.Status,
+	}, nil
+}
+
+// Void releases an authorization. Flutterwave Standard charges the customer
+// at checkout, so like Paystack there is no hold to release.
+func (f *FlutterwaveClient) Void(
+	ctx context.Context,
+	req payment.VoidRequest,
+) (payment.VoidResponse, error) {
+	return payment.VoidResponse{Reference: req.Reference, Status: "voided"}, nil
+}
@@ -0,0 +1,188 @@
+package flutterwave_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Investorharry19/go-payment/internal/flutterwave"
+	"github.com/Investorharry19/go-payment/internal/payment"
+)
+
+// fakeFlutterwave answers the v3 endpoints the client uses. Transactions are
+// found by tx_ref, and requests need the secret key like the live API.
+type fakeFlutterwave struct {
+	transactions map[string]map[string]interface{}
+	payments     []map[string]interface{}
+	refunds      []map[string]interface{}
+}
+
+func newFakeFlutterwave(t *testing.T) (*fakeFlutterwave, *flutterwave.FlutterwaveClient) {
+	s := &fakeFlutterwave{transactions: make(map[string]map[string]interface{})}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v3/payments", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.payments = append(s.payments, body)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"link": "https://checkout.example/" + body["tx_ref"].(string)},
+		})
+	})
+	mux.HandleFunc("GET /v3/transactions/verify_by_reference", func(w http.ResponseWriter, r *http.Request) {
+		tx, ok := s.transactions[r.URL.Query().Get("tx_ref")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "message": "No transaction was found for this id"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": tx})
+	})
+	mux.HandleFunc("POST /v3/transactions/{id}/refund", func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		body["transaction"] = r.PathValue("id")
+		s.refunds = append(s.refunds, body)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"id": 75923, "status": "completed"},
+		})
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer FLWSECK_TEST-x" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "message": "Invalid authorization key"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return s, flutterwave.NewFlutterwaveClient("FLWSECK_TEST-x", server.URL+"/")
+}
+
+func TestAuthorizeSendsMajorUnits(t *testing.T) {
+	s, client := newFakeFlutterwave(t)
+
+	resp, err := client.Authorize(context.Background(), payment.AuthorizeRequest{
+		PaymentID: "pay_1",
+		Amount:    payment.Money{Amount: 502550, Currency: payment.NGN},
+		Email:     "customer@example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Reference != "pay_1" || resp.AuthorizationURL != "https://checkout.example/pay_1" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	if got := s.payments[0]["amount"]; got != 5025.5 {
+		t.Fatalf("sent amount %v, want 5025.50", got)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		tx     map[string]interface{}
+		status payment.VerifyStatus
+		amount int64
+	}{
+		{
+			name:   "successful",
+			tx:     map[string]interface{}{"id": 1, "tx_ref": "pay_1", "status": "successful", "amount": 5025.5, "charged_amount": 5025.5, "currency": "NGN"},
+			status: payment.VerifySuccess,
+			amount: 502550,
+		},
+		{
+			name:   "no decimals",
+			tx:     map[string]interface{}{"id": 1, "tx_ref": "pay_1", "status": "successful", "amount": 1500, "charged_amount": 1500, "currency": "UGX"},
+			status: payment.VerifySuccess,
+			amount: 1500,
+		},
+		{
+			name:   "fees passed on to the customer",
+			tx:     map[string]interface{}{"id": 1, "tx_ref": "pay_1", "status": "successful", "amount": 5000, "charged_amount": 5070, "currency": "NGN"},
+			status: payment.VerifySuccess,
+			amount: 500000,
+		},
+		{
+			name:   "failed",
+			tx:     map[string]interface{}{"id": 1, "tx_ref": "pay_1", "status": "failed", "amount": 50, "currency": "NGN"},
+			status: payment.VerifyFailed,
+			amount: 5000,
+		},
+		{
+			name:   "cancelled",
+			tx:     map[string]interface{}{"id": 1, "tx_ref": "pay_1", "status": "cancelled", "amount": 50, "currency": "NGN"},
+			status: payment.VerifyAbandoned,
+			amount: 5000,
+		},
+		{
+			name:   "not opened yet",
+			status: payment.VerifyPending,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, client := newFakeFlutterwave(t)
+			if tt.tx != nil {
+				s.transactions["pay_1"] = tt.tx
+			}
+
+			resp, err := client.Verify(context.Background(), "pay_1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != tt.status {
+				t.Fatalf("status %s, want %s", resp.Status, tt.status)
+			}
+			if resp.Amount.Amount != tt.amount {
+				t.Fatalf("amount %d, want %d", resp.Amount.Amount, tt.amount)
+			}
+		})
+	}
+}
+
+func TestRefundByTransactionID(t *testing.T) {
+	s, client := newFakeFlutterwave(t)
+	s.transactions["pay_1"] = map[string]interface{}{"id": 4321, "tx_ref": "pay_1", "status": "successful", "amount": 50, "currency": "NGN"}
+
+	resp, err := client.Refund(context.Background(), payment.RefundRequest{
+		Reference: "pay_1",
+		Amount:    payment.Money{Amount: 2050, Currency: payment.NGN},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Reference != "75923" {
+		t.Fatalf("refund reference %q", resp.Reference)
+	}
+	if s.refunds[0]["transaction"] != "4321" || s.refunds[0]["amount"] != 20.5 {
+		t.Fatalf("unexpected refund request %v", s.refunds[0])
+	}
+}
+
+func TestRefundUnknownTransaction(t *testing.T) {
+	_, client := newFakeFlutterwave(t)
+
+	_, err := client.Refund(context.Background(), payment.RefundRequest{Reference: "pay_404"})
+	var bankErr *payment.BankError
+	if !errors.As(err, &bankErr) || bankErr.Retryable {
+		t.Fatalf("expected a final bank error, got %v", err)
+	}
+}
+
+func TestParseWebhook(t *testing.T) {
+	e, err := flutterwave.ParseWebhook([]byte(`{"event":"charge.completed","data":{"id":285959875,"tx_ref":"pay_1","status":"successful"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Provider != "flutterwave" || e.EventID != "285959875" || e.Reference != "pay_1" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
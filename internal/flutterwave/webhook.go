@@ -0,0 +1,137 @@
+package flutterwave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+)
+
+// webhookEnvelope is what every Flutterwave webhook shares; Data is decoded
+// by the handler of the event
+type webhookEnvelope struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// chargeData is sent with charge.completed, whatever the outcome
+type chargeData struct {
+	ID     json.Number `json:"id"`
+	TxRef  string      `json:"tx_ref"`
+	Status string      `json:"status"`
+}
+
+// refundData is sent with refund.completed. ID is the refund, which the
+// refund operation keeps as its bank reference; tx_ref may be missing.
+type refundData struct {
+	ID     json.Number `json:"id"`
+	TxRef  string      `json:"tx_ref"`
+	Status string      `json:"status"` // "completed" or "failed"
+}
+
+// ParseWebhook turns a verified webhook body into an inbox event. Flutterwave
+// retries deliveries, so the event id and tx_ref are what dedupes them.
+func ParseWebhook(body []byte) (*payment.WebhookEvent, error) {
+	var envelope webhookEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Event == "" {
+		return nil, fmt.Errorf("webhook without an event")
+	}
+
+	var ids struct {
+		ID    json.Number `json:"id"`
+		TxRef string      `json:"tx_ref"`
+	}
+	if len(envelope.Data) > 0 {
+		if err := json.Unmarshal(envelope.Data, &ids); err != nil {
+			return nil, err
+		}
+	}
+	return &payment.WebhookEvent{
+		Provider:  "flutterwave",
+		Event:     envelope.Event,
+		EventID:   ids.ID.String(),
+		Reference: ids.TxRef,
+		Payload:   string(body),
+	}, nil
+}
+
+// webhookHandlers processes the stored Flutterwave webhooks
+type webhookHandlers struct {
+	store payment.Store
+	bank  payment.Bank
+}
+
+// NewWebhookHandler dispatches stored Flutterwave webhooks by event name.
+// Events without a handler are acknowledged and ignored.
+func NewWebhookHandler(store payment.Store, bank payment.Bank) payment.WebhookHandler {
+	h := &webhookHandlers{store: store, bank: bank}
+
+	return func(ctx context.Context, e *payment.WebhookEvent) error {
+		var envelope webhookEnvelope
+		if err := json.Unmarshal([]byte(e.Payload), &envelope); err != nil {
+			return fmt.Errorf("%w: %v", payment.ErrOperationFailed, err)
+		}
+
+		switch envelope.Event {
+		case "charge.completed":
+			var data chargeData
+			if err := json.Unmarshal(envelope.Data, &data); err != nil {
+				return fmt.Errorf("%w: %v", payment.ErrOperationFailed, err)
+			}
+			return h.chargeCompleted(ctx, data)
+		case "refund.completed":
+			var data refundData
+			if err := json.Unmarshal(envelope.Data, &data); err != nil {
+				return fmt.Errorf("%w: %v", payment.ErrOperationFailed, err)
+			}
+			return h.refundCompleted(ctx, data)
+		default:
+			fmt.Printf("flutterwave: ignoring %s webhook\n", envelope.Event)
+			return nil
+		}
+	}
+}
+
+// chargeCompleted is only a hint: the charge is verified with Flutterwave
+// before anything is captured, and a mismatch goes to review
+func (h *webhookHandlers) chargeCompleted(ctx context.Context, data chargeData) error {
+	_, _, err := h.store.ApplyVerification(
+		ctx,
+		h.bank,
+		data.TxRef,
+		"webhook",
+		payment.OperationParams{Actor: "flutterwave", Source: payment.SourceWebhook},
+	)
+	return err
+}
+
+// refundCompleted settles the pending refund of a payment either way. The
+// payment is found by the refund id, or by tx_ref for a refund we did not
+// record a reference for.
+func (h *webhookHandlers) refundCompleted(ctx context.Context, data refundData) error {
+	paymentID := data.TxRef
+	p, err := h.store.GetByBankReference("flutterwave", data.ID.String())
+	switch {
+	case err == nil:
+		paymentID = p.ID
+	case !errors.Is(err, payment.ErrPaymentNotFound) || data.TxRef == "":
+		return err
+	}
+
+	operation := payment.OPRefundProcessed
+	if data.Status == "failed" {
+		operation = payment.OPRefundFailed
+	}
+	opID := fmt.Sprintf("webhook-refund.completed-%s", data.ID)
+	_, err = h.store.Apply(ctx, h.bank, paymentID, opID, operation, payment.OperationParams{
+		BankReference: data.ID.String(),
+		Actor:         "flutterwave",
+		Source:        payment.SourceWebhook,
+	})
+	return err
+}
@@ -0,0 +1,155 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/middlewares"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// largest evidence file accepted, providers reject bigger uploads anyway
+const maxEvidenceSize = 10 << 20
+
+// BodyLimit is the largest request body the app has to accept: an evidence
+// file with room for the rest of the form
+const BodyLimit = maxEvidenceSize + 1<<20
+
+// GetDisputesController godoc
+// @Summary List disputes
+// @Description Lists chargebacks, the ones due first. Filter by status to find the ones waiting for evidence.
+// @Tags Disputes
+// @Produce json
+// @Param status query string false "open, awaiting_evidence, won or lost"
+// @Success 200 {array} payment.Dispute
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/disputes [get]
+func GetDisputesController(c *fiber.Ctx, store payment.DisputeStore) error {
+	disputes, err := store.Disputes(payment.DisputeStatus(c.Query("status")))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(disputes)
+}
+
+// GetDisputeByIdController godoc
+// @Summary Get a dispute
+// @Description Returns a dispute with the evidence attached so far
+// @Tags Disputes
+// @Produce json
+// @Param id path int true "Dispute ID"
+// @Success 200 {object} payment.Dispute
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/disputes/{id} [get]
+func GetDisputeByIdController(c *fiber.Ctx, store payment.DisputeStore) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid dispute id"})
+	}
+
+	d, err := store.Dispute(uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "dispute not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(d)
+}
+
+// AddDisputeEvidenceController godoc
+// @Summary Attach evidence to a dispute
+// @Description Adds a file, a note or both to an unresolved dispute
+// @Tags Disputes
+// @Accept multipart/form-data
+// @Produce json
+// @Param id path int true "Dispute ID"
+// @Param file formData file false "Evidence file, e.g. a delivery receipt"
+// @Param note formData string false "Note for the provider"
+// @Success 201 {object} payment.DisputeEvidence
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/disputes/{id}/evidence [post]
+func AddDisputeEvidenceController(c *fiber.Ctx, store payment.DisputeStore) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid dispute id"})
+	}
+
+	evidence := payment.DisputeEvidence{
+		Note:   c.FormValue("note"),
+		Author: middlewares.Subject(c),
+	}
+
+	if header, err := c.FormFile("file"); err == nil {
+		if header.Size > maxEvidenceSize {
+			return c.Status(400).JSON(fiber.Map{"error": "evidence file is too large"})
+		}
+		file, err := header.Open()
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		defer file.Close()
+
+		content, err := io.ReadAll(file)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		evidence.FileName = header.Filename
+		evidence.ContentType = header.Header.Get(fiber.HeaderContentType)
+		evidence.Content = content
+	}
+
+	added, err := store.AddEvidence(uint(id), evidence)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "dispute not found"})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(added)
+}
+
+// GetDisputeEvidenceFileController godoc
+// @Summary Download an evidence file
+// @Tags Disputes
+// @Produce octet-stream
+// @Param id path int true "Dispute ID"
+// @Param evidenceId path int true "Evidence ID"
+// @Success 200 {file} file
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/disputes/{id}/evidence/{evidenceId} [get]
+func GetDisputeEvidenceFileController(c *fiber.Ctx, store payment.DisputeStore) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid dispute id"})
+	}
+	evidenceID, err := strconv.ParseUint(c.Params("evidenceId"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid evidence id"})
+	}
+
+	e, err := store.EvidenceFile(uint(id), uint(evidenceID))
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && len(e.Content) == 0) {
+		return c.Status(404).JSON(fiber.Map{"error": "evidence file not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if e.ContentType != "" {
+		c.Set(fiber.HeaderContentType, e.ContentType)
+	}
+	c.Attachment(e.FileName)
+	return c.Send(e.Content)
+}
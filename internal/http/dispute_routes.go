@@ -0,0 +1,40 @@
+package http
+
+import (
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/middlewares"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RegisterDisputeRoutes serves the disputes of a store that keeps them; the
+// in-memory store keeps none and gets no dispute routes
+func RegisterDisputeRoutes(app *fiber.App, store payment.Store, idempotency fiber.Handler) {
+	disputes, ok := store.(payment.DisputeStore)
+	if !ok {
+		return
+	}
+	idempotency = optional(idempotency)
+
+	disputeRouters := app.Group("/v1/disputes", middlewares.JWTMiddleware())
+
+	// All disputes
+	disputeRouters.Get("/", func(c *fiber.Ctx) error {
+		return GetDisputesController(c, disputes)
+	})
+
+	// Dispute by ID, with its evidence
+	disputeRouters.Get("/:id", func(c *fiber.Ctx) error {
+		return GetDisputeByIdController(c, disputes)
+	})
+
+	// Attach a file or a note
+	disputeRouters.Post("/:id/evidence", idempotency, func(c *fiber.Ctx) error {
+		return AddDisputeEvidenceController(c, disputes)
+	})
+
+	// Download an attached file
+	disputeRouters.Get("/:id/evidence/:evidenceId", func(c *fiber.Ctx) error {
+		return GetDisputeEvidenceFileController(c, disputes)
+	})
+}
@@ -0,0 +1,61 @@
+package http
+
+import (
+	"errors"
+
+	"github.com/Investorharry19/go-payment/internal/ledger"
+	"github.com/Investorharry19/go-payment/internal/payment"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// GetLedgerBalancesController godoc
+// @Summary Get ledger account balances
+// @Description Sums the journal per account and currency. Balances are on each account's normal side.
+// @Tags Ledger
+// @Produce json
+// @Success 200 {array} ledger.Balance
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/ledger/balances [get]
+func GetLedgerBalancesController(c *fiber.Ctx, store payment.Store) error {
+	balances, err := store.Balances()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(balances)
+}
+
+// GetLedgerAccountsController godoc
+// @Summary List ledger accounts
+// @Tags Ledger
+// @Produce json
+// @Success 200 {array} ledger.Account
+// @Security ApiKeyAuth
+// @Router /v1/ledger/accounts [get]
+func GetLedgerAccountsController(c *fiber.Ctx) error {
+	return c.JSON(ledger.Accounts)
+}
+
+// GetPaymentJournalController godoc
+// @Summary Get the journal of a payment
+// @Description Lists the balanced ledger entries booked for a payment's operations, oldest first
+// @Tags Ledger
+// @Produce json
+// @Param id path string true "Payment ID"
+// @Success 200 {array} ledger.JournalEntry
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/payments/{id}/journal [get]
+func GetPaymentJournalController(c *fiber.Ctx, store payment.Store) error {
+	entries, err := store.Journal(c.Params("id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(entries)
+}
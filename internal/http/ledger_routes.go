@@ -0,0 +1,23 @@
+package http
+
+import (
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/middlewares"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func RegisterLedgerRoutes(app *fiber.App, store payment.Store) {
+
+	ledgerRouters := app.Group("/v1/ledger", middlewares.JWTMiddleware())
+
+	// Chart of accounts
+	ledgerRouters.Get("/accounts", func(c *fiber.Ctx) error {
+		return GetLedgerAccountsController(c)
+	})
+
+	// Balance of every account
+	ledgerRouters.Get("/balances", func(c *fiber.Ctx) error {
+		return GetLedgerBalancesController(c, store)
+	})
+}
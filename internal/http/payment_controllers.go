@@ -3,21 +3,31 @@ package http
 import (
 	"crypto/hmac"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/Investorharry19/go-payment/internal/flutterwave"
 	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/paystack"
+	"github.com/Investorharry19/go-payment/internal/stripe"
+	"github.com/Investorharry19/go-payment/middlewares"
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
 )
 
 // PaymentRequest represents the JSON body for creating a payment
 type PaymentRequest struct {
-	ID      string `json:"id" example:"pay_12345"`
-	Amount  int64  `json:"amount" example:"5000"`
-	Email   string `json:"email" example:"customer@example.com"`
-	UserId  string `json:"user_id" example:"user_123"`
-	OrderId string `json:"order_id" example:"order_123"`
+	ID       string `json:"id" example:"pay_12345"`
+	Amount   int64  `json:"amount" example:"5000"`
+	Currency string `json:"currency" example:"NGN"`
+	Email    string `json:"email" example:"customer@example.com"`
+	UserId   string `json:"user_id" example:"user_123"`
+	OrderId  string `json:"order_id" example:"order_123"`
+	Provider string `json:"provider" example:"paystack"`
 }
 
 // PaymentResponse represents the JSON response after creating a payment
@@ -34,23 +44,62 @@ type OperationResponse struct {
 
 // PaymentFullResponse represents a payment with operations
 type PaymentFullResponse struct {
-	ID         string              `json:"id" example:"pay_12345"`
-	Amount     int64               `json:"amount" example:"5000"`
-	UserId     string              `json:"user_id" example:"user_123"`
-	OrderId    string              `json:"order_id" example:"order_123"`
-	Operations []OperationResponse `json:"operations"`
+	ID             string              `json:"id" example:"pay_12345"`
+	Amount         int64               `json:"amount" example:"5000"`
+	Currency       string              `json:"currency" example:"NGN"`
+	CapturedAmount int64               `json:"captured_amount" example:"2000"`
+	RefundedAmount int64               `json:"refunded_amount" example:"500"`
+	UserId         string              `json:"user_id" example:"user_123"`
+	OrderId        string              `json:"order_id" example:"order_123"`
+	Operations     []OperationResponse `json:"operations"`
 }
 type PaymentResponseByID struct {
-	ID         string              `json:"id" example:"pay_12345"`
-	Amount     int64               `json:"amount" example:"5000"`
-	UserId     string              `json:"user_id" example:"user_123"`
-	OrderId    string              `json:"order_id" example:"order_123"`
-	Operations []OperationResponse `json:"operations"`
+	ID             string              `json:"id" example:"pay_12345"`
+	Amount         int64               `json:"amount" example:"5000"`
+	Currency       string              `json:"currency" example:"NGN"`
+	CapturedAmount int64               `json:"captured_amount" example:"2000"`
+	RefundedAmount int64               `json:"refunded_amount" example:"500"`
+	UserId         string              `json:"user_id" example:"user_123"`
+	OrderId        string              `json:"order_id" example:"order_123"`
+	Operations     []OperationResponse `json:"operations"`
 }
 
 // RefundRequest represents the JSON body for a refund
 type RefundRequest struct {
+	OperationID string `json:"operation_id" example:"op_12345" binding:"required"`
+	Amount      int64  `json:"amount" example:"1500"`
+	Currency    string `json:"currency" example:"NGN"`
+}
+
+// CaptureRequest represents the JSON body for a (partial) capture
+type CaptureRequest struct {
+	OperationID string `json:"operation_id" example:"op_12345" binding:"required"`
+	Amount      int64  `json:"amount" example:"2000"`
+	Currency    string `json:"currency" example:"NGN"`
+	Final       bool   `json:"final" example:"false"`
+}
+
+// PaymentStatesResponse describes the payment lifecycle
+type PaymentStatesResponse struct {
+	States      []payment.State      `json:"states"`
+	Transitions []payment.Transition `json:"transitions"`
+}
+
+// TimelineEntryResponse is one state change in a payment's history
+type TimelineEntryResponse struct {
+	Operation   string `json:"operation" example:"capture"`
+	OperationID string `json:"operation_id" example:"op_12345"`
+	From        string `json:"from" example:"authorized"`
+	To          string `json:"to" example:"captured"`
+	Actor       string `json:"actor" example:"harrison"`
+	Source      string `json:"source" example:"api"`
+	At          string `json:"at" example:"2025-12-31T05:23:02Z"`
+}
+
+// ReviewRequest represents the JSON body for resolving a payment under review
+type ReviewRequest struct {
 	OperationID string `json:"operation_id" example:"op_12345"`
+	Approve     bool   `json:"approve" example:"true"`
 }
 
 // PaymentRefundResponse represents a payment after refund (reuse existing payment struct)
@@ -60,7 +109,7 @@ type PaymentRefundResponse = PaymentFullResponse
 
 // CreatePaymentController godoc
 // @Summary Create a payment
-// @Description Creates a new payment and stores it in the database. Requires JWT authentication.
+// @Description Creates a new payment and stores it in the database. The provider (paystack, flutterwave or stripe) defaults to PAYMENT_PROVIDER. Requires JWT authentication.
 // @Tags Payments
 // @Accept json
 // @Produce json
@@ -71,18 +120,25 @@ type PaymentRefundResponse = PaymentFullResponse
 // @Failure 500 {object} ErrorResponse
 // @Security ApiKeyAuth
 // @Router /v1/payments [post]
-func CreatePaymentController(c *fiber.Ctx, store *payment.PaymentStoreDB, bank payment.Bank) error {
+func CreatePaymentController(c *fiber.Ctx, store payment.Store, bank payment.Bank) error {
 	var body struct {
-		ID      string `json:"id"`
-		Amount  int64  `json:"amount"`
-		Email   string `json:"email"`
-		UserId  string `json:"user_id"`
-		OrderId string `json:"order_id"`
+		ID       string `json:"id"`
+		Amount   int64  `json:"amount"`
+		Currency string `json:"currency"`
+		Email    string `json:"email"`
+		UserId   string `json:"user_id"`
+		OrderId  string `json:"order_id"`
+		Provider string `json:"provider"`
 	}
 	if err := c.BodyParser(&body); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
 	}
 
+	amount, err := payment.NewMoney(body.Amount, body.Currency)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	env := os.Getenv("ENV")
 	callbackUrl := ""
 	switch env {
@@ -94,22 +150,27 @@ func CreatePaymentController(c *fiber.Ctx, store *payment.PaymentStoreDB, bank p
 	fmt.Println(callbackUrl)
 	req := payment.AuthorizeRequest{
 		PaymentID:   body.ID,
-		Amount:      body.Amount,
+		Amount:      amount,
 		Email:       body.Email,
 		CallbackURL: fmt.Sprintf("%v/v1/payments/callback/verify", callbackUrl),
 		OperationID: "op-" + body.ID,
+		Provider:    body.Provider,
 	}
 	fmt.Println(req.Email)
 	resp, err := bank.Authorize(c.Context(), req)
+	if errors.Is(err, payment.ErrUnknownProvider) {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 	// Use resp.Reference and resp.AuthorizationURL as needed
 	p, err := store.Create(
 		body.ID,
-		body.Amount,
+		amount,
 		body.UserId,
 		body.OrderId,
+		resp.Provider,
 	)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
@@ -121,52 +182,95 @@ func CreatePaymentController(c *fiber.Ctx, store *payment.PaymentStoreDB, bank p
 	}{resp, p})
 }
 
-func VerifyPaymentInCallbackController(c *fiber.Ctx, store *payment.PaymentStoreDB, bank payment.Bank) error {
+func VerifyPaymentInCallbackController(c *fiber.Ctx, store payment.Store, bank payment.Bank) error {
 
 	reference := c.Query("reference")
 	if reference == "" {
 		return c.Status(400).SendString("Invalid payment reference")
 	}
 
-	// STEP 1: Show verifying page immediately
-	// (Optional UX improvement: stream HTML)
-	// We'll do full flow first
-
-	// STEP 2: Verify with Paystack
-	verifyResp, err := bank.Verify(c.Context(), reference)
-	if err != nil {
-		return renderHTML(c, "Payment verification failed", false)
+	// STEP 1: Load payment from DB
+	if _, err := store.Get(reference); err != nil {
+		return renderHTML(c, "Payment not found", false)
 	}
 
-	// STEP 3: Load payment from DB
-	_, err = store.Get(reference)
+	// STEP 2: Verify with Paystack and apply the outcome (idempotently)
+	p, verifyResp, err := store.ApplyVerification(
+		c.Context(),
+		bank,
+		reference,
+		"verify",
+		payment.OperationParams{Actor: "customer", Source: payment.SourceCallback},
+	)
 	if err != nil {
-		return renderHTML(c, "Payment not found", false)
+		if verifyResp.Status == "" {
+			return renderHTML(c, "Payment verification failed", false)
+		}
+		return renderHTML(c, "Failed to update payment state", false)
 	}
 
-	// Idempotency key for verification
-	opID := "verify-" + reference
-
-	// STEP 4: Apply state transition
-	var operation payment.Operation
+	// STEP 3: A customer sent back by the checkout's cancel button left
+	// without paying; the bank may not say so until the checkout expires
+	if c.QueryBool("cancelled") && verifyResp.Status == payment.VerifyPending &&
+		(p.State == payment.Initiated || p.State == payment.Pending) {
+		opID := fmt.Sprintf("callback-%s-%d-%s", reference, len(p.Operations), payment.OPAbandon)
+		if _, err := store.Apply(c.Context(), bank, reference, opID, payment.OPAbandon, payment.OperationParams{
+			Actor:  "customer",
+			Source: payment.SourceCallback,
+		}); err != nil {
+			return renderHTML(c, "Failed to update payment state", false)
+		}
+		verifyResp.Status = payment.VerifyAbandoned
+	}
+
+	// STEP 4: Final HTML response
+	if p.State == payment.NeedsReview {
+		return renderHTML(c, "We received your payment and are reviewing it. We will get back to you shortly.", false)
+	}
+	switch verifyResp.Status {
+	case payment.VerifySuccess:
+		return renderHTML(c, "Payment successful 🎉", true)
+	case payment.VerifyPending:
+		return renderPendingHTML(c, "Your payment is still being confirmed. This page refreshes on its own.")
+	case payment.VerifyAbandoned:
+		return renderHTML(c, "Payment was not completed. You can return to checkout and try again.", false)
+	default:
+		return renderHTML(c, "Payment failed", false)
+	}
+}
 
-	if verifyResp.Status == "success" {
-		operation = payment.OPCapture
-	} else {
-		operation = payment.OPVoid
+// VerifyPaymentController godoc
+// @Summary Verify a payment again
+// @Description Asks the bank for the current status of a pending or abandoned checkout and applies it: success captures, pending and abandoned stay open, failed ends the payment
+// @Tags Payments
+// @Produce json
+// @Param id path string true "Payment ID"
+// @Success 200 {object} PaymentFullResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 502 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/payments/{id}/verify [post]
+func VerifyPaymentController(c *fiber.Ctx, store payment.Store, bank payment.Bank) error {
+	id := c.Params("id")
+	if _, err := store.Get(id); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
 	}
 
-	if err := store.Apply(
+	p, verifyResp, err := store.ApplyVerification(
+		c.Context(),
 		bank,
-		reference,
-		opID,
-		operation,
-	); err != nil {
-		return renderHTML(c, "Failed to update payment state", false)
+		id,
+		"verify",
+		payment.OperationParams{Actor: middlewares.Subject(c), Source: payment.SourceAPI},
+	)
+	if err != nil && verifyResp.Status == "" {
+		return c.Status(502).JSON(fiber.Map{"error": err.Error()})
 	}
-
-	// STEP 5: Final HTML response
-	return renderHTML(c, "Payment successful 🎉", true)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(p)
 }
 
 // GetAllPaymentsController godoc
@@ -178,17 +282,128 @@ func VerifyPaymentInCallbackController(c *fiber.Ctx, store *payment.PaymentStore
 // @Failure 500 {object} ErrorResponse
 // @Security ApiKeyAuth
 // @Router /v1/payments [get]
-func GetAllPaymentsController(c *fiber.Ctx, store *payment.PaymentStoreDB) error {
-	var payments []payment.Payment
+func GetAllPaymentsController(c *fiber.Ctx, store payment.Store) error {
+	payments, err := store.List()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(payments)
+}
+
+// GetPaymentStatesController godoc
+// @Summary Get the payment lifecycle
+// @Description Lists every payment state and the transitions between them, including the guard that picks between transitions of the same operation
+// @Tags Payments
+// @Produce json
+// @Success 200 {object} PaymentStatesResponse
+// @Router /v1/payments/states [get]
+func GetPaymentStatesController(c *fiber.Ctx) error {
+	return c.JSON(PaymentStatesResponse{
+		States:      payment.AllStates,
+		Transitions: payment.Lifecycle.Transitions(),
+	})
+}
 
-	// Preload operations for each payment
-	if err := store.DB.Preload("Operations").Find(&payments).Error; err != nil {
+// CheckConsistencyController godoc
+// @Summary Check payments against their operation log
+// @Description Replays the operations of every payment through the state machine and lists the payments whose stored state disagrees. POST to the repair route overwrites the stored state with the replayed one.
+// @Tags Payments
+// @Produce json
+// @Success 200 {array} payment.Inconsistency
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/payments/consistency [get]
+// @Router /v1/payments/consistency/repair [post]
+func CheckConsistencyController(c *fiber.Ctx, store payment.Store, repair bool) error {
+	issues, err := store.CheckConsistency(repair)
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
+	return c.JSON(issues)
+}
 
+// GetReviewQueueController godoc
+// @Summary List payments waiting for review
+// @Description Lists the payments whose verified charge did not match their amount or currency, oldest first
+// @Tags Payments
+// @Produce json
+// @Success 200 {array} PaymentFullResponse
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/payments/review [get]
+func GetReviewQueueController(c *fiber.Ctx, store payment.Store) error {
+	payments, err := store.NeedingReview()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
 	return c.JSON(payments)
 }
 
+// ReviewPaymentController godoc
+// @Summary Resolve a payment under review
+// @Description Approving captures the payment, rejecting fails it. Only payments in needs_review can be resolved.
+// @Tags Payments
+// @Accept json
+// @Produce json
+// @Param id path string true "Payment ID"
+// @Param review body ReviewRequest true "Review decision"
+// @Success 200 {object} PaymentFullResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/payments/{id}/review [post]
+func ReviewPaymentController(c *fiber.Ctx, store payment.Store, bank payment.Bank) error {
+	id := c.Params("id")
+
+	var body struct {
+		OperationID string `json:"operation_id"`
+		Approve     bool   `json:"approve"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+
+	// only a payment parked for review can be approved; approving anything
+	// else would capture it without the bank ever confirming the charge.
+	// A retry of a review already made is replayed by the store.
+	stored, err := store.Get(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if stored.State != payment.NeedsReview && !appliedOperation(stored, body.OperationID) {
+		return c.Status(409).JSON(fiber.Map{"error": fmt.Sprintf("payment is %s, not %s", stored.State, payment.NeedsReview)})
+	}
+
+	operation := payment.OPFail
+	if body.Approve {
+		operation = payment.OPCapture
+	}
+
+	p, err := store.Apply(
+		c.Context(),
+		bank,
+		id,
+		body.OperationID,
+		operation,
+		payment.OperationParams{Actor: middlewares.Subject(c), Source: payment.SourceAPI},
+	)
+	if errors.Is(err, payment.ErrPaymentNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
+	}
+	if errors.Is(err, payment.ErrIdempotencyConflict) {
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(p)
+}
+
 // GetPaymentByIdController godoc
 // @Summary Get a payment by ID
 // @Description Retrieves a single payment by its ID, including operations
@@ -200,7 +415,7 @@ func GetAllPaymentsController(c *fiber.Ctx, store *payment.PaymentStoreDB) error
 // @Failure 500 {object} ErrorResponse
 // @Security ApiKeyAuth
 // @Router /v1/payments/{id} [get]
-func GetPaymentByIdController(c *fiber.Ctx, store *payment.PaymentStoreDB) error {
+func GetPaymentByIdController(c *fiber.Ctx, store payment.Store) error {
 	id := c.Params("id")
 	p, err := store.Get(id)
 	if err != nil {
@@ -209,9 +424,108 @@ func GetPaymentByIdController(c *fiber.Ctx, store *payment.PaymentStoreDB) error
 	return c.JSON(p)
 }
 
+// CapturePaymentController godoc
+// @Summary Capture a payment
+// @Description Captures part or all of an authorized payment. Omit amount to capture the remainder; set final to release whatever is left uncaptured.
+// @Tags Payments
+// @Accept json
+// @Produce json
+// @Param id path string true "Payment ID"
+// @Param capture body CaptureRequest true "Capture operation details"
+// @Success 200 {object} PaymentFullResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/payments/{id}/capture [post]
+func CapturePaymentController(c *fiber.Ctx, store payment.Store, bank payment.Bank) error {
+	id := c.Params("id")
+
+	var body struct {
+		OperationID string `json:"operation_id"`
+		Amount      int64  `json:"amount"`
+		Currency    string `json:"currency"`
+		Final       bool   `json:"final"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	// the operation ID is what tells a retry from another partial capture
+	if body.OperationID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "operation_id is required"})
+	}
+
+	amount, err := operationAmount(body.Amount, body.Currency)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Apply operation via DB-backed store; a retry returns the first response
+	p, err := store.Apply(
+		c.Context(),
+		bank,
+		id,
+		body.OperationID,
+		payment.OPCapture,
+		payment.OperationParams{
+			Amount: amount,
+			Final:  body.Final,
+			Actor:  middlewares.Subject(c),
+			Source: payment.SourceAPI,
+		},
+	)
+	if errors.Is(err, payment.ErrPaymentNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
+	}
+	if errors.Is(err, payment.ErrIdempotencyConflict) {
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(p)
+}
+
+// GetPaymentTimelineController godoc
+// @Summary Get the state history of a payment
+// @Description Lists every state change of a payment, oldest first, with the operation, actor and source that caused it
+// @Tags Payments
+// @Produce json
+// @Param id path string true "Payment ID"
+// @Success 200 {array} TimelineEntryResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/payments/{id}/timeline [get]
+func GetPaymentTimelineController(c *fiber.Ctx, store payment.Store) error {
+	id := c.Params("id")
+	transitions, err := store.Timeline(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	timeline := make([]TimelineEntryResponse, 0, len(transitions))
+	for _, t := range transitions {
+		timeline = append(timeline, TimelineEntryResponse{
+			Operation:   t.Operation,
+			OperationID: t.OperationID,
+			From:        string(t.FromState),
+			To:          string(t.ToState),
+			Actor:       t.Actor,
+			Source:      string(t.Source),
+			At:          t.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	return c.JSON(timeline)
+}
+
 // RefundPaymentController godoc
 // @Summary Refund a payment
-// @Description Applies a refund operation to a specific payment by ID
+// @Description Refunds part or all of a captured payment. Omit amount to refund everything still refundable; several partial refunds may be made until the captured amount is used up. The refund is sent to the bank and the payment stays refund_pending until the bank's webhook settles it.
 // @Tags Payments
 // @Accept json
 // @Produce json
@@ -220,46 +534,73 @@ func GetPaymentByIdController(c *fiber.Ctx, store *payment.PaymentStoreDB) error
 // @Success 200 {object} PaymentRefundResponse
 // @Failure 400 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Security ApiKeyAuth
 // @Router /v1/payments/{id}/refund [post]
-func RefundPaymentController(c *fiber.Ctx, store *payment.PaymentStoreDB, bank payment.Bank) error {
+func RefundPaymentController(c *fiber.Ctx, store payment.Store, bank payment.Bank) error {
 	id := c.Params("id")
 
 	var body struct {
 		OperationID string `json:"operation_id"`
+		Amount      int64  `json:"amount"`
+		Currency    string `json:"currency"`
 	}
 	if err := c.BodyParser(&body); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
 	}
 
-	fmt.Println("operation:", "operation_id:", body.OperationID)
+	// the operation ID is what tells a retry from another partial refund
+	if body.OperationID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "operation_id is required"})
+	}
 
-	// Apply operation via DB-backed store
-	err := store.Apply(
+	amount, err := operationAmount(body.Amount, body.Currency)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Apply operation via DB-backed store; a retry returns the first response
+	p, err := store.Apply(
+		c.Context(),
 		bank,
 		id,
 		body.OperationID,
 		payment.OPRefund,
+		payment.OperationParams{
+			Amount: amount,
+			Actor:  middlewares.Subject(c),
+			Source: payment.SourceAPI,
+		},
 	)
-	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	if errors.Is(err, payment.ErrPaymentNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
+	}
+	if errors.Is(err, payment.ErrIdempotencyConflict) || errors.Is(err, payment.ErrOperationInProgress) {
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
 	}
-
-	// Fetch updated payment with operations
-	p, err := store.Get(id)
 	if err != nil {
-		return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 	}
 
 	return c.JSON(p)
 
 }
 
+// PaystackWebhookController godoc
+// @Summary Receive a Paystack webhook
+// @Description Checks the signature and stores the raw event in the webhook inbox, where it is processed in the background. A repeated delivery is acknowledged and dropped.
+// @Tags Webhooks
+// @Accept json
+// @Produce plain
+// @Param x-paystack-signature header string true "HMAC SHA512 of the body"
+// @Success 200 {string} string "OK"
+// @Failure 400 {string} string "Invalid signature"
+// @Failure 500 {string} string "Server config error"
+// @Router /v1/payments/webhooks/paystack [post]
 func PaystackWebhookController(
 	c *fiber.Ctx,
-	store *payment.PaymentStoreDB,
-	bank payment.Bank,
+	inbox *payment.WebhookInbox,
 ) error {
 	// Get raw body for signature verification
 	body := c.Body()
@@ -281,53 +622,158 @@ func PaystackWebhookController(
 		return c.Status(400).SendString("Invalid signature")
 	}
 
-	// 2 Parse the webhook event
-	var event struct {
-		Event string `json:"event"`
-		Data  struct {
-			Reference string `json:"reference"`
-			Status    string `json:"status"`
-		} `json:"data"`
-	}
-	if err := c.BodyParser(&event); err != nil {
+	// 2 Parse just enough of the event to store and dedupe it
+	event, err := paystack.ParseWebhook(body)
+	if err != nil {
 		return c.Status(400).SendString("Invalid JSON")
 	}
 
-	paymentID := event.Data.Reference
+	// 3 Store it raw; if that fails Paystack has to deliver it again
+	if _, err := inbox.Receive(event); err != nil {
+		fmt.Printf("Failed to store %s webhook: %v\n", event.Event, err)
+		return c.Status(500).SendString("Failed to store event")
+	}
+
+	// 4 Respond 200 OK to Paystack, the inbox processes the event
+	return c.SendString("OK")
+}
 
-	// 3 Retrieve the payment from DB
-	stored, err := store.Get(paymentID)
-	if err != nil {
-		fmt.Printf("Payment not found: %s\n", paymentID)
-		return c.SendStatus(fiber.StatusOK) // acknowledge webhook
+// FlutterwaveWebhookController godoc
+// @Summary Receive a Flutterwave webhook
+// @Description Checks the verif-hash header against the secret hash set on the Flutterwave dashboard and stores the raw event in the webhook inbox, where it is processed in the background.
+// @Tags Webhooks
+// @Accept json
+// @Produce plain
+// @Param verif-hash header string true "Secret hash from the Flutterwave dashboard"
+// @Success 200 {string} string "OK"
+// @Failure 400 {string} string "Invalid signature"
+// @Failure 500 {string} string "Server config error"
+// @Router /v1/payments/webhooks/flutterwave [post]
+func FlutterwaveWebhookController(
+	c *fiber.Ctx,
+	inbox *payment.WebhookInbox,
+) error {
+	body := c.Body()
+	hash := c.Get("verif-hash")
+	if hash == "" {
+		return c.Status(400).SendString("Missing signature")
 	}
-	_ = stored
 
-	// 4 Verify with Paystack API
-	verifyResp, err := bank.Verify(c.Context(), paymentID)
+	secret := os.Getenv("FLUTTERWAVE_SECRET_HASH")
+	if secret == "" {
+		return c.Status(500).SendString("Server config error")
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(secret)) != 1 {
+		return c.Status(400).SendString("Invalid signature")
+	}
+
+	event, err := flutterwave.ParseWebhook(body)
 	if err != nil {
-		fmt.Printf("Paystack verify failed for %s: %v\n", paymentID, err)
-		return c.SendStatus(fiber.StatusOK)
+		return c.Status(400).SendString("Invalid JSON")
 	}
 
-	// 5 Determine operation based on verification
-	var operation payment.Operation
-	if verifyResp.Status == "success" {
-		operation = payment.OPCapture
-	} else {
-		operation = payment.OPVoid
+	// if storing fails Flutterwave has to deliver it again
+	if _, err := inbox.Receive(event); err != nil {
+		fmt.Printf("Failed to store %s webhook: %v\n", event.Event, err)
+		return c.Status(500).SendString("Failed to store event")
 	}
+	return c.SendString("OK")
+}
 
-	// 6 Apply operation (idempotently)
-	opID := "webhook-" + paymentID
-	if err := store.Apply(bank, paymentID, opID, operation); err != nil {
-		fmt.Printf("Failed to apply operation for %s: %v\n", paymentID, err)
+// StripeWebhookController godoc
+// @Summary Receive a Stripe webhook
+// @Description Checks the Stripe-Signature header against the endpoint's signing secret and stores the raw event in the webhook inbox, where it is processed in the background.
+// @Tags Webhooks
+// @Accept json
+// @Produce plain
+// @Param Stripe-Signature header string true "Timestamp and HMAC SHA256 of the body"
+// @Success 200 {string} string "OK"
+// @Failure 400 {string} string "Invalid signature"
+// @Failure 500 {string} string "Server config error"
+// @Router /v1/payments/webhooks/stripe [post]
+func StripeWebhookController(
+	c *fiber.Ctx,
+	inbox *payment.WebhookInbox,
+) error {
+	body := c.Body()
+	signature := c.Get("Stripe-Signature")
+	if signature == "" {
+		return c.Status(400).SendString("Missing signature")
 	}
 
-	// 7 Respond 200 OK to Paystack
+	secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if secret == "" {
+		return c.Status(500).SendString("Server config error")
+	}
+	if err := stripe.VerifySignature(body, signature, secret, stripe.SignatureTolerance, time.Now()); err != nil {
+		return c.Status(400).SendString("Invalid signature")
+	}
+
+	event, err := stripe.ParseWebhook(body)
+	if err != nil {
+		return c.Status(400).SendString("Invalid JSON")
+	}
+
+	// if storing fails Stripe has to deliver it again
+	if _, err := inbox.Receive(event); err != nil {
+		fmt.Printf("Failed to store %s webhook: %v\n", event.Event, err)
+		return c.Status(500).SendString("Failed to store event")
+	}
 	return c.SendString("OK")
 }
 
+// appliedOperation tells whether an operation ID already went through on a payment
+func appliedOperation(p *payment.Payment, operationID string) bool {
+	for _, op := range p.Operations {
+		if op.OperationID == operationID && op.Result == "success" {
+			return true
+		}
+	}
+	return false
+}
+
+// operationAmount builds the amount of a capture or refund. The currency is
+// optional and defaults to the payment's own currency; zero is everything
+// outstanding, and a negative amount is refused.
+func operationAmount(amount int64, currency string) (payment.Money, error) {
+	if amount < 0 {
+		return payment.Money{}, fmt.Errorf("%w: must be positive, got %d", payment.ErrInvalidAmount, amount)
+	}
+	if amount == 0 {
+		// the whole outstanding amount, in the payment's currency unless one is given
+		if currency == "" {
+			return payment.Money{}, nil
+		}
+		c, err := payment.ParseCurrency(currency)
+		return payment.Money{Currency: c}, err
+	}
+	if currency == "" {
+		return payment.Money{Amount: amount}, nil
+	}
+	return payment.NewMoney(amount, currency)
+}
+
+// renderPendingHTML tells the customer to wait and reloads the page, which
+// verifies the payment again
+func renderPendingHTML(c *fiber.Ctx, message string) error {
+	html := fmt.Sprintf(`
+<!DOCTYPE html>
+<html>
+<head>
+	<title>Payment Status</title>
+	<meta http-equiv="refresh" content="5">
+</head>
+<body style="font-family: sans-serif;">
+	<h1 style="color:orange;">Payment pending</h1>
+	<p>%s</p>
+</body>
+</html>
+`, message)
+
+	c.Set("Content-Type", "text/html")
+	return c.SendString(html)
+}
+
 func renderHTML(c *fiber.Ctx, message string, success bool) error {
 	status := "failed"
 	color := "red"
@@ -369,6 +815,7 @@ func AuthrizePaymentController(c *fiber.Ctx, store *payment.PaymentStoreDB, bank
 
 	// Apply operation via DB-backed store
 	err := store.Apply(
+		c.Context(),
 		bank,
 		id,
 		body.OperationID,
@@ -404,6 +851,7 @@ func VoidPaymentController(c *fiber.Ctx, store *payment.PaymentStoreDB, bank pay
 
 	// Apply operation via DB-backed store
 	err := store.Apply(
+		c.Context(),
 		bank,
 		id,
 		body.OperationID,
@@ -421,38 +869,5 @@ func VoidPaymentController(c *fiber.Ctx, store *payment.PaymentStoreDB, bank pay
 
 	return c.JSON(p)
 
-}
-
-func CapturePaymentController(c *fiber.Ctx, store *payment.PaymentStoreDB, bank payment.Bank) error {
-	id := c.Params("id")
-
-	var body struct {
-		OperationID string `json:"operation_id"`
-	}
-	if err := c.BodyParser(&body); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
-	}
-
-	fmt.Println("operation:", "operation_id:", body.OperationID)
-
-	// Apply operation via DB-backed store
-	err := store.Apply(
-		bank,
-		id,
-		body.OperationID,
-		payment.OPCapture,
-	)
-	if err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
-	}
-
-	// Fetch updated payment with operations
-	p, err := store.Get(id)
-	if err != nil {
-		return c.Status(404).JSON(fiber.Map{"error": "payment not found"})
-	}
-
-	return c.JSON(p)
-
 }
 */
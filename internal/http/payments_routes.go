@@ -1,20 +1,25 @@
 package http
 
 import (
-	"fmt"
-
 	"github.com/Investorharry19/go-payment/internal/payment"
 	"github.com/Investorharry19/go-payment/middlewares"
 
 	"github.com/gofiber/fiber/v2"
 )
 
-func RegisterPaymentRoutes(app *fiber.App, store *payment.PaymentStoreDB, bank payment.Bank) {
+// RegisterPaymentRoutes serves the payments of any store. idempotency guards
+// every authenticated POST route: it replays the stored response for a
+// repeated Idempotency-Key. The provider webhooks are deduped by event ID instead.
+// Both need a database and may be nil; without an inbox the provider webhooks
+// are not served.
+func RegisterPaymentRoutes(app *fiber.App, store payment.Store, bank payment.Bank, inbox *payment.WebhookInbox, idempotency fiber.Handler) {
+	idempotency = optional(idempotency)
 
 	paymentRouters := app.Group("/v1/payments")
+
 	// Create payment
 
-	paymentRouters.Post("/", middlewares.JWTMiddleware(), func(c *fiber.Ctx) error {
+	paymentRouters.Post("/", middlewares.JWTMiddleware(), idempotency, func(c *fiber.Ctx) error {
 		return CreatePaymentController(c, store, bank)
 	})
 
@@ -23,27 +28,89 @@ func RegisterPaymentRoutes(app *fiber.App, store *payment.PaymentStoreDB, bank p
 		return GetAllPaymentsController(c, store)
 	})
 
+	// Payment lifecycle (registered before /:id so it is not taken for an ID)
+	paymentRouters.Get("/states", func(c *fiber.Ctx) error {
+		return GetPaymentStatesController(c)
+	})
+
+	// Stored state vs. operation log
+	paymentRouters.Get("/consistency", middlewares.JWTMiddleware(), func(c *fiber.Ctx) error {
+		return CheckConsistencyController(c, store, false)
+	})
+	paymentRouters.Post("/consistency/repair", middlewares.JWTMiddleware(), idempotency, func(c *fiber.Ctx) error {
+		return CheckConsistencyController(c, store, true)
+	})
+
+	// Payments whose charge did not match, and their resolution
+	paymentRouters.Get("/review", middlewares.JWTMiddleware(), func(c *fiber.Ctx) error {
+		return GetReviewQueueController(c, store)
+	})
+	paymentRouters.Post("/:id/review", middlewares.JWTMiddleware(), idempotency, func(c *fiber.Ctx) error {
+		return ReviewPaymentController(c, store, bank)
+	})
+
 	// Get payment by ID
 	paymentRouters.Get("/:id", func(c *fiber.Ctx) error {
 		return GetPaymentByIdController(c, store)
 	})
 
+	// State history of a payment
+	paymentRouters.Get("/:id/timeline", func(c *fiber.Ctx) error {
+		return GetPaymentTimelineController(c, store)
+	})
+
+	// Ledger entries of a payment
+	paymentRouters.Get("/:id/journal", middlewares.JWTMiddleware(), func(c *fiber.Ctx) error {
+		return GetPaymentJournalController(c, store)
+	})
+
+	// Verify a pending or abandoned checkout again
+	paymentRouters.Post("/:id/verify", middlewares.JWTMiddleware(), idempotency, func(c *fiber.Ctx) error {
+		return VerifyPaymentController(c, store, bank)
+	})
+
 	// varify route
 	paymentRouters.Get("/callback/verify", func(c *fiber.Ctx) error {
 		return VerifyPaymentInCallbackController(c, store, bank)
 	})
 
-	//
-	paymentRouters.Post("/:id/refund", func(c *fiber.Ctx) error {
+	// Capture (partially or fully) an authorized payment
+	paymentRouters.Post("/:id/capture", middlewares.JWTMiddleware(), idempotency, func(c *fiber.Ctx) error {
+		return CapturePaymentController(c, store, bank)
+	})
+
+	// Refund (partially or fully) a captured payment
+	paymentRouters.Post("/:id/refund", middlewares.JWTMiddleware(), idempotency, func(c *fiber.Ctx) error {
 		return RefundPaymentController(c, store, bank)
 	})
 
-	// Webhook for Paystack events
+	if inbox == nil {
+		return
+	}
+
+	// Webhook for Paystack events, stored and processed by the inbox
 	paymentRouters.Post("/webhooks/paystack", func(c *fiber.Ctx) error {
-		fmt.Println("Paystack webhook received")
-		return PaystackWebhookController(c, store, bank)
+		return PaystackWebhookController(c, inbox)
 	})
 
+	// Webhook for Flutterwave events, stored and processed by the inbox
+	paymentRouters.Post("/webhooks/flutterwave", func(c *fiber.Ctx) error {
+		return FlutterwaveWebhookController(c, inbox)
+	})
+
+	// Webhook for Stripe events, stored and processed by the inbox
+	paymentRouters.Post("/webhooks/stripe", func(c *fiber.Ctx) error {
+		return StripeWebhookController(c, inbox)
+	})
+
+}
+
+// optional lets requests through a middleware that is not configured
+func optional(h fiber.Handler) fiber.Handler {
+	if h == nil {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	return h
 }
 
 type PaystackWebhookEvent struct {
@@ -0,0 +1,157 @@
+package http_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/http"
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/payment/paymenttest"
+	"github.com/Investorharry19/go-payment/middlewares"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newApp serves the payment routes of an in-memory store, without an inbox
+// or idempotency keys, and returns a token the JWT middleware accepts
+func newApp(t *testing.T) (*fiber.App, *paymenttest.Bank, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := middlewares.PublicKey
+	middlewares.PublicKey = &key.PublicKey
+	t.Cleanup(func() { middlewares.PublicKey = previous })
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "tester",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	bank := paymenttest.NewBank()
+	store := payment.NewPaymentStore()
+	http.RegisterPaymentRoutes(app, store, bank, nil, nil)
+	http.RegisterWebhookRoutes(app, store, nil, nil)
+	http.RegisterDisputeRoutes(app, store, nil)
+	http.RegisterLedgerRoutes(app, store)
+	return app, bank, token
+}
+
+// call sends a request and decodes a JSON answer into out, when given
+func call(t *testing.T, app *fiber.App, method, path, token, body string, out interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(raw, out); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, raw)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestPaymentRoutesWithoutDatabase(t *testing.T) {
+	app, bank, token := newApp(t)
+
+	if status := call(t, app, "POST", "/v1/payments", token, `{"id":"pay_1","amount":10000,"currency":"NGN","user_id":"usr_1","order_id":"ord_1"}`, nil); status != 200 {
+		t.Fatalf("create: %d", status)
+	}
+
+	// the customer comes back from checkout, the bank reports the charge
+	if status := call(t, app, "GET", "/v1/payments/callback/verify?reference=pay_1", "", "", nil); status != 200 {
+		t.Fatalf("callback: %d", status)
+	}
+	var p payment.Payment
+	if status := call(t, app, "GET", "/v1/payments/pay_1", "", "", &p); status != 200 || p.State != payment.Captured {
+		t.Fatalf("get: %d, state %s", status, p.State)
+	}
+
+	if status := call(t, app, "POST", "/v1/payments/pay_1/refund", token, `{"operation_id":"op_refund","amount":2500}`, &p); status != 200 || p.State != payment.RefundPending {
+		t.Fatalf("refund: %d, state %s", status, p.State)
+	}
+	if status := call(t, app, "POST", "/v1/payments/pay_1/refund", token, `{"operation_id":"op_negative","amount":-2500}`, nil); status != 400 {
+		t.Fatalf("negative refund: %d", status)
+	}
+	if calls := bank.Calls(paymenttest.MethodRefund); len(calls) != 1 || calls[0].Amount.Amount != 2500 {
+		t.Fatalf("refunds sent to the bank: %+v", calls)
+	}
+
+	var timeline []http.TimelineEntryResponse
+	if status := call(t, app, "GET", "/v1/payments/pay_1/timeline", "", "", &timeline); status != 200 || len(timeline) != 2 {
+		t.Fatalf("timeline: %d, %+v", status, timeline)
+	}
+	if timeline[1].Actor != "tester" {
+		t.Fatalf("refund made by %q, want the token's subject", timeline[1].Actor)
+	}
+}
+
+func TestPaymentRouteErrors(t *testing.T) {
+	app, _, token := newApp(t)
+	if status := call(t, app, "POST", "/v1/payments", token, `{"id":"pay_1","amount":10000,"currency":"NGN"}`, nil); status != 200 {
+		t.Fatalf("create: %d", status)
+	}
+
+	tests := []struct {
+		name, method, path, token, body string
+		want                            int
+	}{
+		{name: "payment of nothing", method: "POST", path: "/v1/payments", token: token, body: `{"id":"pay_2","amount":0,"currency":"NGN"}`, want: 400},
+		{name: "negative payment", method: "POST", path: "/v1/payments", token: token, body: `{"id":"pay_2","amount":-100,"currency":"NGN"}`, want: 400},
+		{name: "without a token", method: "POST", path: "/v1/payments/pay_1/capture", body: `{"operation_id":"op_1"}`, want: 401},
+		{name: "capture without an operation id", method: "POST", path: "/v1/payments/pay_1/capture", token: token, body: `{"amount":100}`, want: 400},
+		{name: "refund without an operation id", method: "POST", path: "/v1/payments/pay_1/refund", token: token, body: `{"amount":100}`, want: 400},
+		{name: "unknown payment", method: "POST", path: "/v1/payments/pay_2/capture", token: token, body: `{"operation_id":"op_1"}`, want: 404},
+		{name: "refund before capture", method: "POST", path: "/v1/payments/pay_1/refund", token: token, body: `{"operation_id":"op_1"}`, want: 400},
+		{name: "review of a payment not in review", method: "POST", path: "/v1/payments/pay_1/review", token: token, body: `{"operation_id":"op_1","approve":true}`, want: 409},
+		{name: "no inbox for provider webhooks", method: "POST", path: "/v1/payments/webhooks/paystack", body: `{}`, want: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := call(t, app, tt.method, tt.path, tt.token, tt.body, nil); status != tt.want {
+				t.Fatalf("status %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
+
+func TestCancelledCheckoutIsAbandoned(t *testing.T) {
+	app, bank, token := newApp(t)
+	if status := call(t, app, "POST", "/v1/payments", token, `{"id":"pay_1","amount":10000,"currency":"NGN"}`, nil); status != 200 {
+		t.Fatalf("create: %d", status)
+	}
+
+	// the bank has not heard of the checkout ending yet
+	bank.VerifyNext("pay_1", payment.VerifyResponse{Status: payment.VerifyPending})
+	if status := call(t, app, "GET", "/v1/payments/callback/verify?reference=pay_1&cancelled=true", "", "", nil); status != 200 {
+		t.Fatalf("callback: %d", status)
+	}
+	var p payment.Payment
+	if status := call(t, app, "GET", "/v1/payments/pay_1", "", "", &p); status != 200 || p.State != payment.Abandoned {
+		t.Fatalf("get: %d, state %s", status, p.State)
+	}
+}
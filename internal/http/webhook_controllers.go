@@ -0,0 +1,277 @@
+package http
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/middlewares"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// ReplayResponse reports how many webhook events were queued again
+type ReplayResponse struct {
+	Replayed int64 `json:"replayed" example:"3"`
+}
+
+// GetWebhookEventsController godoc
+// @Summary List stored webhook events
+// @Description Lists the webhook inbox, newest first. Filter by status to find failed or dead-lettered events.
+// @Tags Webhooks
+// @Produce json
+// @Param status query string false "received, processing, processed, failed or dead"
+// @Param limit query int false "Maximum number of events" default(50)
+// @Success 200 {array} payment.WebhookEvent
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/webhooks/events [get]
+func GetWebhookEventsController(c *fiber.Ctx, inbox *payment.WebhookInbox) error {
+	events, err := inbox.Events(c.Query("status"), c.QueryInt("limit", 50))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(events)
+}
+
+// ReplayWebhookEventController godoc
+// @Summary Replay a webhook event
+// @Description Queues a stored event to be processed again, whatever its status
+// @Tags Webhooks
+// @Produce json
+// @Param id path int true "Webhook event ID"
+// @Success 202 {object} ReplayResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/webhooks/events/{id}/replay [post]
+func ReplayWebhookEventController(c *fiber.Ctx, inbox *payment.WebhookInbox) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid event id"})
+	}
+
+	err = inbox.Replay(uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "webhook event not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(202).JSON(ReplayResponse{Replayed: 1})
+}
+
+// ReplayFailedWebhookEventsController godoc
+// @Summary Replay every failed webhook event
+// @Description Queues every failed and dead-lettered event to be processed again
+// @Tags Webhooks
+// @Produce json
+// @Success 202 {object} ReplayResponse
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/webhooks/events/replay [post]
+func ReplayFailedWebhookEventsController(c *fiber.Ctx, inbox *payment.WebhookInbox) error {
+	n, err := inbox.ReplayFailed()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(202).JSON(ReplayResponse{Replayed: n})
+}
+
+// WebhookEndpointRequest represents the JSON body for registering a merchant webhook endpoint
+type WebhookEndpointRequest struct {
+	URL         string   `json:"url" example:"https://orders.example.com/webhooks/payments"`
+	Description string   `json:"description" example:"order service"`
+	EventTypes  []string `json:"event_types" example:"payment.captured,payment.refunded"` // empty means every event
+}
+
+// WebhookEndpointCreatedResponse is a new endpoint with its signing secret,
+// which is never shown again
+type WebhookEndpointCreatedResponse struct {
+	payment.WebhookEndpoint
+	Secret string `json:"secret" example:"whsec_5f2b..."`
+}
+
+// WebhookEndpointUpdateRequest represents the JSON body for turning an endpoint off or on
+type WebhookEndpointUpdateRequest struct {
+	Enabled bool `json:"enabled" example:"true"`
+}
+
+// CreateWebhookEndpointController godoc
+// @Summary Register a merchant webhook endpoint
+// @Description The endpoint receives a signed POST for every payment creation (payment.created) and state change (payment.<state>) it subscribes to. Verify the X-Webhook-Signature header (t=<unix>,v1=<HMAC-SHA256 of "<t>.<body>">) with the returned secret.
+// @Tags Webhooks
+// @Accept json
+// @Produce json
+// @Param endpoint body WebhookEndpointRequest true "Endpoint"
+// @Success 201 {object} WebhookEndpointCreatedResponse
+// @Failure 400 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/webhooks/endpoints [post]
+func CreateWebhookEndpointController(c *fiber.Ctx, store payment.WebhookEndpointStore) error {
+	var body WebhookEndpointRequest
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+
+	endpoint, secret, err := store.CreateWebhookEndpoint(body.URL, body.Description, body.EventTypes, middlewares.Subject(c))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(201).JSON(WebhookEndpointCreatedResponse{WebhookEndpoint: *endpoint, Secret: secret})
+}
+
+// GetWebhookEndpointsController godoc
+// @Summary List merchant webhook endpoints
+// @Tags Webhooks
+// @Produce json
+// @Success 200 {array} payment.WebhookEndpoint
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/webhooks/endpoints [get]
+func GetWebhookEndpointsController(c *fiber.Ctx, store payment.WebhookEndpointStore) error {
+	endpoints, err := store.WebhookEndpoints()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(endpoints)
+}
+
+// UpdateWebhookEndpointController godoc
+// @Summary Turn a merchant webhook endpoint off or on
+// @Description Enabling an endpoint, e.g. one disabled after repeated failures, resets its failure count and resumes its pending deliveries
+// @Tags Webhooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Endpoint ID"
+// @Param endpoint body WebhookEndpointUpdateRequest true "Update"
+// @Success 200 {object} payment.WebhookEndpoint
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/webhooks/endpoints/{id} [patch]
+func UpdateWebhookEndpointController(c *fiber.Ctx, store payment.WebhookEndpointStore) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid endpoint id"})
+	}
+	var body WebhookEndpointUpdateRequest
+	if err := c.BodyParser(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+	}
+
+	endpoint, err := store.SetWebhookEndpointEnabled(uint(id), body.Enabled)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "webhook endpoint not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(endpoint)
+}
+
+// DeleteWebhookEndpointController godoc
+// @Summary Remove a merchant webhook endpoint
+// @Description Deliveries still waiting for the endpoint are dropped
+// @Tags Webhooks
+// @Param id path int true "Endpoint ID"
+// @Success 204
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/webhooks/endpoints/{id} [delete]
+func DeleteWebhookEndpointController(c *fiber.Ctx, store payment.WebhookEndpointStore) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid endpoint id"})
+	}
+
+	err = store.DeleteWebhookEndpoint(uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "webhook endpoint not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.SendStatus(204)
+}
+
+// GetWebhookDeliveriesController godoc
+// @Summary List the deliveries of a merchant webhook endpoint
+// @Tags Webhooks
+// @Produce json
+// @Param id path int true "Endpoint ID"
+// @Param status query string false "pending, delivered or dead"
+// @Param limit query int false "Maximum number of deliveries" default(50)
+// @Success 200 {array} payment.WebhookDelivery
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/webhooks/endpoints/{id}/deliveries [get]
+func GetWebhookDeliveriesController(c *fiber.Ctx, store payment.WebhookEndpointStore) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid endpoint id"})
+	}
+
+	deliveries, err := store.WebhookDeliveries(uint(id), c.Query("status"), c.QueryInt("limit", 50))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(deliveries)
+}
+
+// GetWebhookDeliveryController godoc
+// @Summary Get a delivery with its attempt log
+// @Tags Webhooks
+// @Produce json
+// @Param id path int true "Delivery ID"
+// @Success 200 {object} payment.WebhookDelivery
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/webhooks/deliveries/{id} [get]
+func GetWebhookDeliveryController(c *fiber.Ctx, store payment.WebhookEndpointStore) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid delivery id"})
+	}
+
+	delivery, err := store.WebhookDelivery(uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "webhook delivery not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(delivery)
+}
+
+// RedeliverWebhookController godoc
+// @Summary Send a delivery again
+// @Description Queues a delivery again with a full set of retries, whether it was delivered or given up
+// @Tags Webhooks
+// @Produce json
+// @Param id path int true "Delivery ID"
+// @Success 202 {object} payment.WebhookDelivery
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Security ApiKeyAuth
+// @Router /v1/webhooks/deliveries/{id}/redeliver [post]
+func RedeliverWebhookController(c *fiber.Ctx, store payment.WebhookEndpointStore) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid delivery id"})
+	}
+
+	delivery, err := store.Redeliver(uint(id))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "webhook delivery not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(202).JSON(delivery)
+}
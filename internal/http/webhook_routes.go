@@ -0,0 +1,70 @@
+package http
+
+import (
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/middlewares"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RegisterWebhookRoutes serves the webhook inbox and the merchant endpoints.
+// Without an inbox, or with a store that keeps no endpoints like the
+// in-memory one, those routes are left out.
+func RegisterWebhookRoutes(app *fiber.App, store payment.Store, inbox *payment.WebhookInbox, idempotency fiber.Handler) {
+	idempotency = optional(idempotency)
+
+	webhookRouters := app.Group("/v1/webhooks", middlewares.JWTMiddleware())
+
+	if inbox != nil {
+		registerInboxRoutes(webhookRouters, inbox)
+	}
+	if endpoints, ok := store.(payment.WebhookEndpointStore); ok {
+		registerEndpointRoutes(webhookRouters, endpoints, idempotency)
+	}
+}
+
+func registerInboxRoutes(webhookRouters fiber.Router, inbox *payment.WebhookInbox) {
+
+	// Stored webhook events
+	webhookRouters.Get("/events", func(c *fiber.Ctx) error {
+		return GetWebhookEventsController(c, inbox)
+	})
+
+	// Replay every failed and dead event
+	webhookRouters.Post("/events/replay", func(c *fiber.Ctx) error {
+		return ReplayFailedWebhookEventsController(c, inbox)
+	})
+
+	// Replay one event
+	webhookRouters.Post("/events/:id/replay", func(c *fiber.Ctx) error {
+		return ReplayWebhookEventController(c, inbox)
+	})
+}
+
+func registerEndpointRoutes(webhookRouters fiber.Router, store payment.WebhookEndpointStore, idempotency fiber.Handler) {
+
+	// Merchant endpoints told about payment state changes
+	webhookRouters.Post("/endpoints", idempotency, func(c *fiber.Ctx) error {
+		return CreateWebhookEndpointController(c, store)
+	})
+	webhookRouters.Get("/endpoints", func(c *fiber.Ctx) error {
+		return GetWebhookEndpointsController(c, store)
+	})
+	webhookRouters.Patch("/endpoints/:id", func(c *fiber.Ctx) error {
+		return UpdateWebhookEndpointController(c, store)
+	})
+	webhookRouters.Delete("/endpoints/:id", func(c *fiber.Ctx) error {
+		return DeleteWebhookEndpointController(c, store)
+	})
+
+	// What was sent to an endpoint, and sending it again
+	webhookRouters.Get("/endpoints/:id/deliveries", func(c *fiber.Ctx) error {
+		return GetWebhookDeliveriesController(c, store)
+	})
+	webhookRouters.Get("/deliveries/:id", func(c *fiber.Ctx) error {
+		return GetWebhookDeliveryController(c, store)
+	})
+	webhookRouters.Post("/deliveries/:id/redeliver", func(c *fiber.Ctx) error {
+		return RedeliverWebhookController(c, store)
+	})
+}
@@ -0,0 +1,202 @@
+package ledger
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var ErrUnbalanced = fmt.Errorf("journal entry is not balanced")
+
+// AccountCode identifies a ledger account
+type AccountCode string
+
+const (
+	CustomerReceivable AccountCode = "customer_receivable" // owed to us for the customer's charges
+	AuthorizedFunds    AccountCode = "authorized_funds"    // held on the customer's card, not captured yet
+	MerchantBalance    AccountCode = "merchant_balance"    // owed to the merchant
+	Fees               AccountCode = "fees"                // our cut of every capture
+	RefundsPayable     AccountCode = "refunds_payable"     // refunds sent to the provider, not settled yet
+)
+
+// Account is a ledger account and the side its balance grows on
+type Account struct {
+	Code        AccountCode `json:"code"`
+	Name        string      `json:"name"`
+	DebitNormal bool        `json:"debit_normal"`
+}
+
+// Accounts lists every ledger account
+var Accounts = []Account{
+	{Code: CustomerReceivable, Name: "Customer receivable", DebitNormal: true},
+	{Code: AuthorizedFunds, Name: "Authorized funds"},
+	{Code: MerchantBalance, Name: "Merchant balance"},
+	{Code: Fees, Name: "Fees"},
+	{Code: RefundsPayable, Name: "Refunds payable"},
+}
+
+func findAccount(code AccountCode) (Account, bool) {
+	for _, a := range Accounts {
+		if a.Code == code {
+			return a, true
+		}
+	}
+	return Account{}, false
+}
+
+// JournalEntry is one balanced booking, written for a payment operation
+type JournalEntry struct {
+	ID          uint          `json:"id" gorm:"primaryKey"`
+	PaymentID   string        `json:"payment_id" gorm:"not null;index"`
+	OperationID string        `json:"operation_id" gorm:"not null;index"`
+	Description string        `json:"description"`
+	Lines       []JournalLine `json:"lines" gorm:"foreignKey:EntryID"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+// JournalLine moves an amount in or out of one account; exactly one of
+// Debit and Credit is set
+type JournalLine struct {
+	ID       uint        `json:"-" gorm:"primaryKey"`
+	EntryID  uint        `json:"-" gorm:"not null;index"`
+	Account  AccountCode `json:"account" gorm:"not null;index"`
+	Debit    int64       `json:"debit" gorm:"not null;default:0"`  // minor units
+	Credit   int64       `json:"credit" gorm:"not null;default:0"` // minor units
+	Currency string      `json:"currency" gorm:"not null"`
+}
+
+func NewEntry(paymentID, operationID, description string) *JournalEntry {
+	return &JournalEntry{PaymentID: paymentID, OperationID: operationID, Description: description}
+}
+
+// Debit adds a debit line; zero amounts are left out
+func (e *JournalEntry) Debit(account AccountCode, amount int64, currency string) *JournalEntry {
+	if amount != 0 {
+		e.Lines = append(e.Lines, JournalLine{Account: account, Debit: amount, Currency: currency})
+	}
+	return e
+}
+
+// Credit adds a credit line; zero amounts are left out
+func (e *JournalEntry) Credit(account AccountCode, amount int64, currency string) *JournalEntry {
+	if amount != 0 {
+		e.Lines = append(e.Lines, JournalLine{Account: account, Credit: amount, Currency: currency})
+	}
+	return e
+}
+
+// Validate checks that every line uses a known account and that debits and
+// credits are equal in every currency
+func (e *JournalEntry) Validate() error {
+	totals := map[string]int64{}
+	for _, l := range e.Lines {
+		if _, ok := findAccount(l.Account); !ok {
+			return fmt.Errorf("unknown account: %s", l.Account)
+		}
+		if l.Debit < 0 || l.Credit < 0 || (l.Debit == 0) == (l.Credit == 0) {
+			return fmt.Errorf("%w: line on %s needs one positive side", ErrUnbalanced, l.Account)
+		}
+		totals[l.Currency] += l.Debit - l.Credit
+	}
+	for currency, diff := range totals {
+		if diff != 0 {
+			return fmt.Errorf("%w: %s %s off by %d", ErrUnbalanced, e.OperationID, currency, diff)
+		}
+	}
+	return nil
+}
+
+// Post validates an entry and writes it with its lines. Run it inside the
+// transaction that changes the payment so the books never drift from it.
+// An entry without lines (nothing moved) is not written.
+func Post(tx *gorm.DB, e *JournalEntry) error {
+	if len(e.Lines) == 0 {
+		return nil
+	}
+	if err := e.Validate(); err != nil {
+		return err
+	}
+	return tx.Create(e).Error
+}
+
+// Balance is the position of one account in one currency
+type Balance struct {
+	Account  AccountCode `json:"account"`
+	Currency string      `json:"currency"`
+	Debit    int64       `json:"debit"`
+	Credit   int64       `json:"credit"`
+	Balance  int64       `json:"balance"` // on the account's normal side
+}
+
+// Balances sums the journal per account and currency
+func Balances(db *gorm.DB) ([]Balance, error) {
+	balances := []Balance{}
+	err := db.Model(&JournalLine{}).
+		Select("account, currency, SUM(debit) AS debit, SUM(credit) AS credit").
+		Group("account, currency").
+		Order("account, currency").
+		Scan(&balances).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range balances {
+		balances[i].settle()
+	}
+	return balances, nil
+}
+
+// Sum adds up lines kept outside the database, the same way Balances does
+func Sum(lines []JournalLine) []Balance {
+	type key struct {
+		account  AccountCode
+		currency string
+	}
+	totals := map[key]*Balance{}
+	for _, l := range lines {
+		k := key{l.Account, l.Currency}
+		b, ok := totals[k]
+		if !ok {
+			b = &Balance{Account: l.Account, Currency: l.Currency}
+			totals[k] = b
+		}
+		b.Debit += l.Debit
+		b.Credit += l.Credit
+	}
+
+	balances := make([]Balance, 0, len(totals))
+	for _, b := range totals {
+		b.settle()
+		balances = append(balances, *b)
+	}
+	sort.Slice(balances, func(i, j int) bool {
+		if balances[i].Account != balances[j].Account {
+			return balances[i].Account < balances[j].Account
+		}
+		return balances[i].Currency < balances[j].Currency
+	})
+	return balances
+}
+
+// settle puts the balance on the account's normal side
+func (b *Balance) settle() {
+	b.Balance = b.Credit - b.Debit
+	if a, ok := findAccount(b.Account); ok && a.DebitNormal {
+		b.Balance = b.Debit - b.Credit
+	}
+}
+
+// Journal returns the entries of a payment, oldest first
+func Journal(db *gorm.DB, paymentID string) ([]JournalEntry, error) {
+	entries := []JournalEntry{}
+	err := db.Preload("Lines", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).
+		Where("payment_id = ?", paymentID).
+		Order("id").
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,28 @@
+package outbox
+
+import "context"
+
+// ChannelPublisher hands messages to a consumer in the same process, e.g. a
+// cache invalidator or a test. Publish blocks while the channel is full.
+type ChannelPublisher struct {
+	C chan Message
+}
+
+func NewChannelPublisher(buffer int) *ChannelPublisher {
+	return &ChannelPublisher{C: make(chan Message, buffer)}
+}
+
+func (p *ChannelPublisher) Publish(ctx context.Context, m Message) error {
+	select {
+	case p.C <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close closes the channel, so consumers ranging over it stop
+func (p *ChannelPublisher) Close() error {
+	close(p.C)
+	return nil
+}
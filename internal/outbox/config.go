@@ -0,0 +1,35 @@
+package outbox
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/env"
+)
+
+// RelayConfigFromEnv reads OUTBOX_INTERVAL, OUTBOX_BATCH_SIZE and OUTBOX_LEASE
+func RelayConfigFromEnv() RelayConfig {
+	return RelayConfig{
+		Interval:  env.Interval("OUTBOX_INTERVAL", time.Second),
+		BatchSize: env.Int("OUTBOX_BATCH_SIZE", 100),
+		Lease:     env.Duration("OUTBOX_LEASE", DefaultLease),
+	}
+}
+
+// PublisherFromEnv builds the publisher named by OUTBOX_PUBLISHER:
+//
+//	file   NDJSON lines appended to OUTBOX_FILE (default outbox.ndjson, "-" for stdout)
+//
+// It returns nil when OUTBOX_PUBLISHER is not set. The channel publisher is
+// only for consumers in the same process and is not configured here.
+func PublisherFromEnv() (Publisher, error) {
+	switch kind := os.Getenv("OUTBOX_PUBLISHER"); kind {
+	case "":
+		return nil, nil
+	case "file":
+		return OpenNDJSONFile(env.String("OUTBOX_FILE", "outbox.ndjson"))
+	default:
+		return nil, fmt.Errorf("unknown OUTBOX_PUBLISHER %q, want file", kind)
+	}
+}
@@ -0,0 +1,74 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// NDJSONPublisher appends every message as one JSON line, to a file that log
+// shippers or batch jobs pick up, or to stdout
+type NDJSONPublisher struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer // nil for writers the publisher does not own
+}
+
+// ndjsonLine is one line of the sink; the event is embedded as JSON, not as a string
+type ndjsonLine struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Key       string          `json:"key"`
+	CreatedAt time.Time       `json:"created_at"`
+	Event     json.RawMessage `json:"event"`
+}
+
+func NewNDJSONPublisher(w io.Writer) *NDJSONPublisher {
+	return &NDJSONPublisher{w: w}
+}
+
+// OpenNDJSONFile appends to path, creating it if needed; "-" is stdout
+func OpenNDJSONFile(path string) (*NDJSONPublisher, error) {
+	if path == "-" {
+		return NewNDJSONPublisher(os.Stdout), nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &NDJSONPublisher{w: f, c: f}, nil
+}
+
+func (p *NDJSONPublisher) Publish(_ context.Context, m Message) error {
+	line, err := json.Marshal(ndjsonLine{
+		ID:        m.EventID,
+		Type:      m.Type,
+		Key:       m.Key,
+		CreatedAt: m.CreatedAt,
+		Event:     json.RawMessage(m.Payload),
+	})
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// a message only counts as published once it is on disk
+	if f, ok := p.w.(*os.File); ok && p.c != nil {
+		return f.Sync()
+	}
+	return nil
+}
+
+func (p *NDJSONPublisher) Close() error {
+	if p.c == nil {
+		return nil
+	}
+	return p.c.Close()
+}
@@ -0,0 +1,77 @@
+package outbox_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/outbox"
+)
+
+func TestNDJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	pub := outbox.NewNDJSONPublisher(&buf)
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	messages := []outbox.Message{
+		{EventID: "evt_1", Type: "payment.created", Key: "pay_1", Payload: `{"amount":5000}`, CreatedAt: created},
+		{EventID: "evt_2", Type: "payment.captured", Key: "pay_1", Payload: `{"amount":5000,"state":"captured"}`, CreatedAt: created},
+	}
+	for _, m := range messages {
+		if err := pub.Publish(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	for i := 0; scanner.Scan(); i++ {
+		var line struct {
+			ID        string          `json:"id"`
+			Type      string          `json:"type"`
+			Key       string          `json:"key"`
+			CreatedAt time.Time       `json:"created_at"`
+			Event     json.RawMessage `json:"event"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		m := messages[i]
+		if line.ID != m.EventID || line.Type != m.Type || line.Key != m.Key || !line.CreatedAt.Equal(created) {
+			t.Fatalf("line %d: %s", i, scanner.Text())
+		}
+		// the event is embedded as an object, not as a string
+		if string(line.Event) != m.Payload {
+			t.Fatalf("line %d: event %s, want %s", i, line.Event, m.Payload)
+		}
+	}
+}
+
+func TestNDJSONFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.ndjson")
+
+	for _, id := range []string{"evt_1", "evt_2"} {
+		pub, err := outbox.OpenNDJSONFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pub.Publish(context.Background(), outbox.Message{EventID: id, Type: "payment.created", Payload: `{}`}); err != nil {
+			t.Fatal(err)
+		}
+		if err := pub.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(content, []byte("\n")); lines != 2 {
+		t.Fatalf("%d lines after two runs, want 2:\n%s", lines, content)
+	}
+}
@@ -0,0 +1,51 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Message is a domain event waiting in the outbox table until the relay has
+// published it
+type Message struct {
+	ID          uint       `json:"-" gorm:"primaryKey"`
+	EventID     string     `json:"id" gorm:"not null;uniqueIndex"`
+	Type        string     `json:"type" gorm:"not null"` // e.g. payment.captured
+	Key         string     `json:"key" gorm:"not null"`  // what the event is about, e.g. the payment ID
+	Payload     string     `json:"payload" gorm:"type:text;not null"`
+	CreatedAt   time.Time  `json:"created_at"`
+	PublishedAt *time.Time `json:"-" gorm:"index"`
+	LeasedUntil *time.Time `json:"-"` // a relay is publishing it until then
+	Attempts    int        `json:"-" gorm:"not null;default:0"`
+	LastError   string     `json:"-"`
+}
+
+func (Message) TableName() string {
+	return "outbox"
+}
+
+// Publisher hands messages to a broker, a file or another process. Publish
+// returns once the message is accepted; the relay retries it otherwise, so
+// consumers may see a message more than once and dedupe on its ID.
+type Publisher interface {
+	Publish(ctx context.Context, m Message) error
+	Close() error
+}
+
+// Add writes an event to the outbox. Call it with the transaction that makes
+// the change, so the event is published if and only if the change commits.
+func Add(tx *gorm.DB, eventID, eventType, key string, event any) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&Message{
+		EventID: eventID,
+		Type:    eventType,
+		Key:     key,
+		Payload: string(payload),
+	}).Error
+}
@@ -0,0 +1,134 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RelayConfig tunes the publishing of the outbox
+type RelayConfig struct {
+	Interval  time.Duration // how often the relay looks for new messages
+	BatchSize int           // messages published per round
+	Lease     time.Duration // how long a round may take before another relay takes over
+}
+
+// DefaultLease is how long a relay holds a batch when RelayConfig.Lease is not
+// set; well above the time publishers wait for a broker
+const DefaultLease = time.Minute
+
+// Relay publishes outbox messages in the order they were written. A message
+// that cannot be published holds back the ones after it until it goes through.
+type Relay struct {
+	db     *gorm.DB
+	pub    Publisher
+	config RelayConfig
+}
+
+func NewRelay(db *gorm.DB, pub Publisher, config RelayConfig) *Relay {
+	if config.Lease == 0 {
+		config.Lease = DefaultLease
+	}
+	return &Relay{db: db, pub: pub, config: config}
+}
+
+// Run publishes until ctx is cancelled, then closes the publisher
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.config.Interval)
+	defer ticker.Stop()
+	defer r.pub.Close()
+
+	for {
+		// drain the backlog before waiting for the next tick
+		for {
+			n, err := r.RelayOnce(ctx)
+			if err != nil {
+				fmt.Printf("outbox: %v\n", err)
+			}
+			if err != nil || n < r.config.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RelayOnce publishes one batch and returns how many messages went out. The
+// batch is leased in a short transaction and published outside of it; while
+// the oldest message is leased, a second relay waits instead of publishing
+// the ones after it out of order.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	batch, err := r.lease()
+	if err != nil || len(batch) == 0 {
+		return 0, err
+	}
+
+	published := 0
+	for i, m := range batch {
+		if pubErr := r.pub.Publish(ctx, m); pubErr != nil {
+			fmt.Printf("outbox: publish %s %s: %v\n", m.Type, m.EventID, pubErr)
+			if err := r.db.Model(&Message{}).Where("id = ?", m.ID).Updates(map[string]interface{}{
+				"attempts":   gorm.Expr("attempts + 1"),
+				"last_error": pubErr.Error(),
+			}).Error; err != nil {
+				return published, err
+			}
+			// keep the order: the rest waits for this one, whichever relay tries next
+			return published, r.release(batch[i:])
+		}
+		now := time.Now()
+		if err := r.db.Model(&Message{}).Where("id = ?", m.ID).
+			Updates(map[string]interface{}{"published_at": now, "last_error": "", "leased_until": nil}).Error; err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+// release gives up the lease of messages that were not published
+func (r *Relay) release(batch []Message) error {
+	return r.db.Model(&Message{}).Where("id IN ?", ids(batch)).Update("leased_until", nil).Error
+}
+
+// lease claims the oldest unpublished messages for one round, unless another
+// relay holds them. A relay that dies mid-round loses its lease after
+// RelayConfig.Lease and the batch is published again.
+func (r *Relay) lease() ([]Message, error) {
+	var batch []Message
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("published_at IS NULL").
+			Order("id").
+			Limit(r.config.BatchSize).
+			Find(&batch).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if len(batch) == 0 || (batch[0].LeasedUntil != nil && batch[0].LeasedUntil.After(now)) {
+			batch = nil
+			return nil
+		}
+		return tx.Model(&Message{}).Where("id IN ?", ids(batch)).
+			Update("leased_until", now.Add(r.config.Lease)).Error
+	})
+	return batch, err
+}
+
+func ids(batch []Message) []uint {
+	ids := make([]uint, len(batch))
+	for i, m := range batch {
+		ids[i] = m.ID
+	}
+	return ids
+}
@@ -0,0 +1,44 @@
+package payment
+
+import (
+	"sync"
+	"time"
+)
+
+// Alert tells the operations team that a payment needs a human
+type Alert struct {
+	PaymentID string    `json:"payment_id"`
+	Kind      string    `json:"kind"` // e.g. amount_mismatch
+	Message   string    `json:"message"`
+	At        time.Time `json:"at"`
+}
+
+// AlertHandler receives every raised alert
+type AlertHandler func(a Alert)
+
+var (
+	alertMu       sync.RWMutex
+	alertHandlers []AlertHandler
+)
+
+// OnAlert registers a handler for alerts, e.g. to page someone or post to chat
+func OnAlert(h AlertHandler) {
+	alertMu.Lock()
+	defer alertMu.Unlock()
+	alertHandlers = append(alertHandlers, h)
+}
+
+// RaiseAlert sends an alert to every registered handler
+func RaiseAlert(a Alert) {
+	if a.At.IsZero() {
+		a.At = time.Now()
+	}
+
+	alertMu.RLock()
+	handlers := alertHandlers
+	alertMu.RUnlock()
+
+	for _, h := range handlers {
+		h(a)
+	}
+}
@@ -2,41 +2,107 @@ package payment
 
 import (
 	"context"
+	"fmt"
+	"time"
 )
 
 type Bank interface {
 	Authorize(ctx context.Context, req AuthorizeRequest) (AuthorizeResponse, error)
 	Verify(ctx context.Context, reference string) (VerifyResponse, error)
 	Refund(ctx context.Context, req RefundRequest) (RefundResponse, error)
+	Void(ctx context.Context, req VoidRequest) (VoidResponse, error)
 }
 
 type AuthorizeRequest struct {
+	Provider    string // empty for the default one
 	PaymentID   string
 	OperationID string // idempotency key
-	Amount      int64
-	Currency    string
+	Amount      Money
 	Email       string
 	CallbackURL string
 }
 
 type AuthorizeResponse struct {
+	Provider         string // set by Providers: the one that took the payment
 	Reference        string
 	AuthorizationURL string
 }
 
+// VerifyStatus is the outcome of a checkout, as mapped by the Bank from the provider's status
+type VerifyStatus string
+
+const (
+	VerifySuccess    VerifyStatus = "success"
+	VerifyAuthorized VerifyStatus = "authorized" // funds held, waiting for a capture
+	VerifyPending    VerifyStatus = "pending"    // still in progress, verify again later
+	VerifyAbandoned  VerifyStatus = "abandoned"
+	VerifyFailed     VerifyStatus = "failed"
+)
+
 type VerifyResponse struct {
-	Reference string
-	Status    string // success, failed
-	Amount    int64
-	Currency  string
+	Reference      string
+	Status         VerifyStatus
+	ProviderStatus string // the provider's own status, e.g. Paystack's "ongoing"
+	Amount         Money
+
+	// authorized only: when the provider drops the hold, zero if it does not say
+	AuthorizedUntil time.Time
+}
+
+// OperationForVerification maps a verification outcome to the operation it applies
+func OperationForVerification(status VerifyStatus) Operation {
+	switch status {
+	case VerifySuccess:
+		return OPCapture
+	case VerifyAuthorized:
+		return OPAuthorize
+	case VerifyAbandoned:
+		return OPAbandon
+	case VerifyFailed:
+		return OPFail
+	default:
+		return OPMarkPending
+	}
 }
 
 type RefundRequest struct {
-	Reference string
-	Amount    int64
+	Provider    string // of the payment
+	OperationID string // idempotency key
+	Reference   string
+	Amount      Money
 }
 
 type RefundResponse struct {
 	Reference string
 	Status    string
 }
+
+// VoidRequest releases what is left of an authorization
+type VoidRequest struct {
+	Provider    string // of the payment
+	OperationID string // idempotency key
+	Reference   string
+	Amount      Money
+}
+
+type VoidResponse struct {
+	Reference string
+	Status    string
+}
+
+// BankError is a failure reported by (or on the way to) the payment provider
+type BankError struct {
+	Provider  string // paystack, ...
+	Code      string // provider error code, HTTP status or network_error
+	Message   string // message as given by the provider
+	Retryable bool   // the same request may succeed later (timeouts, 5xx, rate limits)
+	Err       error
+}
+
+func (e *BankError) Error() string {
+	return fmt.Sprintf("%s error: %s", e.Provider, e.Message)
+}
+
+func (e *BankError) Unwrap() error {
+	return e.Err
+}
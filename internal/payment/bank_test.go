@@ -1,36 +1,342 @@
-package payment
+package payment_test
 
-// func TestBankFailureDoesNotCHangeState(t *testing.T) {
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
 
-// 	bank := &MockBank{
-// 		FailureRate: 1.0,
-// 	}
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/payment/paymenttest"
+)
 
-// 	p := NewPayment("p1", 1000)
+func TestBankFailureDoesNotChangeState(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantRetryable bool
+	}{
+		{name: "temporary", err: paymenttest.ErrUnavailable, wantRetryable: true},
+		{name: "permanent", err: &payment.BankError{Provider: "paymenttest", Code: "invalid_reference", Message: "no such transaction"}},
+		{name: "timeout", err: context.DeadlineExceeded, wantRetryable: true},
+	}
 
-// 	err := p.ApplyWithBank(bank, "op1", Operation(OPAuthorize))
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				bank := paymenttest.NewBank()
+				p := newPayment(t, store, 10000)
+				if _, err := store.Apply(ctx, bank, p.ID, "cap", payment.OPCapture, payment.OperationParams{}); err != nil {
+					t.Fatal(err)
+				}
 
-// 	if err != nil {
-// 		t.Fatal("expected bank error")
-// 	}
-// 	if p.State != Initiated {
-// 		t.Fatalf("state changed on failure : %v", err)
-// 	}
-// }
-// func TestBankREtrySucceeds(t *testing.T) {
+				bank.FailNext(paymenttest.MethodRefund, tt.err)
+				if _, err := store.Apply(ctx, bank, p.ID, "ref", payment.OPRefund, payment.OperationParams{}); err == nil {
+					t.Fatal("refund succeeded while the bank failed")
+				}
 
-// 	bank := &MockBank{
-// 		FailureRate: 0.0,
-// 	}
+				got, err := store.Get(p.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.State != payment.Captured || !got.PendingRefundAmount.IsZero() {
+					t.Fatalf("payment = %s pending %s after a failed refund", got.State, got.PendingRefundAmount)
+				}
+				failed := lastOperation(got)
+				if failed.OperationID != "ref" || failed.Result != "failed" || failed.Retryable != tt.wantRetryable {
+					t.Fatalf("recorded %+v, want a failed ref with retryable %v", failed, tt.wantRetryable)
+				}
 
-// 	p := NewPayment("p2", 1000)
+				// a retry of a temporary failure goes to the bank again, a permanent one does not
+				_, err = store.Apply(ctx, bank, p.ID, "ref", payment.OPRefund, payment.OperationParams{})
+				wantCalls := 1
+				if tt.wantRetryable {
+					wantCalls = 2
+					if err != nil {
+						t.Fatalf("retry: %v", err)
+					}
+				} else if !errors.Is(err, payment.ErrOperationFailed) {
+					t.Fatalf("retry err = %v, want %v", err, payment.ErrOperationFailed)
+				}
+				if calls := bank.Calls(paymenttest.MethodRefund); len(calls) != wantCalls {
+					t.Fatalf("bank refunded %d times, want %d", len(calls), wantCalls)
+				}
+			})
+		}
+	})
+}
 
-// 	err := p.ApplyWithBank(bank, "op1", Operation(OPAuthorize))
+func TestBankRetrySucceeds(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		ctx := context.Background()
+		bank := paymenttest.NewBank()
+		p := newPayment(t, store, 10000)
+		if _, err := store.Apply(ctx, bank, p.ID, "auth", payment.OPAuthorize, payment.OperationParams{}); err != nil {
+			t.Fatal(err)
+		}
 
-// 	if err != nil {
-// 		t.Fatal("expected bank error")
-// 	}
-// 	if p.State != Authorized {
-// 		t.Fatalf("expected authorize, got: %v", p.State)
-// 	}
-// }
+		bank.FailNext(paymenttest.MethodVoid, paymenttest.ErrUnavailable, paymenttest.ErrUnavailable)
+		for i := 0; i < 2; i++ {
+			if _, err := store.Apply(ctx, bank, p.ID, "void", payment.OPVoid, payment.OperationParams{}); err == nil {
+				t.Fatalf("attempt %d succeeded while the bank failed", i+1)
+			}
+		}
+		got, err := store.Apply(ctx, bank, p.ID, "void", payment.OPVoid, payment.OperationParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.State != payment.Voided {
+			t.Fatalf("state = %s, want %s", got.State, payment.Voided)
+		}
+		if op := lastOperation(got); op.Result != "success" || op.Attempts != 3 {
+			t.Fatalf("recorded %+v, want a success on the 3rd attempt", op)
+		}
+	})
+}
+
+func TestBankLatencyHonoursContext(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		bank := paymenttest.NewBank()
+		bank.Latency = time.Second
+		p := newPayment(t, store, 10000)
+		if _, err := store.Apply(context.Background(), bank, p.ID, "cap", payment.OPCapture, payment.OperationParams{}); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := store.Apply(ctx, bank, p.ID, "ref", payment.OPRefund, payment.OperationParams{})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("err = %v, want %v", err, context.DeadlineExceeded)
+		}
+		got, _ := store.Get(p.ID)
+		if op := lastOperation(got); op.ErrorCode != "timeout" || !op.Retryable {
+			t.Fatalf("recorded %+v, want a retryable timeout", op)
+		}
+	})
+}
+
+func TestVerification(t *testing.T) {
+	tests := []struct {
+		name      string
+		verify    []payment.VerifyResponse // empty: the bank's default answer
+		wantState payment.State
+	}{
+		{name: "charge succeeded", wantState: payment.Captured},
+		{name: "still pending", verify: []payment.VerifyResponse{{Status: payment.VerifyPending}}, wantState: payment.Pending},
+		{name: "abandoned", verify: []payment.VerifyResponse{{Status: payment.VerifyAbandoned}}, wantState: payment.Abandoned},
+		{name: "declined", verify: []payment.VerifyResponse{{Status: payment.VerifyFailed}}, wantState: payment.Failed},
+		{name: "authorized", verify: []payment.VerifyResponse{{Status: payment.VerifyAuthorized, Amount: ngn(10000)}}, wantState: payment.Authorized},
+		{name: "charged another amount", verify: []payment.VerifyResponse{{Status: payment.VerifySuccess, Amount: ngn(100)}}, wantState: payment.NeedsReview},
+		{name: "charged another currency", verify: []payment.VerifyResponse{{Status: payment.VerifySuccess, Amount: payment.Money{Amount: 10000, Currency: payment.USD}}}, wantState: payment.NeedsReview},
+	}
+
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				bank := paymenttest.NewBank()
+				p := newPayment(t, store, 10000)
+				if _, err := bank.Authorize(ctx, payment.AuthorizeRequest{PaymentID: p.ID, Amount: p.Amount}); err != nil {
+					t.Fatal(err)
+				}
+				bank.VerifyNext(p.ID, tt.verify...)
+
+				got, _, err := store.ApplyVerification(ctx, bank, p.ID, "verify", payment.OperationParams{Source: payment.SourceCallback})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.State != tt.wantState {
+					t.Fatalf("state = %s, want %s", got.State, tt.wantState)
+				}
+			})
+		}
+	})
+}
+
+func TestVerificationRounds(t *testing.T) {
+	rounds := []payment.VerifyStatus{payment.VerifyPending, payment.VerifyAbandoned, payment.VerifyPending, payment.VerifyAbandoned}
+	states := []payment.State{payment.Pending, payment.Abandoned, payment.Pending, payment.Abandoned}
+
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		ctx := context.Background()
+		bank := paymenttest.NewBank()
+		p := newPayment(t, store, 10000)
+
+		for i, status := range rounds {
+			bank.VerifyNext(p.ID, payment.VerifyResponse{Status: status})
+			got, _, err := store.ApplyVerification(ctx, bank, p.ID, "verify", payment.OperationParams{Source: payment.SourceCallback})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.State != states[i] {
+				t.Fatalf("round %d: state = %s, want %s", i+1, got.State, states[i])
+			}
+		}
+
+		timeline, err := store.Timeline(p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(timeline) != len(rounds) {
+			t.Fatalf("recorded %d transitions, want %d", len(timeline), len(rounds))
+		}
+	})
+}
+
+func TestVerifyingAgainChangesNothing(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    payment.VerifyStatus
+		wantState payment.State
+	}{
+		{name: "still pending", status: payment.VerifyPending, wantState: payment.Pending},
+		{name: "still abandoned", status: payment.VerifyAbandoned, wantState: payment.Abandoned},
+	}
+
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				bank := paymenttest.NewBank()
+				p := newPayment(t, store, 10000)
+
+				for _, prefix := range []string{"verify", "poller", "poller"} {
+					bank.VerifyNext(p.ID, payment.VerifyResponse{Status: tt.status})
+					got, _, err := store.ApplyVerification(ctx, bank, p.ID, prefix, payment.OperationParams{})
+					if err != nil {
+						t.Fatalf("%s: %v", prefix, err)
+					}
+					if got.State != tt.wantState {
+						t.Fatalf("%s: state = %s, want %s", prefix, got.State, tt.wantState)
+					}
+				}
+
+				timeline, err := store.Timeline(p.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(timeline) != 1 {
+					t.Fatalf("recorded %d transitions, want 1", len(timeline))
+				}
+			})
+		}
+	})
+}
+
+func TestCallbackAndWebhookInAnyOrder(t *testing.T) {
+	callback := payment.OperationParams{Actor: "customer", Source: payment.SourceCallback}
+	webhook := payment.OperationParams{Actor: "paystack", Source: payment.SourceWebhook}
+
+	tests := []struct {
+		name      string
+		verify    payment.VerifyResponse
+		wantState payment.State
+	}{
+		{name: "charged", verify: payment.VerifyResponse{Status: payment.VerifySuccess, Amount: ngn(10000)}, wantState: payment.Captured},
+		{name: "authorized", verify: payment.VerifyResponse{Status: payment.VerifyAuthorized, Amount: ngn(10000)}, wantState: payment.Authorized},
+		{name: "charged another amount", verify: payment.VerifyResponse{Status: payment.VerifySuccess, Amount: ngn(9000)}, wantState: payment.NeedsReview},
+	}
+	orders := []struct {
+		name   string
+		prefix [2]string
+		params [2]payment.OperationParams
+	}{
+		{name: "callback first", prefix: [2]string{"verify", "webhook"}, params: [2]payment.OperationParams{callback, webhook}},
+		{name: "webhook first", prefix: [2]string{"webhook", "verify"}, params: [2]payment.OperationParams{webhook, callback}},
+	}
+
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		for _, tt := range tests {
+			for _, order := range orders {
+				t.Run(tt.name+", "+order.name, func(t *testing.T) {
+					ctx := context.Background()
+					bank := paymenttest.NewBank()
+					p := newPayment(t, store, 10000)
+
+					for i, prefix := range order.prefix {
+						bank.VerifyNext(p.ID, tt.verify)
+						got, _, err := store.ApplyVerification(ctx, bank, p.ID, prefix, order.params[i])
+						if err != nil {
+							t.Fatalf("%s: %v", prefix, err)
+						}
+						if got.State != tt.wantState {
+							t.Fatalf("%s: state = %s, want %s", prefix, got.State, tt.wantState)
+						}
+					}
+
+					timeline, err := store.Timeline(p.ID)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if len(timeline) != 1 {
+						t.Fatalf("recorded %d transitions, want 1", len(timeline))
+					}
+				})
+			}
+		}
+
+		t.Run("at the same time", func(t *testing.T) {
+			ctx := context.Background()
+			bank := paymenttest.NewBank()
+			p := newPayment(t, store, 10000)
+			bank.VerifyNext(p.ID, tests[0].verify, tests[0].verify)
+
+			var wg sync.WaitGroup
+			errs := make([]error, 2)
+			for i, prefix := range []string{"verify", "webhook"} {
+				wg.Add(1)
+				go func(i int, prefix string) {
+					defer wg.Done()
+					_, _, errs[i] = store.ApplyVerification(ctx, bank, p.ID, prefix, payment.OperationParams{})
+				}(i, prefix)
+			}
+			wg.Wait()
+
+			for _, err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := store.Get(p.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.State != payment.Captured || got.CapturedAmount.Amount != 10000 {
+				t.Fatalf("state = %s, captured %d", got.State, got.CapturedAmount.Amount)
+			}
+		})
+	})
+}
+
+func TestFailureRate(t *testing.T) {
+	bank := paymenttest.NewBank()
+	bank.FailureRate = 0.3
+	bank.Seed = 42
+
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := bank.Verify(context.Background(), "ref"); err != nil {
+			failed++
+		}
+	}
+	if failed < 200 || failed > 400 {
+		t.Fatalf("%d of 1000 calls failed at a failure rate of 0.3", failed)
+	}
+	if calls := bank.Calls(paymenttest.MethodVerify); len(calls) != 1000 {
+		t.Fatalf("recorded %d calls, want 1000", len(calls))
+	}
+}
+
+// lastOperation returns the latest recorded attempt of a payment
+func lastOperation(p *payment.Payment) payment.PaymentOperation {
+	var last payment.PaymentOperation
+	for _, op := range p.Operations {
+		if op.ID > last.ID {
+			last = op
+		}
+	}
+	return last
+}
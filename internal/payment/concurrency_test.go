@@ -1,34 +1,128 @@
-package payment
-
-// func TestConcurrentCapture(t *testing.T) {
-
-// 	bank := &MockBank{
-// 		FailureRate: 0.0,
-// 	}
-// 	store := NewPaymentStore()
-
-// 	store.Create("p1", 1000)
-// 	// authorize
-// 	if err := store.Apply(bank, "p1", "auth", OPAuthorize); err != nil {
-// 		t.Fatal(err)
-// 	}
-
-// 	var wg sync.WaitGroup
-// 	wg.Add(2)
-
-// 	go func() {
-// 		defer wg.Done()
-// 		_ = store.Apply(bank, "p1", "cap-1", OPAuthorize)
-// 	}()
-// 	go func() {
-// 		defer wg.Done()
-// 		_ = store.Apply(bank, "p1", "cap-2", OPAuthorize)
-// 	}()
-
-// 	wg.Wait()
-
-// 	stored, _ := store.Get("p1")
-// 	if stored.Payment.State != Captured {
-// 		t.Fatalf("expected captured, got : %v", stored.Payment.State)
-// 	}
-// }
+package payment_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/payment/paymenttest"
+)
+
+func TestConcurrentCaptures(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		ctx := context.Background()
+		bank := paymenttest.NewBank()
+		p := newPayment(t, store, 10000)
+		if _, err := store.Apply(ctx, bank, p.ID, "auth", payment.OPAuthorize, payment.OperationParams{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// 20 captures of 1000 race for an authorization of 10000
+		var (
+			wg        sync.WaitGroup
+			mu        sync.Mutex
+			succeeded int
+		)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, err := store.Apply(ctx, bank, p.ID, fmt.Sprintf("cap-%d", i), payment.OPCapture, payment.OperationParams{Amount: ngn(1000)})
+				if err == nil {
+					mu.Lock()
+					succeeded++
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		got, err := store.Get(p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if succeeded != 10 {
+			t.Errorf("%d captures succeeded, want 10", succeeded)
+		}
+		if got.State != payment.Captured || got.CapturedAmount.Amount != 10000 {
+			t.Fatalf("payment = %s captured %s, want captured with 10000", got.State, got.CapturedAmount)
+		}
+	})
+}
+
+func TestConcurrentRetriesRefundOnce(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		ctx := context.Background()
+		bank := paymenttest.NewBank()
+		bank.Latency = 5 * time.Millisecond
+		p := newPayment(t, store, 10000)
+		if _, err := store.Apply(ctx, bank, p.ID, "cap", payment.OPCapture, payment.OperationParams{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// a client retrying the same refund on several connections at once
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := store.Apply(ctx, bank, p.ID, "ref", payment.OPRefund, payment.OperationParams{Amount: ngn(4000)})
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Errorf("retry failed: %v", err)
+			}
+		}
+		if calls := bank.Calls(paymenttest.MethodRefund); len(calls) != 1 {
+			t.Fatalf("bank refunded %d times, want once", len(calls))
+		}
+		got, _ := store.Get(p.ID)
+		if got.PendingRefundAmount.Amount != 4000 {
+			t.Fatalf("pending refund = %s, want 4000", got.PendingRefundAmount)
+		}
+	})
+}
+
+func TestConcurrentPaymentsDoNotWait(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		ctx := context.Background()
+		bank := paymenttest.NewBank()
+		bank.Latency = 50 * time.Millisecond
+
+		ids := make([]string, 10)
+		for i := range ids {
+			p := newPayment(t, store, 10000)
+			if _, err := store.Apply(ctx, bank, p.ID, "auth", payment.OPAuthorize, payment.OperationParams{}); err != nil {
+				t.Fatal(err)
+			}
+			ids[i] = p.ID
+		}
+
+		// voids go to the bank while their payment is locked; other payments go on
+		started := time.Now()
+		var wg sync.WaitGroup
+		for _, id := range ids {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				if _, err := store.Apply(ctx, bank, id, "void", payment.OPVoid, payment.OperationParams{}); err != nil {
+					t.Error(err)
+				}
+			}(id)
+		}
+		wg.Wait()
+
+		if elapsed := time.Since(started); elapsed > 5*bank.Latency {
+			t.Fatalf("10 voids of different payments took %s, the bank takes %s", elapsed, bank.Latency)
+		}
+	})
+}
@@ -1,8 +1,14 @@
 package payment
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
+	"github.com/Investorharry19/go-payment/internal/ledger"
+	"github.com/Investorharry19/go-payment/internal/outbox"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -10,6 +16,10 @@ import (
 // PaymentStoreDB is a DB-backed payment store
 type PaymentStoreDB struct {
 	DB *gorm.DB
+
+	// EventSourced derives a payment's state from its operation log on every
+	// read and before every operation, instead of trusting the stored columns
+	EventSourced bool
 }
 
 // Constructor
@@ -17,16 +27,29 @@ func NewPaymentStoreDB(db *gorm.DB) *PaymentStoreDB {
 	return &PaymentStoreDB{DB: db}
 }
 
-func (s *PaymentStoreDB) Create(id string, amount int64, userId, orderId string) (*Payment, error) {
-	p := &Payment{
-		ID:      id,
-		Amount:  amount,
-		State:   Initiated,
-		UserID:  userId,
-		OrderID: orderId,
+func (s *PaymentStoreDB) Create(id string, amount Money, userId, orderId, provider string) (*Payment, error) {
+	if _, err := NewMoney(amount.Amount, string(amount.Currency)); err != nil {
+		return nil, err
 	}
 
-	if err := s.DB.Create(p).Error; err != nil {
+	p := NewPayment(id, amount)
+	p.UserID = userId
+	p.OrderID = orderId
+	if provider != "" {
+		p.Provider = provider
+	}
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(p).Error; err != nil {
+			return err
+		}
+		event := createdEvent(p)
+		if err := outbox.Add(tx, event.ID, event.Type, p.ID, event); err != nil {
+			return err
+		}
+		return enqueueWebhooks(tx, event)
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -36,54 +59,491 @@ func (s *PaymentStoreDB) Create(id string, amount int64, userId, orderId string)
 func (s *PaymentStoreDB) Get(id string) (*Payment, error) {
 	var p Payment
 	if err := s.DB.Preload("Operations").First(&p, "id = ?", id).Error; err != nil {
-		return nil, err
+		return nil, notFound(err)
+	}
+	if s.EventSourced {
+		replayed, err := Replay(&p, p.Operations)
+		if err != nil {
+			return nil, err
+		}
+		p.adopt(replayed)
 	}
 	return &p, nil
 }
 
+func (s *PaymentStoreDB) GetByBankReference(provider, reference string) (*Payment, error) {
+	if reference == "" {
+		return nil, ErrPaymentNotFound
+	}
+	var op PaymentOperation
+	err := s.DB.Joins("JOIN payments ON payments.id = payment_operations.payment_id").
+		Where("payments.provider = ? AND payment_operations.bank_reference = ?", provider, reference).
+		First(&op).Error
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return s.Get(op.PaymentID)
+}
+
+func (s *PaymentStoreDB) List() ([]Payment, error) {
+	payments := []Payment{}
+	if err := s.DB.Preload("Operations").Order("created_at, id").Find(&payments).Error; err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+// Timeline returns the state changes of a payment, oldest first
+func (s *PaymentStoreDB) Timeline(paymentID string) ([]PaymentStateTransition, error) {
+	if err := s.DB.Select("id").First(&Payment{}, "id = ?", paymentID).Error; err != nil {
+		return nil, err
+	}
+
+	var transitions []PaymentStateTransition
+	if err := s.DB.Where("payment_id = ?", paymentID).Order("created_at, id").Find(&transitions).Error; err != nil {
+		return nil, err
+	}
+	return transitions, nil
+}
+
 func (s *PaymentStoreDB) Apply(
+	ctx context.Context,
 	bank Bank,
 	paymentID string,
 	operationID string,
 	operation Operation,
-) error {
+	params OperationParams,
+) (*Payment, error) {
+	if movesMoney(operation) {
+		return s.applyAtBank(ctx, bank, paymentID, operationID, operation, params)
+	}
 
-	return s.DB.Transaction(func(tx *gorm.DB) error {
-		//  Lock the payment row for update to prevent concurrent modification
-		var p Payment
-		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
-			First(&p, "id = ?", paymentID).Error; err != nil {
-			return fmt.Errorf("payment not found")
+	var (
+		result  *Payment
+		attempt PaymentOperation // what gets recorded if the attempt fails
+		failure *operationFailure
+	)
+	err := s.DB.Transaction(func(tx *gorm.DB) (err error) {
+		result, attempt, failure, err = s.applyIn(tx, paymentID, operationID, operation, params)
+		return err
+	})
+	if failure != nil {
+		//  The transaction is gone, but the attempt is kept for support and retries
+		if recordErr := s.recordFailure(attempt, failure); recordErr != nil {
+			fmt.Printf("Failed to record failed %s of %s: %v\n", operation, paymentID, recordErr)
 		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
 
-		//  Check if the operation was already applied
-		var op PaymentOperation
-		if err := tx.First(&op, "payment_id = ? AND operation_id = ?", paymentID, operationID).Error; err == nil {
-			// Already processed, return success (idempotent)
-			return nil
+// applyIn applies an operation that is not sent to the bank within tx, for
+// callers that keep other writes in the same transaction. A failed attempt is
+// returned with its failure, for the caller to record once tx is rolled back.
+func (s *PaymentStoreDB) applyIn(
+	tx *gorm.DB,
+	paymentID string,
+	operationID string,
+	operation Operation,
+	params OperationParams,
+) (*Payment, PaymentOperation, *operationFailure, error) {
+
+	p, err := lockPayment(tx, paymentID)
+	if err != nil {
+		return nil, PaymentOperation{}, nil, err
+	}
+
+	attempt, _, replayed, err := s.begin(tx, p, operationID, operation, &params)
+	if err != nil || replayed != nil {
+		return replayed, attempt, nil, err
+	}
+
+	result, failure, err := s.record(tx, p, attempt, operation, params, 0)
+	return result, attempt, failure, err
+}
+
+// movesMoney tells the operations that are sent to the bank
+func movesMoney(operation Operation) bool {
+	return operation == OPRefund || operation == OPVoid
+}
+
+// applyAtBank applies a refund or a void in three steps, so the bank is never
+// called with the payment row locked and nothing the bank did is lost to a
+// rollback:
+//
+//  1. the request is committed as a pending operation, which keeps any other
+//     refund or void of the payment out until it is settled
+//  2. the bank is called; retries of the same operation ID wait on the
+//     pending row, not on the payment
+//  3. the outcome is recorded. A bank failure replaces the pending operation
+//     with a failed one. A success that cannot be recorded keeps it pending
+//     with the bank reference, and a retry with the same operation ID
+//     records it without calling the bank again.
+func (s *PaymentStoreDB) applyAtBank(
+	ctx context.Context,
+	bank Bank,
+	paymentID string,
+	operationID string,
+	operation Operation,
+	params OperationParams,
+) (*Payment, error) {
+
+	var (
+		attempt  PaymentOperation
+		replayed *Payment
+		failure  *operationFailure
+	)
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		p, err := lockPayment(tx, paymentID)
+		if err != nil {
+			return err
 		}
 
-		//  Apply operation (update state)
-		if err := p.ApplyOperation(operationID, operation); err != nil {
+		var pending *PaymentOperation
+		attempt, pending, replayed, err = s.begin(tx, p, operationID, operation, &params)
+		if err != nil || replayed != nil || pending != nil {
 			return err
 		}
 
-		//  Record operation for idempotency
-		newOp := PaymentOperation{
-			PaymentID:   paymentID,
-			OperationID: operationID,
-			Operation:   string(operation),
-			Result:      "success",
+		var inFlight int64
+		if err := tx.Model(&PaymentOperation{}).
+			Where("payment_id = ? AND result = ?", paymentID, "pending").
+			Count(&inFlight).Error; err != nil {
+			return err
+		}
+		if inFlight > 0 {
+			return fmt.Errorf("%w: %s", ErrOperationInProgress, paymentID)
+		}
+
+		//  Price the request on a copy; the payment only changes once the bank accepted it
+		if err := s.replayLog(tx, p); err != nil {
+			return err
 		}
-		if err := tx.Create(&newOp).Error; err != nil {
+		check := *p
+		res, err := check.ApplyOperation(operationID, operation, params)
+		if err != nil {
+			failure = classifyFailure(err, 0)
 			return err
 		}
+		attempt.Amount = res.Amount
+		attempt.Result = "pending"
+		return tx.Create(&attempt).Error
+	})
+	if failure != nil {
+		if recordErr := s.recordFailure(attempt, failure); recordErr != nil {
+			fmt.Printf("Failed to record failed %s of %s: %v\n", operation, paymentID, recordErr)
+		}
+	}
+	if err != nil || replayed != nil {
+		return replayed, err
+	}
 
-		//  Save updated payment state
-		if err := tx.Save(&p).Error; err != nil {
+	var (
+		result    *Payment
+		sent      *PaymentOperation // the pending operation, once the bank accepted it
+		latency   time.Duration
+		reference string
+	)
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		lockOperation := func(op *PaymentOperation) error {
+			return tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+				First(op, "payment_id = ? AND operation_id = ?", paymentID, operationID).Error
+		}
+		var op PaymentOperation
+		err := lockOperation(&op)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			// a concurrent retry settled it while we waited, under a new row
+			err = lockOperation(&op)
+		}
+		if err != nil {
+			return err
+		}
+		switch op.Result {
+		case "pending":
+		case "failed":
+			// a concurrent retry got the bank's answer first
+			return op.failureError()
+		default:
+			replayed, err := op.replayResponse(op.Fingerprint)
+			if err != nil {
+				return err
+			}
+			if replayed == nil {
+				replayed, err = s.Get(paymentID)
+			}
+			result = replayed
 			return err
 		}
+		attempt = op
+		attempt.ID = 0
+		attempt.CreatedAt = time.Time{}
 
-		return nil
+		//  Move the money, unless an earlier attempt already did
+		reference = op.BankReference
+		if reference == "" {
+			var p Payment
+			if err := tx.Select("id", "provider").First(&p, "id = ?", paymentID).Error; err != nil {
+				return notFound(err)
+			}
+			started := time.Now()
+			reference, err = sendToBank(ctx, bank, operation, p.Provider, operationID, paymentID, op.Amount)
+			latency = time.Since(started)
+			if err != nil {
+				failure = classifyFailure(err, latency)
+				return fmt.Errorf("bank %s failed: %w", operation, err)
+			}
+		}
+		sent = &op
+
+		p, err := lockPayment(tx, paymentID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Delete(&op).Error; err != nil {
+			return err
+		}
+		params.Amount = op.Amount
+		params.BankReference = reference
+		result, _, err = s.record(tx, p, attempt, operation, params, latency)
+		return err
 	})
+	switch {
+	case err == nil:
+		return result, nil
+	case sent != nil:
+		//  The bank moved the money but the payment does not show it: keep the
+		//  reference on the pending operation so nothing is sent twice
+		updates := map[string]interface{}{"bank_reference": reference}
+		if latency > 0 {
+			updates["latency_ms"] = latency.Milliseconds()
+		}
+		if recordErr := s.DB.Model(&PaymentOperation{}).
+			Where("id = ? AND result = ?", sent.ID, "pending").
+			Updates(updates).Error; recordErr != nil {
+			fmt.Printf("Failed to record bank reference %s of %s: %v\n", reference, paymentID, recordErr)
+		}
+		RaiseAlert(Alert{
+			PaymentID: paymentID,
+			Kind:      "unrecorded_bank_operation",
+			Message:   fmt.Sprintf("%s %s accepted by the bank as %s but not recorded: %v", operation, operationID, reference, err),
+		})
+	case failure != nil:
+		if recordErr := s.recordFailure(attempt, failure); recordErr != nil {
+			fmt.Printf("Failed to record failed %s of %s: %v\n", operation, paymentID, recordErr)
+		}
+	}
+	return nil, err
+}
+
+// sendToBank sends a refund or a void for amount and returns the bank's reference
+func sendToBank(ctx context.Context, bank Bank, operation Operation, provider, operationID, paymentID string, amount Money) (string, error) {
+	switch operation {
+	case OPRefund:
+		refund, err := bank.Refund(ctx, RefundRequest{
+			Provider:    provider,
+			OperationID: operationID,
+			Reference:   paymentID,
+			Amount:      amount,
+		})
+		return refund.Reference, err
+	case OPVoid:
+		void, err := bank.Void(ctx, VoidRequest{
+			Provider:    provider,
+			OperationID: operationID,
+			Reference:   paymentID,
+			Amount:      amount,
+		})
+		return void.Reference, err
+	}
+	return "", fmt.Errorf("%s is not sent to the bank", operation)
+}
+
+// lockPayment reads a payment and locks its row for update, to prevent
+// concurrent modification
+func lockPayment(tx *gorm.DB, paymentID string) (*Payment, error) {
+	var p Payment
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&p, "id = ?", paymentID).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &p, nil
+}
+
+// begin looks up an earlier use of the operation ID on the locked payment p.
+// An operation already applied returns its first response; a pending one is
+// returned to be finished. Otherwise begin returns the attempt to record.
+func (s *PaymentStoreDB) begin(
+	tx *gorm.DB,
+	p *Payment,
+	operationID string,
+	operation Operation,
+	params *OperationParams,
+) (attempt PaymentOperation, pending *PaymentOperation, replayed *Payment, err error) {
+
+	if params.Amount.Currency == "" {
+		params.Amount.Currency = p.Amount.Currency
+	}
+	fingerprint := Fingerprint(operation, *params)
+	attempt = PaymentOperation{
+		PaymentID:   p.ID,
+		OperationID: operationID,
+		Operation:   string(operation),
+		Amount:      params.Amount,
+		Final:       params.Final,
+		Source:      params.Source,
+		Fingerprint: fingerprint,
+		Attempts:    1,
+	}
+
+	var op PaymentOperation
+	err = tx.First(&op, "payment_id = ? AND operation_id = ?", p.ID, operationID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return attempt, nil, nil, nil
+	}
+	if err != nil {
+		return attempt, nil, nil, err
+	}
+
+	switch op.Result {
+	case "failed":
+		// A failed attempt: a permanent failure is final, anything else is retried
+		if op.Fingerprint != "" && op.Fingerprint != fingerprint {
+			return attempt, nil, nil, fmt.Errorf("%w: %s", ErrIdempotencyConflict, operationID)
+		}
+		if !op.Retryable {
+			return attempt, nil, nil, op.failureError()
+		}
+		attempt.Attempts = op.Attempts + 1
+		return attempt, nil, nil, tx.Delete(&op).Error
+	case "pending":
+		// sent to the bank earlier, its outcome not recorded yet
+		if op.Fingerprint != "" && op.Fingerprint != fingerprint {
+			return attempt, nil, nil, fmt.Errorf("%w: %s", ErrIdempotencyConflict, operationID)
+		}
+		return op, &op, nil, nil
+	default:
+		// Already processed: same request gets the first response back (idempotent)
+		replayed, err = op.replayResponse(fingerprint)
+		if err != nil {
+			return attempt, nil, nil, err
+		}
+		if replayed == nil {
+			replayed, err = s.snapshot(tx, p)
+		}
+		return attempt, nil, replayed, err
+	}
+}
+
+// replayLog derives the state of p from its operation log in event-sourced
+// mode, where the log is the source of truth
+func (s *PaymentStoreDB) replayLog(tx *gorm.DB, p *Payment) error {
+	if !s.EventSourced {
+		return nil
+	}
+	var ops []PaymentOperation
+	if err := tx.Where("payment_id = ? AND result = ?", p.ID, "success").Order("id").Find(&ops).Error; err != nil {
+		return err
+	}
+	replayed, err := Replay(p, ops)
+	if err != nil {
+		return err
+	}
+	p.adopt(replayed)
+	return nil
+}
+
+// record applies an operation to the locked payment p and stores it with
+// its transition, events, journal entry and response. A failure of the
+// operation itself is returned for the caller to record after the rollback.
+func (s *PaymentStoreDB) record(
+	tx *gorm.DB,
+	p *Payment,
+	attempt PaymentOperation,
+	operation Operation,
+	params OperationParams,
+	latency time.Duration,
+) (*Payment, *operationFailure, error) {
+
+	if err := s.replayLog(tx, p); err != nil {
+		return nil, nil, err
+	}
+
+	//  Apply operation (update state)
+	from := p.State
+	res, err := p.ApplyOperation(attempt.OperationID, operation, params)
+	if err != nil {
+		return nil, classifyFailure(err, 0), err
+	}
+
+	//  Record operation for idempotency
+	newOp := attempt
+	newOp.Amount = res.Amount
+	newOp.Result = "success"
+	newOp.BankReference = params.BankReference
+	newOp.LatencyMs = latency.Milliseconds()
+	if err := tx.Create(&newOp).Error; err != nil {
+		return nil, nil, err
+	}
+
+	//  Record the state change in the payment's history
+	transition := PaymentStateTransition{
+		PaymentID:   p.ID,
+		OperationID: attempt.OperationID,
+		Operation:   string(operation),
+		FromState:   from,
+		ToState:     res.State,
+		Actor:       params.Actor,
+		Source:      params.Source,
+	}
+	if err := tx.Create(&transition).Error; err != nil {
+		return nil, nil, err
+	}
+
+	//  Announce the change to the outbox and the merchant's endpoints, unless nothing changed
+	if from != res.State || !res.Amount.IsZero() {
+		event := transitionEvent(p, transition, res)
+		if err := outbox.Add(tx, event.ID, event.Type, p.ID, event); err != nil {
+			return nil, nil, err
+		}
+		if err := enqueueWebhooks(tx, event); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	//  Book the money movement in the ledger
+	if entry := journalEntry(p, attempt.OperationID, from, res); entry != nil {
+		if err := ledger.Post(tx, entry); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	//  Save updated payment state
+	if err := tx.Save(p).Error; err != nil {
+		return nil, nil, err
+	}
+
+	//  Remember the response so a retry gets exactly the same one
+	snapshot, err := s.snapshot(tx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Model(&newOp).Update("response", string(response)).Error; err != nil {
+		return nil, nil, err
+	}
+	return snapshot, nil, nil
+}
+
+// snapshot returns the payment with the operations recorded so far
+func (s *PaymentStoreDB) snapshot(tx *gorm.DB, p *Payment) (*Payment, error) {
+	snapshot := *p
+	if err := tx.Where("payment_id = ?", p.ID).Order("id").Find(&snapshot.Operations).Error; err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
 }
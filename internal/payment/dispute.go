@@ -0,0 +1,260 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type DisputeStatus string
+
+const (
+	DisputeOpen             DisputeStatus = "open"              // with the provider, waiting for a decision
+	DisputeAwaitingEvidence DisputeStatus = "awaiting_evidence" // the provider waits for our side of the story
+	DisputeWon              DisputeStatus = "won"
+	DisputeLost             DisputeStatus = "lost"
+)
+
+// Dispute is a chargeback the customer raised against a payment
+type Dispute struct {
+	ID                uint          `json:"id" gorm:"primaryKey"`
+	PaymentID         string        `json:"payment_id" gorm:"not null;index"`
+	Provider          string        `json:"provider" gorm:"not null;uniqueIndex:idx_disputes_provider_ref"`
+	ProviderReference string        `json:"provider_reference" gorm:"not null;uniqueIndex:idx_disputes_provider_ref"`
+	Status            DisputeStatus `json:"status" gorm:"not null;index"`
+	Reason            string        `json:"reason"`
+	Amount            Money         `json:"amount" gorm:"embedded"`
+	DueBy             *time.Time    `json:"due_by"` // evidence after this is not looked at
+	ResolvedAt        *time.Time    `json:"resolved_at"`
+
+	Evidence []DisputeEvidence `json:"evidence,omitempty" gorm:"foreignKey:DisputeID"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DisputeEvidence is a file or a note supporting our side of a dispute
+type DisputeEvidence struct {
+	ID          uint      `json:"id" gorm:"primaryKey"`
+	DisputeID   uint      `json:"dispute_id" gorm:"not null;index"`
+	Note        string    `json:"note,omitempty" gorm:"type:text"`
+	FileName    string    `json:"file_name,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int       `json:"size,omitempty"`
+	Content     []byte    `json:"-"`
+	Author      string    `json:"author"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// DisputeStore keeps disputes and their evidence. PaymentStoreDB is one; the
+// in-memory store keeps none.
+type DisputeStore interface {
+	OpenDispute(ctx context.Context, bank Bank, params DisputeParams) (*Dispute, error)
+	ResolveDispute(ctx context.Context, bank Bank, provider, reference string, won bool, actor string, source Source) (*Dispute, error)
+	Dispute(id uint) (*Dispute, error)
+	Disputes(status DisputeStatus) ([]Dispute, error)
+	AddEvidence(disputeID uint, evidence DisputeEvidence) (*DisputeEvidence, error)
+	EvidenceFile(disputeID, evidenceID uint) (*DisputeEvidence, error)
+}
+
+var _ DisputeStore = (*PaymentStoreDB)(nil)
+
+// DisputeParams describes a dispute reported by a provider
+type DisputeParams struct {
+	Provider          string
+	ProviderReference string // the provider's dispute id
+	PaymentID         string
+	Amount            Money // zero means everything the payment kept
+	Reason            string
+	DueBy             *time.Time
+	AwaitingEvidence  bool
+
+	Actor  string
+	Source Source
+}
+
+// OpenDispute records a dispute and moves its payment to Disputed, which
+// blocks refunds until the dispute is resolved. Reporting the same dispute
+// again returns the stored one.
+func (s *PaymentStoreDB) OpenDispute(ctx context.Context, bank Bank, params DisputeParams) (*Dispute, error) {
+	status := DisputeOpen
+	if params.AwaitingEvidence {
+		status = DisputeAwaitingEvidence
+	}
+	d := Dispute{
+		PaymentID:         params.PaymentID,
+		Provider:          params.Provider,
+		ProviderReference: params.ProviderReference,
+		Status:            status,
+		Reason:            params.Reason,
+		Amount:            params.Amount,
+		DueBy:             params.DueBy,
+	}
+
+	// the dispute and the move of its payment are kept together or not at all
+	var (
+		stored  *Dispute
+		attempt PaymentOperation
+		failure *operationFailure
+	)
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		txStore := &PaymentStoreDB{DB: tx, EventSourced: s.EventSourced}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&d).Error; err != nil {
+			return err
+		}
+
+		// the operation ID makes moving the payment idempotent as well
+		opID := fmt.Sprintf("dispute-%s-%s-open", params.Provider, params.ProviderReference)
+		var p *Payment
+		var err error
+		p, attempt, failure, err = s.applyIn(tx, params.PaymentID, opID, OPDispute, OperationParams{
+			Amount: params.Amount,
+			Reason: params.Reason,
+			Actor:  params.Actor,
+			Source: params.Source,
+		})
+		if err != nil {
+			return err
+		}
+
+		// without an amount from the provider the whole kept amount is disputed
+		err = tx.Model(&Dispute{}).
+			Where("provider = ? AND provider_reference = ? AND amount = 0", params.Provider, params.ProviderReference).
+			Updates(map[string]interface{}{"amount": p.DisputedAmount.Amount, "currency": p.DisputedAmount.Currency}).Error
+		if err != nil {
+			return err
+		}
+		stored, err = txStore.providerDispute(params.Provider, params.ProviderReference)
+		return err
+	})
+	s.recordDisputeFailure(attempt, failure)
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// recordDisputeFailure keeps a failed move of a disputed payment once the
+// dispute's transaction is rolled back, like Apply does
+func (s *PaymentStoreDB) recordDisputeFailure(attempt PaymentOperation, failure *operationFailure) {
+	if failure == nil {
+		return
+	}
+	if err := s.recordFailure(attempt, failure); err != nil {
+		fmt.Printf("Failed to record failed %s of %s: %v\n", attempt.Operation, attempt.PaymentID, err)
+	}
+}
+
+// ResolveDispute closes a dispute. A won dispute gives the payment back its
+// earlier state; a lost one charges the disputed amount back.
+func (s *PaymentStoreDB) ResolveDispute(ctx context.Context, bank Bank, provider, reference string, won bool, actor string, source Source) (*Dispute, error) {
+	operation, status := OPChargeback, DisputeLost
+	if won {
+		operation, status = OPWinDispute, DisputeWon
+	}
+
+	// the outcome and the move of the payment are kept together or not at all
+	var (
+		id      uint
+		attempt PaymentOperation
+		failure *operationFailure
+	)
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var d Dispute
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&d, "provider = ? AND provider_reference = ?", provider, reference).Error; err != nil {
+			return err
+		}
+		id = d.ID
+
+		opID := fmt.Sprintf("dispute-%s-%s-%s", provider, reference, status)
+		var err error
+		_, attempt, failure, err = s.applyIn(tx, d.PaymentID, opID, operation, OperationParams{Actor: actor, Source: source})
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&Dispute{}).Where("id = ?", d.ID).
+			Updates(map[string]interface{}{"status": status, "resolved_at": time.Now()}).Error
+	})
+	s.recordDisputeFailure(attempt, failure)
+	if err != nil {
+		return nil, err
+	}
+	return s.Dispute(id)
+}
+
+func (s *PaymentStoreDB) providerDispute(provider, reference string) (*Dispute, error) {
+	var d Dispute
+	if err := s.DB.First(&d, "provider = ? AND provider_reference = ?", provider, reference).Error; err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Dispute returns a dispute with its evidence
+func (s *PaymentStoreDB) Dispute(id uint) (*Dispute, error) {
+	var d Dispute
+	if err := s.DB.Preload("Evidence", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).
+		First(&d, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Disputes lists disputes, the ones due first, optionally only those in one status
+func (s *PaymentStoreDB) Disputes(status DisputeStatus) ([]Dispute, error) {
+	disputes := []Dispute{}
+	q := s.DB.Order("due_by NULLS LAST, id")
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if err := q.Find(&disputes).Error; err != nil {
+		return nil, err
+	}
+	return disputes, nil
+}
+
+// AddEvidence attaches a file or a note to an unresolved dispute. Once the
+// provider has our evidence the dispute is no longer waiting for it.
+func (s *PaymentStoreDB) AddEvidence(disputeID uint, evidence DisputeEvidence) (*DisputeEvidence, error) {
+	if evidence.Note == "" && len(evidence.Content) == 0 {
+		return nil, fmt.Errorf("evidence needs a file or a note")
+	}
+
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var d Dispute
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&d, "id = ?", disputeID).Error; err != nil {
+			return err
+		}
+		if d.Status == DisputeWon || d.Status == DisputeLost {
+			return fmt.Errorf("dispute %d is already %s", d.ID, d.Status)
+		}
+
+		evidence.DisputeID = d.ID
+		evidence.Size = len(evidence.Content)
+		if err := tx.Create(&evidence).Error; err != nil {
+			return err
+		}
+		if d.Status == DisputeAwaitingEvidence {
+			return tx.Model(&d).Update("status", DisputeOpen).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &evidence, nil
+}
+
+// EvidenceFile returns one piece of evidence of a dispute, with its content
+func (s *PaymentStoreDB) EvidenceFile(disputeID, evidenceID uint) (*DisputeEvidence, error) {
+	var e DisputeEvidence
+	if err := s.DB.First(&e, "id = ? AND dispute_id = ?", evidenceID, disputeID).Error; err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
@@ -0,0 +1,57 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/payment/paymenttest"
+	"gorm.io/gorm"
+)
+
+func TestOpenDispute(t *testing.T) {
+	store := openPostgres(t).(*payment.PaymentStoreDB)
+	ctx := context.Background()
+	bank := paymenttest.NewBank()
+
+	dispute := func(p *payment.Payment) payment.DisputeParams {
+		return payment.DisputeParams{Provider: "paystack", ProviderReference: "dsp-" + p.ID, PaymentID: p.ID}
+	}
+
+	t.Run("refund pending", func(t *testing.T) {
+		p := newPayment(t, store, 10000)
+		for i, op := range []payment.Operation{payment.OPCapture, payment.OPRefund} {
+			params := payment.OperationParams{}
+			if op == payment.OPRefund {
+				params.Amount = ngn(2500)
+			}
+			if _, err := store.Apply(ctx, bank, p.ID, string(op)+"-"+string(rune('a'+i)), op, params); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		d, err := store.OpenDispute(ctx, bank, dispute(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Amount.Amount != 7500 {
+			t.Fatalf("disputed %d, want what is kept: 7500", d.Amount.Amount)
+		}
+		if got, _ := store.Get(p.ID); got.State != payment.Disputed {
+			t.Fatalf("payment is %s", got.State)
+		}
+	})
+
+	t.Run("payment that cannot be disputed", func(t *testing.T) {
+		p := newPayment(t, store, 10000)
+
+		if _, err := store.OpenDispute(ctx, bank, dispute(p)); !errors.Is(err, payment.ErrInvalidTranstion) {
+			t.Fatalf("err = %v, want ErrInvalidTranstion", err)
+		}
+		var d payment.Dispute
+		if err := store.DB.First(&d, "payment_id = ?", p.ID).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Fatalf("dispute kept without its payment: %+v, %v", d, err)
+		}
+	})
+}
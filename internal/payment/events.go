@@ -0,0 +1,70 @@
+package payment
+
+import (
+	"fmt"
+	"time"
+)
+
+// PaymentEvent announces a change of a payment, to merchant webhooks and to
+// the outbox. It is the JSON body of every webhook delivery.
+type PaymentEvent struct {
+	ID        string           `json:"id"`   // unique per change, lets receivers dedupe
+	Type      string           `json:"type"` // payment.<state>, e.g. payment.captured
+	CreatedAt time.Time        `json:"created_at"`
+	Data      PaymentEventData `json:"data"`
+}
+
+type PaymentEventData struct {
+	PaymentID      string    `json:"payment_id"`
+	OrderID        string    `json:"order_id"`
+	UserID         string    `json:"user_id"`
+	Operation      Operation `json:"operation,omitempty"`
+	OperationID    string    `json:"operation_id,omitempty"`
+	From           State     `json:"from,omitempty"`
+	State          State     `json:"state"`
+	Amount         Money     `json:"amount"` // what the operation moved, the payment amount when created
+	CapturedAmount Money     `json:"captured_amount"`
+	RefundedAmount Money     `json:"refunded_amount"`
+}
+
+// EventType names the event of a payment entering a state
+func EventType(state State) string {
+	return "payment." + string(state)
+}
+
+// EventPaymentCreated is sent once for every new payment
+const EventPaymentCreated = "payment.created"
+
+func createdEvent(p *Payment) PaymentEvent {
+	return PaymentEvent{
+		ID:        fmt.Sprintf("evt_%s_created", p.ID),
+		Type:      EventPaymentCreated,
+		CreatedAt: time.Now().UTC(),
+		Data:      eventData(p, p.Amount),
+	}
+}
+
+func transitionEvent(p *Payment, t PaymentStateTransition, res OperationResult) PaymentEvent {
+	data := eventData(p, res.Amount)
+	data.Operation = res.Operation
+	data.OperationID = t.OperationID
+	data.From = t.FromState
+	return PaymentEvent{
+		ID:        fmt.Sprintf("evt_%s_%s", p.ID, t.OperationID),
+		Type:      EventType(t.ToState),
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+}
+
+func eventData(p *Payment, amount Money) PaymentEventData {
+	return PaymentEventData{
+		PaymentID:      p.ID,
+		OrderID:        p.OrderID,
+		UserID:         p.UserID,
+		State:          p.State,
+		Amount:         amount,
+		CapturedAmount: p.CapturedAmount,
+		RefundedAmount: p.RefundedAmount,
+	}
+}
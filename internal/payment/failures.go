@@ -0,0 +1,75 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrOperationFailed = fmt.Errorf("Operation failed")
+)
+
+// operationFailure is what gets recorded about a failed attempt
+type operationFailure struct {
+	Code      string
+	Message   string
+	Retryable bool
+	Latency   time.Duration
+}
+
+// classifyFailure tells permanent failures (the same request will fail again)
+// apart from the ones worth retrying
+func classifyFailure(err error, latency time.Duration) *operationFailure {
+	f := &operationFailure{Message: err.Error(), Latency: latency}
+
+	var bankErr *BankError
+	switch {
+	case errors.As(err, &bankErr):
+		f.Code, f.Message, f.Retryable = bankErr.Code, bankErr.Message, bankErr.Retryable
+	case errors.Is(err, ErrInvalidTranstion):
+		f.Code = "invalid_transition"
+	case errors.Is(err, ErrInvalidAmount):
+		f.Code = "invalid_amount"
+	case errors.Is(err, ErrCurrencyMismatch):
+		f.Code = "currency_mismatch"
+	case errors.Is(err, ErrUnsupportedCurrency):
+		f.Code = "unsupported_currency"
+	case errors.Is(err, ErrIdempotencyConflict):
+		f.Code = "idempotency_conflict"
+	case errors.Is(err, ErrOperationFailed):
+		f.Code = "operation_failed"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		f.Code, f.Retryable = "timeout", true
+	default:
+		f.Code, f.Retryable = "internal_error", true
+	}
+	return f
+}
+
+// failureError rebuilds the error of a recorded permanent failure for a retry
+func (op *PaymentOperation) failureError() error {
+	return fmt.Errorf("%w: %s (%s)", ErrOperationFailed, op.ErrorMessage, op.ErrorCode)
+}
+
+// recordFailure writes a failed attempt. It runs after the operation's
+// transaction was rolled back, and replaces an earlier failed or pending
+// attempt of the same operation ID.
+func (s *PaymentStoreDB) recordFailure(failed PaymentOperation, f *operationFailure) error {
+	failed.Result = "failed"
+	failed.ErrorCode = f.Code
+	failed.ErrorMessage = f.Message
+	failed.Retryable = f.Retryable
+	failed.LatencyMs = f.Latency.Milliseconds()
+
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("payment_id = ? AND operation_id = ? AND result IN ?", failed.PaymentID, failed.OperationID, []string{"failed", "pending"}).
+			Delete(&PaymentOperation{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&failed).Error
+	})
+}
@@ -0,0 +1,40 @@
+package payment
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+var (
+	ErrIdempotencyConflict = fmt.Errorf("Operation ID reused with a different request")
+	ErrOperationInProgress = fmt.Errorf("another refund or void of the payment is waiting on the bank")
+)
+
+// Fingerprint identifies the request behind an operation, so a retry can be
+// told apart from a different request reusing the same operation ID.
+// params.Amount must already carry the payment's currency.
+func Fingerprint(operation Operation, params OperationParams) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%d|%s|%t", operation, params.Amount.Amount, params.Amount.Currency, params.Final)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replayResponse returns what the first call of an already applied operation
+// returned, or ErrIdempotencyConflict when the retry asks for something else
+func (op *PaymentOperation) replayResponse(fingerprint string) (*Payment, error) {
+	// rows written before fingerprints existed cannot be compared
+	if op.Fingerprint != "" && op.Fingerprint != fingerprint {
+		return nil, fmt.Errorf("%w: %s", ErrIdempotencyConflict, op.OperationID)
+	}
+	if op.Response == "" {
+		return nil, nil
+	}
+
+	var p Payment
+	if err := json.Unmarshal([]byte(op.Response), &p); err != nil {
+		return nil, fmt.Errorf("decode stored response of %s: %w", op.OperationID, err)
+	}
+	return &p, nil
+}
@@ -1,53 +1,112 @@
-package payment
-
-// func TestIdepotencCapture(t *testing.T) {
-// 	p := NewPayment("p1", 1000)
-
-// 	opAuth := "op-a1"
-// 	opCap := "op-a2"
-
-// 	if err := p.ApplyOperation(opAuth, OPAuthorize); err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	if err := p.ApplyOperation(opCap, OPCapture); err != nil {
-// 		t.Fatal(err)
-// 	}
-
-// 	// retry capture
-// 	if err := p.ApplyOperation(opCap, OPCapture); err != nil {
-// 		t.Fatal(err)
-// 	}
-
-// 	if p.State != Captured {
-// 		t.Fatalf("Expected capture, got %s", p.State)
-// 	}
-// 	t.Log(p)
-// }
-
-// func TestIdepotencRefund(t *testing.T) {
-// 	p := NewPayment("p2", 1000)
-
-// 	opAuth := "op-a1"
-// 	opCap := "op-a2"
-// 	opRef := "op-ref"
-// 	if err := p.ApplyOperation(opAuth, OPAuthorize); err != nil {
-// 		t.Fatal(err)
-// 	}
-// 	if err := p.ApplyOperation(opCap, OPCapture); err != nil {
-// 		t.Fatal(err)
-// 	}
-
-// 	if err := p.ApplyOperation(opRef, OPRefund); err != nil {
-// 		t.Fatal(err)
-// 	}
-
-// 	// retry refund
-// 	if err := p.ApplyOperation(opRef, OPRefund); err != nil {
-// 		t.Fatal(err)
-// 	}
-
-// 	if p.State != Refunded {
-// 		t.Fatalf("Expected refund, got %s", p.State)
-// 	}
-// 	t.Log(p)
-// }
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/payment/paymenttest"
+)
+
+func TestIdempotentApply(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		ctx := context.Background()
+		bank := paymenttest.NewBank()
+		p := newPayment(t, store, 10000)
+
+		if _, err := store.Apply(ctx, bank, p.ID, "cap", payment.OPCapture, payment.OperationParams{}); err != nil {
+			t.Fatal(err)
+		}
+		first, err := store.Apply(ctx, bank, p.ID, "ref", payment.OPRefund, payment.OperationParams{Amount: ngn(2500)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// settle the refund, then retry it: the retry answers as the first call did
+		if _, err := store.Apply(ctx, bank, p.ID, "ref-ok", payment.OPRefundProcessed, payment.OperationParams{}); err != nil {
+			t.Fatal(err)
+		}
+		retry, err := store.Apply(ctx, bank, p.ID, "ref", payment.OPRefund, payment.OperationParams{Amount: ngn(2500)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retry.State != payment.RefundPending || retry.State != first.State || retry.PendingRefundAmount != first.PendingRefundAmount {
+			t.Fatalf("retry = %s pending %s, first = %s pending %s", retry.State, retry.PendingRefundAmount, first.State, first.PendingRefundAmount)
+		}
+		if calls := bank.Calls(paymenttest.MethodRefund); len(calls) != 1 {
+			t.Fatalf("bank refunded %d times, want once", len(calls))
+		}
+
+		got, err := store.Get(p.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.State != payment.PartiallyRefunded || got.RefundedAmount.Amount != 2500 {
+			t.Fatalf("payment = %s refunded %s, want partially_refunded with 2500", got.State, got.RefundedAmount)
+		}
+	})
+}
+
+func TestIdempotencyConflict(t *testing.T) {
+	tests := []struct {
+		name   string
+		retry  payment.Operation
+		params payment.OperationParams
+	}{
+		{name: "other amount", retry: payment.OPCapture, params: payment.OperationParams{Amount: ngn(2000)}},
+		{name: "other operation", retry: payment.OPVoid},
+		{name: "final flag", retry: payment.OPCapture, params: payment.OperationParams{Amount: ngn(1000), Final: true}},
+	}
+
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				bank := paymenttest.NewBank()
+				p := newPayment(t, store, 10000)
+
+				if _, err := store.Apply(ctx, bank, p.ID, "auth", payment.OPAuthorize, payment.OperationParams{}); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := store.Apply(ctx, bank, p.ID, "op", payment.OPCapture, payment.OperationParams{Amount: ngn(1000)}); err != nil {
+					t.Fatal(err)
+				}
+
+				_, err := store.Apply(ctx, bank, p.ID, "op", tt.retry, tt.params)
+				if !errors.Is(err, payment.ErrIdempotencyConflict) {
+					t.Fatalf("err = %v, want %v", err, payment.ErrIdempotencyConflict)
+				}
+				got, _ := store.Get(p.ID)
+				if got.State != payment.PartiallyCaptured || got.CapturedAmount.Amount != 1000 {
+					t.Fatalf("payment = %s captured %s after a conflict", got.State, got.CapturedAmount)
+				}
+			})
+		}
+	})
+}
+
+func TestRejectedOperationIsNotRetried(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		ctx := context.Background()
+		bank := paymenttest.NewBank()
+		p := newPayment(t, store, 10000)
+
+		_, err := store.Apply(ctx, bank, p.ID, "ref", payment.OPRefund, payment.OperationParams{})
+		if !errors.Is(err, payment.ErrInvalidTranstion) {
+			t.Fatalf("err = %v, want %v", err, payment.ErrInvalidTranstion)
+		}
+
+		// capturing makes the refund possible, but the operation ID is spent
+		if _, err := store.Apply(ctx, bank, p.ID, "cap", payment.OPCapture, payment.OperationParams{}); err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.Apply(ctx, bank, p.ID, "ref", payment.OPRefund, payment.OperationParams{})
+		if !errors.Is(err, payment.ErrOperationFailed) {
+			t.Fatalf("retry err = %v, want %v", err, payment.ErrOperationFailed)
+		}
+		if calls := bank.Calls(paymenttest.MethodRefund); len(calls) != 0 {
+			t.Fatalf("bank refunded %d times for a rejected operation", len(calls))
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package payment
+
+import (
+	"fmt"
+
+	"github.com/Investorharry19/go-payment/internal/env"
+	"github.com/Investorharry19/go-payment/internal/ledger"
+)
+
+// FeeBasisPoints is the fee kept on every capture, in hundredths of a percent
+var FeeBasisPoints int64
+
+// FeeBasisPointsFromEnv reads LEDGER_FEE_BPS, for main to set FeeBasisPoints
+func FeeBasisPointsFromEnv() int64 {
+	return int64(env.Int("LEDGER_FEE_BPS", int(FeeBasisPoints)))
+}
+
+// journalEntry books an applied operation in the ledger:
+//
+//	authorize         customer_receivable  -> authorized_funds
+//	capture           authorized_funds (or customer_receivable when nothing was held)
+//	                                       -> merchant_balance + fees
+//	                  a final capture also releases the uncaptured rest:
+//	                  authorized_funds     -> customer_receivable
+//	void              authorized_funds     -> customer_receivable
+//	refund            merchant_balance     -> refunds_payable
+//	refund_processed  refunds_payable      -> customer_receivable
+//	refund_failed     refunds_payable      -> merchant_balance
+//	chargeback        merchant_balance     -> customer_receivable
+//
+// Operations that move no money get no entry.
+func journalEntry(p *Payment, operationID string, from State, res OperationResult) *ledger.JournalEntry {
+	amount := res.Amount.Amount
+	currency := string(res.Amount.Currency)
+	entry := ledger.NewEntry(p.ID, operationID, fmt.Sprintf("%s %s", res.Operation, res.Amount))
+
+	switch res.Operation {
+	case OPAuthorize:
+		entry.Debit(ledger.CustomerReceivable, amount, currency).
+			Credit(ledger.AuthorizedFunds, amount, currency)
+	case OPCapture:
+		source := ledger.CustomerReceivable
+		if from == Authorized || from == PartiallyCaptured {
+			source = ledger.AuthorizedFunds
+		}
+		fee := amount * FeeBasisPoints / 10000
+		entry.Debit(source, amount, currency).
+			Credit(ledger.MerchantBalance, amount-fee, currency).
+			Credit(ledger.Fees, fee, currency)
+
+		// a final capture releases the rest of the hold, like a void
+		released := p.Amount.Amount - p.CapturedAmount.Amount
+		if source == ledger.AuthorizedFunds && res.State == Captured && released > 0 {
+			entry.Debit(ledger.AuthorizedFunds, released, currency).
+				Credit(ledger.CustomerReceivable, released, currency)
+		}
+	case OPVoid:
+		entry.Debit(ledger.AuthorizedFunds, amount, currency).
+			Credit(ledger.CustomerReceivable, amount, currency)
+	case OPRefund:
+		entry.Debit(ledger.MerchantBalance, amount, currency).
+			Credit(ledger.RefundsPayable, amount, currency)
+	case OPRefundProcessed:
+		entry.Debit(ledger.RefundsPayable, amount, currency).
+			Credit(ledger.CustomerReceivable, amount, currency)
+	case OPRefundFailed:
+		entry.Debit(ledger.RefundsPayable, amount, currency).
+			Credit(ledger.MerchantBalance, amount, currency)
+	case OPChargeback:
+		entry.Debit(ledger.MerchantBalance, amount, currency).
+			Credit(ledger.CustomerReceivable, amount, currency)
+	default:
+		return nil
+	}
+	return entry
+}
+
+// Journal returns the ledger entries of a payment, oldest first
+func (s *PaymentStoreDB) Journal(paymentID string) ([]ledger.JournalEntry, error) {
+	if err := s.DB.Select("id").First(&Payment{}, "id = ?", paymentID).Error; err != nil {
+		return nil, err
+	}
+	return ledger.Journal(s.DB, paymentID)
+}
+
+func (s *PaymentStoreDB) Balances() ([]ledger.Balance, error) {
+	return ledger.Balances(s.DB)
+}
@@ -0,0 +1,90 @@
+package payment_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Investorharry19/go-payment/internal/ledger"
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/payment/paymenttest"
+)
+
+func TestHeldFundsAreReleased(t *testing.T) {
+	type step struct {
+		operation payment.Operation
+		params    payment.OperationParams
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  map[ledger.AccountCode]int64
+	}{
+		{
+			name: "final partial capture",
+			steps: []step{
+				{operation: payment.OPAuthorize},
+				{operation: payment.OPCapture, params: payment.OperationParams{Amount: ngn(3000), Final: true}},
+			},
+			want: map[ledger.AccountCode]int64{ledger.AuthorizedFunds: 0, ledger.CustomerReceivable: 3000, ledger.MerchantBalance: 3000},
+		},
+		{
+			name: "partial captures, the last one final",
+			steps: []step{
+				{operation: payment.OPAuthorize},
+				{operation: payment.OPCapture, params: payment.OperationParams{Amount: ngn(2000)}},
+				{operation: payment.OPCapture, params: payment.OperationParams{Amount: ngn(3000), Final: true}},
+			},
+			want: map[ledger.AccountCode]int64{ledger.AuthorizedFunds: 0, ledger.CustomerReceivable: 5000, ledger.MerchantBalance: 5000},
+		},
+		{
+			name: "partial capture, then void",
+			steps: []step{
+				{operation: payment.OPAuthorize},
+				{operation: payment.OPCapture, params: payment.OperationParams{Amount: ngn(4000)}},
+				{operation: payment.OPVoid},
+			},
+			want: map[ledger.AccountCode]int64{ledger.AuthorizedFunds: 0, ledger.CustomerReceivable: 4000, ledger.MerchantBalance: 4000},
+		},
+		{
+			name: "full capture",
+			steps: []step{
+				{operation: payment.OPAuthorize},
+				{operation: payment.OPCapture},
+			},
+			want: map[ledger.AccountCode]int64{ledger.AuthorizedFunds: 0, ledger.CustomerReceivable: 10000, ledger.MerchantBalance: 10000},
+		},
+	}
+
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				bank := paymenttest.NewBank()
+				p := newPayment(t, store, 10000)
+				for i, s := range tt.steps {
+					if _, err := store.Apply(ctx, bank, p.ID, string(s.operation)+"-"+string(rune('a'+i)), s.operation, s.params); err != nil {
+						t.Fatalf("%s: %v", s.operation, err)
+					}
+				}
+
+				entries, err := store.Journal(p.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var lines []ledger.JournalLine
+				for _, e := range entries {
+					lines = append(lines, e.Lines...)
+				}
+				got := map[ledger.AccountCode]int64{}
+				for _, b := range ledger.Sum(lines) {
+					got[b.Account] = b.Balance
+				}
+				for account, want := range tt.want {
+					if got[account] != want {
+						t.Errorf("%s = %d, want %d", account, got[account], want)
+					}
+				}
+			})
+		}
+	})
+}
@@ -11,8 +11,25 @@ type Payment struct {
 	UserID  string `gorm:"index;not null"` // usr_xxx
 	OrderID string `gorm:"index;not null"`
 
-	Amount     int64              `gorm:"not null"`
-	State      State              `gorm:"not null"`
+	// the Bank the payment is made with: paystack, flutterwave...
+	Provider string `gorm:"not null;default:'paystack';index"`
+
+	Amount              Money `gorm:"embedded"`
+	CapturedAmount      Money `gorm:"embedded;embeddedPrefix:captured_"`
+	RefundedAmount      Money `gorm:"embedded;embeddedPrefix:refunded_"`
+	PendingRefundAmount Money `gorm:"embedded;embeddedPrefix:pending_refund_"`
+	DisputedAmount      Money `gorm:"embedded;embeddedPrefix:disputed_"`
+	State               State `gorm:"not null;index"`
+	DisputedFrom        State // the state an open dispute came from
+	ReviewReason        string
+
+	// when the provider drops the authorization hold
+	AuthorizedUntil *time.Time `gorm:"index"`
+
+	// background verification of unfinished checkouts
+	VerifyAttempts int `gorm:"not null;default:0"`
+	NextVerifyAt   *time.Time
+
 	Operations []PaymentOperation `gorm:"foreignKey:PaymentID"`
 	CreatedAt  time.Time
 	UpdatedAt  time.Time
@@ -24,13 +41,47 @@ type PaymentOperation struct {
 	OperationID string `gorm:"not null;index:idx_payment_operation_id,unique"`
 
 	Operation string `gorm:"not null"` // AUTHORIZE, CAPTURE, VOID, REFUND
-	Amount    int64  `gorm:"not null"`
-	Result    string `gorm:"not null"` // success, failed
+	Amount    Money  `gorm:"embedded"`
+	Final     bool   `gorm:"not null;default:false"` // final capture, needed to replay the log
+	Result    string `gorm:"not null"`               // success, failed, pending (sent to the bank, outcome not recorded yet)
+	Source    Source // api, webhook, callback, poller, scheduler
+
+	BankReference string `gorm:"index"`
+
+	// failed attempts: why, whether a retry may succeed, and how long the bank took
+	ErrorCode    string
+	ErrorMessage string
+	Retryable    bool  `gorm:"not null;default:false"`
+	LatencyMs    int64 `gorm:"not null;default:0"`
+	Attempts     int   `gorm:"not null;default:1"`
+
+	// idempotency: the request the operation ID was first used for,
+	// and the payment as that first call returned it
+	Fingerprint string `json:"-"`
+	Response    string `json:"-" gorm:"type:text"`
 
-	BankReference string
-	CreatedAt     time.Time
+	CreatedAt time.Time
 }
 
 func (PaymentOperation) TableName() string {
 	return "payment_operations"
 }
+
+// PaymentStateTransition records one state change of a payment
+type PaymentStateTransition struct {
+	ID          uint   `gorm:"primaryKey"`
+	PaymentID   string `gorm:"not null;index"`
+	OperationID string `gorm:"not null"`
+	Operation   string `gorm:"not null"`
+
+	FromState State  `gorm:"not null"`
+	ToState   State  `gorm:"not null"`
+	Actor     string // JWT sub for API calls, the provider for webhooks
+	Source    Source `gorm:"not null"` // api, webhook, callback
+
+	CreatedAt time.Time `gorm:"index"`
+}
+
+func (PaymentStateTransition) TableName() string {
+	return "payment_state_transitions"
+}
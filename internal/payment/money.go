@@ -0,0 +1,133 @@
+package payment
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Currency is an ISO 4217 currency code
+type Currency string
+
+const (
+	NGN Currency = "NGN"
+	GHS Currency = "GHS"
+	KES Currency = "KES"
+	ZAR Currency = "ZAR"
+	EGP Currency = "EGP"
+	XOF Currency = "XOF"
+	RWF Currency = "RWF"
+	UGX Currency = "UGX"
+	USD Currency = "USD"
+	EUR Currency = "EUR"
+	GBP Currency = "GBP"
+)
+
+// number of minor-unit digits per supported currency (kobo, pesewas, cents...)
+var currencyExponents = map[Currency]int{
+	NGN: 2,
+	GHS: 2,
+	KES: 2,
+	ZAR: 2,
+	EGP: 2,
+	XOF: 0,
+	RWF: 0,
+	UGX: 0,
+	USD: 2,
+	EUR: 2,
+	GBP: 2,
+}
+
+var (
+	ErrUnsupportedCurrency = fmt.Errorf("Unsupported currency")
+	ErrCurrencyMismatch    = fmt.Errorf("Currency mismatch")
+)
+
+// ParseCurrency normalizes a currency code and checks that it is supported
+func ParseCurrency(code string) (Currency, error) {
+	c := Currency(strings.ToUpper(strings.TrimSpace(code)))
+	if _, ok := currencyExponents[c]; !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedCurrency, code)
+	}
+	return c, nil
+}
+
+// Exponent returns the number of minor-unit digits of the currency
+func (c Currency) Exponent() int {
+	return currencyExponents[c]
+}
+
+// Money is an amount in minor units of a currency, e.g. 5000 NGN is ₦50.00
+type Money struct {
+	Amount   int64    `json:"amount" gorm:"column:amount;not null"`
+	Currency Currency `json:"currency" gorm:"column:currency;not null;default:'NGN'"`
+}
+
+// NewMoney builds a Money value, rejecting unsupported currencies and
+// amounts that are not positive
+func NewMoney(amount int64, currency string) (Money, error) {
+	c, err := ParseCurrency(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	if amount <= 0 {
+		return Money{}, fmt.Errorf("%w: must be positive, got %d", ErrInvalidAmount, amount)
+	}
+	return Money{Amount: amount, Currency: c}, nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) sameCurrency(o Money) error {
+	if m.Currency != o.Currency {
+		return fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	return nil
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: m.Amount - o.Amount, Currency: m.Currency}, nil
+}
+
+// Cmp returns -1, 0 or 1 when m is less than, equal to or greater than o
+func (m Money) Cmp(o Money) (int, error) {
+	if err := m.sameCurrency(o); err != nil {
+		return 0, err
+	}
+	switch {
+	case m.Amount < o.Amount:
+		return -1, nil
+	case m.Amount > o.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// String formats the amount in major units, e.g. "NGN 50.00"
+func (m Money) String() string {
+	exp := m.Currency.Exponent()
+	if exp == 0 {
+		return fmt.Sprintf("%s %d", m.Currency, m.Amount)
+	}
+
+	div := int64(1)
+	for i := 0; i < exp; i++ {
+		div *= 10
+	}
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	return fmt.Sprintf("%s %s%d.%0*d", m.Currency, sign, amount/div, exp, amount%div)
+}
@@ -2,16 +2,29 @@ package payment
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/env"
 )
 
 type State string
 
 const (
-	Initiated  State = "initiated"
-	Authorized State = "authorized"
-	Captured   State = "captured"
-	Voided     State = "voided"
-	Refunded   State = "refunded"
+	Initiated         State = "initiated"
+	Pending           State = "pending"   // the customer is still paying, verify again later
+	Abandoned         State = "abandoned" // the customer left checkout, they may still come back
+	Failed            State = "failed"
+	NeedsReview       State = "needs_review" // the bank charged something else than we asked for
+	Expired           State = "expired"      // never paid within the payment TTL
+	Authorized        State = "authorized"
+	PartiallyCaptured State = "partially_captured"
+	Captured          State = "captured"
+	Voided            State = "voided"
+	RefundPending     State = "refund_pending"
+	PartiallyRefunded State = "partially_refunded"
+	Refunded          State = "refunded"
+	Disputed          State = "disputed"     // the customer disputed the charge, refunds wait for the outcome
+	ChargedBack       State = "charged_back" // the dispute was lost and the money taken back
 )
 
 type Operation string
@@ -21,99 +34,293 @@ const (
 	OPCapture   Operation = "capture"
 	OPVoid      Operation = "void"
 	OPRefund    Operation = "refund"
+
+	// outcomes of verifying a checkout that did not (yet) succeed
+	OPMarkPending Operation = "mark_pending"
+	OPAbandon     Operation = "abandon"
+	OPFail        Operation = "fail"
+
+	// the verified charge does not match the payment
+	OPFlagForReview Operation = "flag_for_review"
+
+	// the checkout was never completed within the payment TTL
+	OPExpire Operation = "expire"
+
+	// settle a pending refund once the bank reports back
+	OPRefundProcessed Operation = "refund_processed"
+	OPRefundFailed    Operation = "refund_failed"
+
+	// a chargeback: opened by the customer, then won or lost by the merchant
+	OPDispute    Operation = "dispute"
+	OPWinDispute Operation = "win_dispute"
+	OPChargeback Operation = "chargeback"
+)
+
+// Source tells where an operation came from
+type Source string
+
+const (
+	SourceAPI       Source = "api"
+	SourceWebhook   Source = "webhook"
+	SourceCallback  Source = "callback"
+	SourcePoller    Source = "poller"
+	SourceScheduler Source = "scheduler"
 )
 
+// OperationParams carries the arguments of a single operation
+type OperationParams struct {
+	Amount        Money  // zero means the full outstanding amount; no currency means the payment's
+	Final         bool   // capture only: release whatever is left uncaptured
+	BankReference string // provider reference of the operation, e.g. a refund reference
+	Reason        string // flag for review only: what did not match
+
+	// authorize only: when the provider drops the hold; zero means AuthorizationTTL from now
+	AuthorizedUntil time.Time
+
+	// who asked for the operation, recorded in the transition history
+	Actor  string
+	Source Source
+}
+
 type OperationResult struct {
 	Operation Operation
 	State     State
+	Amount    Money
 }
 
 var (
 	ErrInvalidTranstion = fmt.Errorf("Invalid state transition")
+	ErrInvalidAmount    = fmt.Errorf("Invalid amount")
 )
 
-func NewPayment(id string, amount int64) *Payment {
+func NewPayment(id string, amount Money) *Payment {
+	zero := Money{Currency: amount.Currency}
 	return &Payment{
-		ID:     id,
-		Amount: amount,
-		State:  Initiated,
+		ID:                  id,
+		Amount:              amount,
+		CapturedAmount:      zero,
+		RefundedAmount:      zero,
+		PendingRefundAmount: zero,
+		DisputedAmount:      zero,
+		State:               Initiated,
+		Provider:            DefaultProvider,
 	}
 }
 
-func (p *Payment) ApplyOperation(opID string, operation Operation) error {
+// ApplyOperation runs an operation through the payment lifecycle table.
+// Already applied operations are filtered out by the store, not here.
+func (p *Payment) ApplyOperation(opID string, operation Operation, params OperationParams) (OperationResult, error) {
+	return Lifecycle.Apply(p, operation, params)
+}
+
+func (p *Payment) Authorize() error {
+	_, err := p.ApplyOperation("", OPAuthorize, OperationParams{})
+	return err
+}
+
+// Capture captures part or all of the payment; a zero amount captures the
+// whole remainder and final releases whatever is left uncaptured.
+// It returns the amount captured by this call.
+func (p *Payment) Capture(amount Money, final bool) (Money, error) {
+	res, err := p.ApplyOperation("", OPCapture, OperationParams{Amount: amount, Final: final})
+	return res.Amount, err
+}
+
+// Void releases the authorization and returns the released amount
+func (p *Payment) Void() (Money, error) {
+	res, err := p.ApplyOperation("", OPVoid, OperationParams{})
+	return res.Amount, err
+}
+
+// Refund puts a refund on hold until the bank settles it; a zero amount
+// refunds everything still refundable.
+func (p *Payment) Refund(amount Money) (Money, error) {
+	res, err := p.ApplyOperation("", OPRefund, OperationParams{Amount: amount})
+	return res.Amount, err
+}
+
+func (p *Payment) SettleRefund() (Money, error) {
+	res, err := p.ApplyOperation("", OPRefundProcessed, OperationParams{})
+	return res.Amount, err
+}
+
+func (p *Payment) FailRefund() (Money, error) {
+	res, err := p.ApplyOperation("", OPRefundFailed, OperationParams{})
+	return res.Amount, err
+}
+
+// operationEffects update the amounts of a payment once the state machine
+// has accepted the transition. They return the amount the operation moved.
+// The state itself is set from the transition table.
+var operationEffects = map[Operation]func(p *Payment, params OperationParams) (Money, error){
+	OPAuthorize:       authorizeEffect,
+	OPCapture:         captureEffect,
+	OPVoid:            voidEffect,
+	OPRefund:          refundEffect,
+	OPRefundProcessed: settleRefundEffect,
+	OPRefundFailed:    failRefundEffect,
+	OPMarkPending:     noEffect,
+	OPAbandon:         noEffect,
+	OPFail:            noEffect,
+	OPFlagForReview:   flagForReviewEffect,
+	OPExpire:          noEffect,
+	OPDispute:         disputeEffect,
+	OPWinDispute:      winDisputeEffect,
+	OPChargeback:      chargebackEffect,
+}
+
+func flagForReviewEffect(p *Payment, params OperationParams) (Money, error) {
+	p.ReviewReason = params.Reason
+	return Money{Currency: p.Amount.Currency}, nil
+}
+
+// verification outcomes only move the state
+func noEffect(p *Payment, _ OperationParams) (Money, error) {
+	return Money{Currency: p.Amount.Currency}, nil
+}
 
-	// if the operation is already execulted then return stored result
-	// if res, ok := p.Operations[opID]; ok {
-	// 	p.State = res.State
-	// 	return nil
-	// }
+// AuthorizationTTL is how long an authorization is assumed to last when the
+// provider does not say
+var AuthorizationTTL = 7 * 24 * time.Hour
 
-	// execute operation that did not exists
-	var err error
-	switch operation {
-	case OPAuthorize:
-		err = p.Authorize()
-	case OPCapture:
-		err = p.Capture()
-	case OPVoid:
-		err = p.Void()
-	case OPRefund:
-		err = p.Refund()
+// AuthorizationTTLFromEnv reads AUTHORIZATION_TTL, for main to set AuthorizationTTL
+func AuthorizationTTLFromEnv() time.Duration {
+	return env.Duration("AUTHORIZATION_TTL", AuthorizationTTL)
+}
 
-	default:
-		return fmt.Errorf("unknowk operation: %s", operation)
+func authorizeEffect(p *Payment, params OperationParams) (Money, error) {
+	until := params.AuthorizedUntil
+	if until.IsZero() {
+		until = time.Now().Add(AuthorizationTTL)
 	}
+	p.AuthorizedUntil = &until
+	return p.Amount, nil
+}
 
+// rule you never capture more than what is left of the authorized amount
+func captureEffect(p *Payment, params OperationParams) (Money, error) {
+	remaining, err := p.Amount.Sub(p.CapturedAmount)
 	if err != nil {
-		return err
+		return Money{}, err
+	}
+
+	amount := params.Amount
+	if amount.IsZero() {
+		amount = remaining
+	}
+	if amount.Amount < 0 {
+		return Money{}, fmt.Errorf("%w: capture amount must be positive, got %s", ErrInvalidAmount, amount)
+	}
+	if cmp, err := amount.Cmp(remaining); err != nil {
+		return Money{}, err
+	} else if cmp > 0 {
+		return Money{}, fmt.Errorf("%w: capture of %s exceeds remaining %s", ErrInvalidAmount, amount, remaining)
 	}
 
-	// record sucesssful operation
-	// p.Operations[opID] = OperationResult{
-	// 	Operation: operation,
-	// 	State:     p.State,
-	// }
-	return nil
+	p.CapturedAmount, _ = p.CapturedAmount.Add(amount)
+	return amount, nil
 }
 
-// rule you can only authorize an authorized initiated
-func (p *Payment) Authorize() error {
-	if p.State != Initiated {
-		return fmt.Errorf("%w: cannot authorize from %s", ErrInvalidTranstion, p.State)
+// a void releases whatever was not captured; after a partial capture that
+// closes the payment as captured
+func voidEffect(p *Payment, _ OperationParams) (Money, error) {
+	return p.Amount.Sub(p.CapturedAmount)
+}
+
+// rule the refunds together never exceed the captured amount,
+// and only one refund can be pending at a time
+func refundEffect(p *Payment, params OperationParams) (Money, error) {
+	refundable, err := p.CapturedAmount.Sub(p.RefundedAmount)
+	if err != nil {
+		return Money{}, err
+	}
+
+	amount := params.Amount
+	if amount.IsZero() {
+		amount = refundable
+	}
+	if amount.Amount <= 0 {
+		return Money{}, fmt.Errorf("%w: refund amount must be positive, got %s", ErrInvalidAmount, amount)
+	}
+	if cmp, err := amount.Cmp(refundable); err != nil {
+		return Money{}, err
+	} else if cmp > 0 {
+		return Money{}, fmt.Errorf("%w: refund of %s exceeds refundable %s", ErrInvalidAmount, amount, refundable)
 	}
 
-	p.State = Authorized
-	return nil
+	p.PendingRefundAmount = amount
+	return amount, nil
 }
 
-// rule you can only capture an authorized or initiated payment
-func (p *Payment) Capture() error {
-	if p.State != Authorized && p.State != Initiated {
-		return fmt.Errorf("%w: cannot capture from %s", ErrInvalidTranstion, p.State)
+func settleRefundEffect(p *Payment, _ OperationParams) (Money, error) {
+	amount := p.PendingRefundAmount
+	refunded, err := p.RefundedAmount.Add(amount)
+	if err != nil {
+		return Money{}, err
 	}
 
-	p.State = Captured
-	return nil
+	p.RefundedAmount = refunded
+	p.PendingRefundAmount = Money{Currency: amount.Currency}
+	return amount, nil
+}
+
+// a failed refund gives the pending amount back
+func failRefundEffect(p *Payment, _ OperationParams) (Money, error) {
+	amount := p.PendingRefundAmount
+	p.PendingRefundAmount = Money{Currency: amount.Currency}
+	return amount, nil
 }
 
-// rule you can only void an authorized payment
-func (p *Payment) Void() error {
-	if p.State != Authorized {
-		return fmt.Errorf("%w: cannot void from %s", ErrInvalidTranstion, p.State)
+// rule a dispute covers at most what was captured and not refunded, a
+// pending refund included; a dispute of a refunded payment puts nothing at stake
+func disputeEffect(p *Payment, params OperationParams) (Money, error) {
+	kept, err := p.CapturedAmount.Sub(p.RefundedAmount)
+	if err != nil {
+		return Money{}, err
+	}
+	if kept, err = kept.Sub(p.PendingRefundAmount); err != nil {
+		return Money{}, err
+	}
+	p.DisputedFrom = p.State
+	if kept.IsZero() {
+		p.DisputedAmount = kept
+		return kept, nil
+	}
+
+	amount := params.Amount
+	if amount.IsZero() {
+		amount = kept
+	}
+	if amount.Amount <= 0 {
+		return Money{}, fmt.Errorf("%w: disputed amount must be positive, got %s", ErrInvalidAmount, amount)
+	}
+	if cmp, err := amount.Cmp(kept); err != nil {
+		return Money{}, err
+	} else if cmp > 0 {
+		return Money{}, fmt.Errorf("%w: dispute of %s exceeds kept %s", ErrInvalidAmount, amount, kept)
 	}
 
-	p.State = Voided
-	return nil
+	p.DisputedAmount = amount
+	return amount, nil
 }
 
-// rule you can only void an authorized payment
-func (p *Payment) Refund() error {
-	if p.State != Captured {
-		return fmt.Errorf("%w: cannot refund from %s", ErrInvalidTranstion, p.State)
-	}
+// a won dispute leaves the payment as it was
+func winDisputeEffect(p *Payment, _ OperationParams) (Money, error) {
+	amount := p.DisputedAmount
+	p.DisputedAmount = Money{Currency: amount.Currency}
+	p.DisputedFrom = ""
+	return amount, nil
+}
 
-	p.State = Refunded
-	return nil
+// a lost dispute takes the disputed amount back, like a refund the merchant did not ask for
+func chargebackEffect(p *Payment, _ OperationParams) (Money, error) {
+	refunded, err := p.RefundedAmount.Add(p.DisputedAmount)
+	if err != nil {
+		return Money{}, err
+	}
+	amount := p.DisputedAmount
+	p.RefundedAmount = refunded
+	return amount, nil
 }
 
 func PaymentFunction() {
@@ -122,15 +329,27 @@ func PaymentFunction() {
 
 /*
 
-	payment structure for reference
-	initiated
-		|
-	authorized
-		|
-	-		-
-	|		|
-   Void    Capture
-			|
-			Refund
+	payment structure for reference (the rules live in transitionTable, state_machine.go)
+
+	initiated / pending / abandoned --fail--> failed
+	    |  (verification: mark_pending and abandon move between the three,
+	    |   flag_for_review parks a mismatched charge in needs_review,
+	    |   expire ends a checkout nobody completed in time)
+	    |
+	initiated --authorize--> authorized --void--> voided
+	    |                        |
+	    +---------capture--------+--> partially_captured (capture again until full or final)
+	                             |
+	                          captured
+	                             |
+	                           refund --> refund_pending --processed--> refunded / partially_refunded
+	                                           |
+	                                         failed --> captured / partially_refunded
+
+	anything captured --dispute--> disputed --win_dispute--> back where it was
+	                                   |
+	                               chargeback --> charged_back (new refunds are blocked while
+	                                              disputed; one already pending settles, and what
+	                                              a partial chargeback left can be refunded after)
 
 */
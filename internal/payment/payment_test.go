@@ -1,54 +1,286 @@
-package payment
-
-// func TestValidTransitions(t *testing.T) {
-// 	p := &Payment{
-// 		ID:     "p1",
-// 		Amount: 1000,
-// 		State:  Initiated,
-// 	}
-
-// 	// test valid transitions
-// 	if err := p.Authorize(); err != nil {
-// 		t.Fatal("failed to authorize")
-// 	}
-// 	if err := p.Capture(); err != nil {
-// 		t.Fatal("failed to capture")
-// 	}
-// 	if err := p.Refund(); err != nil {
-// 		t.Fatal("Failed to refund")
-// 	}
-
-// }
-
-// func TestInvalidTransitons(t *testing.T) {
-// 	tests := []struct {
-// 		name string
-// 		p    Payment
-// 		fn   func(*Payment) error
-// 	}{
-// 		{
-// 			name: "try Capture without authorize",
-// 			p:    Payment{State: Initiated},
-// 			fn:   (*Payment).Capture,
-// 		},
-// 		{
-// 			name: "try refund without capture",
-// 			p:    Payment{State: Authorized},
-// 			fn:   (*Payment).Refund,
-// 		},
-// 		{
-// 			name: "try void after capture",
-// 			p:    Payment{State: Captured},
-// 			fn:   (*Payment).Void,
-// 		},
-// 	}
-
-// 	for _, tt := range tests {
-// 		t.Run(tt.name, func(t *testing.T) {
-// 			if err := tt.fn(&tt.p); err != nil {
-// 				t.Fatal("expected error and got nil")
-// 			}
-// 		})
-// 	}
-
-// }
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/payment/paymenttest"
+)
+
+type step struct {
+	op     payment.Operation
+	amount int64
+	final  bool
+}
+
+func TestValidTransitions(t *testing.T) {
+	tests := []struct {
+		name         string
+		steps        []step
+		wantState    payment.State
+		wantCaptured int64
+		wantRefunded int64
+	}{
+		{
+			name:         "authorize and capture",
+			steps:        []step{{op: payment.OPAuthorize}, {op: payment.OPCapture}},
+			wantState:    payment.Captured,
+			wantCaptured: 10000,
+		},
+		{
+			name:         "partial captures up to the amount",
+			steps:        []step{{op: payment.OPAuthorize}, {op: payment.OPCapture, amount: 4000}, {op: payment.OPCapture, amount: 6000}},
+			wantState:    payment.Captured,
+			wantCaptured: 10000,
+		},
+		{
+			name:         "final partial capture",
+			steps:        []step{{op: payment.OPAuthorize}, {op: payment.OPCapture, amount: 4000, final: true}},
+			wantState:    payment.Captured,
+			wantCaptured: 4000,
+		},
+		{
+			name:         "void releases the uncaptured remainder",
+			steps:        []step{{op: payment.OPAuthorize}, {op: payment.OPCapture, amount: 3000}, {op: payment.OPVoid}},
+			wantState:    payment.Captured,
+			wantCaptured: 3000,
+		},
+		{
+			name:      "void an authorization",
+			steps:     []step{{op: payment.OPAuthorize}, {op: payment.OPVoid}},
+			wantState: payment.Voided,
+		},
+		{
+			name:         "full refund settles",
+			steps:        []step{{op: payment.OPCapture}, {op: payment.OPRefund}, {op: payment.OPRefundProcessed}},
+			wantState:    payment.Refunded,
+			wantCaptured: 10000,
+			wantRefunded: 10000,
+		},
+		{
+			name:         "partial refund settles",
+			steps:        []step{{op: payment.OPCapture}, {op: payment.OPRefund, amount: 2500}, {op: payment.OPRefundProcessed}},
+			wantState:    payment.PartiallyRefunded,
+			wantCaptured: 10000,
+			wantRefunded: 2500,
+		},
+		{
+			name:         "failed refund gives the capture back",
+			steps:        []step{{op: payment.OPCapture}, {op: payment.OPRefund}, {op: payment.OPRefundFailed}},
+			wantState:    payment.Captured,
+			wantCaptured: 10000,
+		},
+		{
+			name:         "pending checkout captured later",
+			steps:        []step{{op: payment.OPMarkPending}, {op: payment.OPMarkPending}, {op: payment.OPCapture}},
+			wantState:    payment.Captured,
+			wantCaptured: 10000,
+		},
+		{
+			name:         "review accepted",
+			steps:        []step{{op: payment.OPFlagForReview}, {op: payment.OPCapture}},
+			wantState:    payment.Captured,
+			wantCaptured: 10000,
+		},
+		{
+			name:         "won dispute",
+			steps:        []step{{op: payment.OPCapture}, {op: payment.OPDispute}, {op: payment.OPWinDispute}},
+			wantState:    payment.Captured,
+			wantCaptured: 10000,
+		},
+		{
+			name:         "won dispute of a partial capture",
+			steps:        []step{{op: payment.OPAuthorize}, {op: payment.OPCapture, amount: 4000}, {op: payment.OPDispute}, {op: payment.OPWinDispute}},
+			wantState:    payment.PartiallyCaptured,
+			wantCaptured: 4000,
+		},
+		{
+			name:         "won dispute of a final partial capture",
+			steps:        []step{{op: payment.OPAuthorize}, {op: payment.OPCapture, amount: 4000, final: true}, {op: payment.OPDispute}, {op: payment.OPWinDispute}},
+			wantState:    payment.Captured,
+			wantCaptured: 4000,
+		},
+		{
+			name:         "won dispute with a refund pending",
+			steps:        []step{{op: payment.OPCapture}, {op: payment.OPRefund, amount: 2500}, {op: payment.OPDispute}, {op: payment.OPWinDispute}},
+			wantState:    payment.RefundPending,
+			wantCaptured: 10000,
+		},
+		{
+			name:         "refund settles while disputed",
+			steps:        []step{{op: payment.OPCapture}, {op: payment.OPRefund, amount: 2500}, {op: payment.OPDispute}, {op: payment.OPRefundProcessed}, {op: payment.OPWinDispute}},
+			wantState:    payment.PartiallyRefunded,
+			wantCaptured: 10000,
+			wantRefunded: 2500,
+		},
+		{
+			name:         "dispute of a refunded payment",
+			steps:        []step{{op: payment.OPCapture}, {op: payment.OPRefund}, {op: payment.OPRefundProcessed}, {op: payment.OPDispute}, {op: payment.OPWinDispute}},
+			wantState:    payment.Refunded,
+			wantCaptured: 10000,
+			wantRefunded: 10000,
+		},
+		{
+			name:         "lost dispute with a refund pending",
+			steps:        []step{{op: payment.OPCapture}, {op: payment.OPRefund, amount: 2500}, {op: payment.OPDispute}, {op: payment.OPChargeback}, {op: payment.OPRefundProcessed}},
+			wantState:    payment.ChargedBack,
+			wantCaptured: 10000,
+			wantRefunded: 10000,
+		},
+		{
+			name:         "lost dispute",
+			steps:        []step{{op: payment.OPCapture}, {op: payment.OPDispute, amount: 4000}, {op: payment.OPChargeback}},
+			wantState:    payment.ChargedBack,
+			wantCaptured: 10000,
+			wantRefunded: 4000,
+		},
+		{
+			name:         "refund what a lost dispute left",
+			steps:        []step{{op: payment.OPCapture}, {op: payment.OPDispute, amount: 4000}, {op: payment.OPChargeback}, {op: payment.OPRefund}, {op: payment.OPRefundProcessed}},
+			wantState:    payment.ChargedBack,
+			wantCaptured: 10000,
+			wantRefunded: 10000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := payment.NewPayment("p1", ngn(10000))
+			for _, s := range tt.steps {
+				params := payment.OperationParams{Amount: ngn(s.amount), Final: s.final}
+				if _, err := p.ApplyOperation("", s.op, params); err != nil {
+					t.Fatalf("%s from %s: %v", s.op, p.State, err)
+				}
+			}
+			if p.State != tt.wantState {
+				t.Errorf("state = %s, want %s", p.State, tt.wantState)
+			}
+			if p.CapturedAmount.Amount != tt.wantCaptured {
+				t.Errorf("captured = %d, want %d", p.CapturedAmount.Amount, tt.wantCaptured)
+			}
+			if p.RefundedAmount.Amount != tt.wantRefunded {
+				t.Errorf("refunded = %d, want %d", p.RefundedAmount.Amount, tt.wantRefunded)
+			}
+		})
+	}
+}
+
+func TestInvalidTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []step // all but the last must succeed
+		wantErr error
+	}{
+		{
+			name:    "refund without capture",
+			steps:   []step{{op: payment.OPAuthorize}, {op: payment.OPRefund}},
+			wantErr: payment.ErrInvalidTranstion,
+		},
+		{
+			name:    "void after capture",
+			steps:   []step{{op: payment.OPAuthorize}, {op: payment.OPCapture}, {op: payment.OPVoid}},
+			wantErr: payment.ErrInvalidTranstion,
+		},
+		{
+			name:    "capture after void",
+			steps:   []step{{op: payment.OPAuthorize}, {op: payment.OPVoid}, {op: payment.OPCapture}},
+			wantErr: payment.ErrInvalidTranstion,
+		},
+		{
+			name:    "second refund while one is pending",
+			steps:   []step{{op: payment.OPCapture}, {op: payment.OPRefund, amount: 1000}, {op: payment.OPRefund, amount: 1000}},
+			wantErr: payment.ErrInvalidTranstion,
+		},
+		{
+			name:    "refund while disputed",
+			steps:   []step{{op: payment.OPCapture}, {op: payment.OPDispute}, {op: payment.OPRefund}},
+			wantErr: payment.ErrInvalidTranstion,
+		},
+		{
+			name:    "refund after a full chargeback",
+			steps:   []step{{op: payment.OPCapture}, {op: payment.OPDispute}, {op: payment.OPChargeback}, {op: payment.OPRefund}},
+			wantErr: payment.ErrInvalidTranstion,
+		},
+		{
+			name:    "refund after a chargeback while one is pending",
+			steps:   []step{{op: payment.OPCapture}, {op: payment.OPRefund, amount: 1000}, {op: payment.OPDispute, amount: 4000}, {op: payment.OPChargeback}, {op: payment.OPRefund, amount: 1000}},
+			wantErr: payment.ErrInvalidTranstion,
+		},
+		{
+			name:    "dispute more than kept",
+			steps:   []step{{op: payment.OPCapture}, {op: payment.OPRefund, amount: 2500}, {op: payment.OPDispute, amount: 8000}},
+			wantErr: payment.ErrInvalidAmount,
+		},
+		{
+			name:    "capture more than authorized",
+			steps:   []step{{op: payment.OPAuthorize}, {op: payment.OPCapture, amount: 10001}},
+			wantErr: payment.ErrInvalidAmount,
+		},
+		{
+			name:    "refund more than captured",
+			steps:   []step{{op: payment.OPAuthorize}, {op: payment.OPCapture, amount: 5000, final: true}, {op: payment.OPRefund, amount: 5001}},
+			wantErr: payment.ErrInvalidAmount,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := payment.NewPayment("p1", ngn(10000))
+			last := len(tt.steps) - 1
+			for _, s := range tt.steps[:last] {
+				if _, err := p.ApplyOperation("", s.op, payment.OperationParams{Amount: ngn(s.amount), Final: s.final}); err != nil {
+					t.Fatalf("%s from %s: %v", s.op, p.State, err)
+				}
+			}
+
+			before := *p
+			s := tt.steps[last]
+			_, err := p.ApplyOperation("", s.op, payment.OperationParams{Amount: ngn(s.amount), Final: s.final})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("%s from %s: err = %v, want %v", s.op, p.State, err, tt.wantErr)
+			}
+			if p.State != before.State || p.CapturedAmount != before.CapturedAmount || p.RefundedAmount != before.RefundedAmount {
+				t.Fatalf("rejected %s changed the payment: %+v", s.op, p)
+			}
+		})
+	}
+}
+
+func TestCurrencyMismatch(t *testing.T) {
+	p := payment.NewPayment("p1", ngn(10000))
+	_, err := p.ApplyOperation("", payment.OPCapture, payment.OperationParams{Amount: payment.Money{Amount: 100, Currency: payment.USD}})
+	if !errors.Is(err, payment.ErrCurrencyMismatch) {
+		t.Fatalf("err = %v, want %v", err, payment.ErrCurrencyMismatch)
+	}
+}
+
+func TestAmountsMustBePositive(t *testing.T) {
+	for _, amount := range []int64{0, -100} {
+		if _, err := payment.NewMoney(amount, "NGN"); !errors.Is(err, payment.ErrInvalidAmount) {
+			t.Errorf("NewMoney(%d): %v, want ErrInvalidAmount", amount, err)
+		}
+	}
+
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		if _, err := store.Create("pay-"+runID+"-negative", ngn(-100), "usr_test", "order_test", ""); !errors.Is(err, payment.ErrInvalidAmount) {
+			t.Fatalf("Create: %v, want ErrInvalidAmount", err)
+		}
+
+		p := newPayment(t, store, 10000)
+		ctx := context.Background()
+		bank := paymenttest.NewBank()
+		if _, err := store.Apply(ctx, bank, p.ID, "cap", payment.OPCapture, payment.OperationParams{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, op := range []payment.Operation{payment.OPCapture, payment.OPRefund} {
+			if _, err := store.Apply(ctx, bank, p.ID, "negative-"+string(op), op, payment.OperationParams{Amount: ngn(-100)}); err == nil {
+				t.Errorf("negative %s accepted", op)
+			}
+		}
+		if calls := bank.Calls(paymenttest.MethodRefund); len(calls) != 0 {
+			t.Fatalf("negative refund sent to the bank: %+v", calls)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+// Package paymenttest provides a fake payment.Bank for tests
+package paymenttest
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+)
+
+// Method names a Bank call
+type Method string
+
+const (
+	MethodAuthorize Method = "authorize"
+	MethodVerify    Method = "verify"
+	MethodRefund    Method = "refund"
+	MethodVoid      Method = "void"
+)
+
+// ErrUnavailable is what random failures return: a retryable bank error
+var ErrUnavailable = &payment.BankError{
+	Provider:  "paymenttest",
+	Code:      "503",
+	Message:   "bank unavailable",
+	Retryable: true,
+}
+
+// Call is a recorded call to the Bank
+type Call struct {
+	Method      Method
+	Reference   string
+	OperationID string
+	Amount      payment.Money
+}
+
+// Bank is a fake payment.Bank. Every call is recorded; scripted outcomes are
+// used first, then calls fail at FailureRate and succeed otherwise.
+//
+// Verify answers success for the authorized amount of a reference, and
+// pending for a reference that was never authorized.
+type Bank struct {
+	FailureRate float64       // 0 never fails, 1 always fails
+	Latency     time.Duration // every call takes this long, or until its ctx is done
+	Seed        int64         // makes random failures repeatable
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	calls    []Call
+	failures map[Method][]error
+	verify   map[string][]payment.VerifyResponse
+	amounts  map[string]payment.Money // authorized amount per reference
+}
+
+func NewBank() *Bank {
+	return &Bank{
+		failures: make(map[Method][]error),
+		verify:   make(map[string][]payment.VerifyResponse),
+		amounts:  make(map[string]payment.Money),
+	}
+}
+
+// FailNext makes the next calls of a method fail with errs, one per call
+func (b *Bank) FailNext(method Method, errs ...error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures[method] = append(b.failures[method], errs...)
+}
+
+// VerifyNext makes the next verifications of a reference answer responses,
+// one per call
+func (b *Bank) VerifyNext(reference string, responses ...payment.VerifyResponse) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range responses {
+		if r.Reference == "" {
+			r.Reference = reference
+		}
+		b.verify[reference] = append(b.verify[reference], r)
+	}
+}
+
+// Calls returns the recorded calls of a method, or of all methods if none is given
+func (b *Bank) Calls(methods ...Method) []Call {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	calls := []Call{}
+	for _, c := range b.calls {
+		if len(methods) == 0 || contains(methods, c.Method) {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+func contains(methods []Method, m Method) bool {
+	for _, x := range methods {
+		if x == m {
+			return true
+		}
+	}
+	return false
+}
+
+// call records a call, waits Latency and returns the error it should fail with
+func (b *Bank) call(ctx context.Context, c Call) error {
+	b.mu.Lock()
+	b.calls = append(b.calls, c)
+	err := b.failure(c.Method)
+	b.mu.Unlock()
+
+	if b.Latency > 0 {
+		select {
+		case <-time.After(b.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// failure takes the next scripted error of a method, or rolls for a random one
+func (b *Bank) failure(method Method) error {
+	if errs := b.failures[method]; len(errs) > 0 {
+		b.failures[method] = errs[1:]
+		return errs[0]
+	}
+	if b.FailureRate <= 0 {
+		return nil
+	}
+	if b.rng == nil {
+		b.rng = rand.New(rand.NewSource(b.Seed))
+	}
+	if b.rng.Float64() < b.FailureRate {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+func (b *Bank) Authorize(ctx context.Context, req payment.AuthorizeRequest) (payment.AuthorizeResponse, error) {
+	if err := b.call(ctx, Call{Method: MethodAuthorize, Reference: req.PaymentID, OperationID: req.OperationID, Amount: req.Amount}); err != nil {
+		return payment.AuthorizeResponse{}, err
+	}
+
+	b.mu.Lock()
+	b.amounts[req.PaymentID] = req.Amount
+	b.mu.Unlock()
+	return payment.AuthorizeResponse{
+		Reference:        req.PaymentID,
+		AuthorizationURL: "https://checkout.paymenttest.local/" + req.PaymentID,
+	}, nil
+}
+
+func (b *Bank) Verify(ctx context.Context, reference string) (payment.VerifyResponse, error) {
+	if err := b.call(ctx, Call{Method: MethodVerify, Reference: reference}); err != nil {
+		return payment.VerifyResponse{}, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if scripted := b.verify[reference]; len(scripted) > 0 {
+		b.verify[reference] = scripted[1:]
+		return scripted[0], nil
+	}
+	amount, ok := b.amounts[reference]
+	if !ok {
+		return payment.VerifyResponse{Reference: reference, Status: payment.VerifyPending, ProviderStatus: "ongoing"}, nil
+	}
+	return payment.VerifyResponse{Reference: reference, Status: payment.VerifySuccess, ProviderStatus: "success", Amount: amount}, nil
+}
+
+func (b *Bank) Refund(ctx context.Context, req payment.RefundRequest) (payment.RefundResponse, error) {
+	if err := b.call(ctx, Call{Method: MethodRefund, Reference: req.Reference, OperationID: req.OperationID, Amount: req.Amount}); err != nil {
+		return payment.RefundResponse{}, err
+	}
+	return payment.RefundResponse{Reference: fmt.Sprintf("rf_%s", req.OperationID), Status: "pending"}, nil
+}
+
+func (b *Bank) Void(ctx context.Context, req payment.VoidRequest) (payment.VoidResponse, error) {
+	if err := b.call(ctx, Call{Method: MethodVoid, Reference: req.Reference, OperationID: req.OperationID, Amount: req.Amount}); err != nil {
+		return payment.VoidResponse{}, err
+	}
+	return payment.VoidResponse{Reference: req.Reference, Status: "voided"}, nil
+}
+
+var _ payment.Bank = (*Bank)(nil)
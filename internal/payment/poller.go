@@ -0,0 +1,141 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/env"
+)
+
+// PollerConfig tunes the background verification of unfinished checkouts
+type PollerConfig struct {
+	Interval  time.Duration   // how often the poller looks for stale payments
+	MinAge    time.Duration   // leave the webhook and callback some time before polling
+	TTL       time.Duration   // a checkout still unpaid after this is expired
+	BatchSize int             // payments verified per round
+	Backoff   []time.Duration // wait before verifying the same payment again; the last step repeats
+}
+
+// PollerConfigFromEnv reads POLLER_INTERVAL, POLLER_MIN_AGE, PAYMENT_TTL,
+// POLLER_BATCH_SIZE and POLLER_BACKOFF (e.g. "1m,5m,15m,1h")
+func PollerConfigFromEnv() PollerConfig {
+	return PollerConfig{
+		Interval:  env.Interval("POLLER_INTERVAL", time.Minute),
+		MinAge:    env.Duration("POLLER_MIN_AGE", 5*time.Minute),
+		TTL:       env.Duration("PAYMENT_TTL", 24*time.Hour),
+		BatchSize: env.Int("POLLER_BATCH_SIZE", 50),
+		Backoff: env.Durations("POLLER_BACKOFF", []time.Duration{
+			time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour,
+		}),
+	}
+}
+
+// Poller settles payments whose checkout result never reached us: it verifies
+// stale initiated, pending and abandoned payments with the bank and applies
+// the outcome, and expires the ones still unpaid after the TTL.
+type Poller struct {
+	store  Store
+	bank   Bank
+	config PollerConfig
+}
+
+func NewPoller(store Store, bank Bank, config PollerConfig) *Poller {
+	return &Poller{store: store, bank: bank, config: config}
+}
+
+// Run polls until ctx is cancelled
+func (w *Poller) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := w.PollOnce(ctx); err != nil {
+			fmt.Printf("poller: %v\n", err)
+		} else if n > 0 {
+			fmt.Printf("poller: verified %d stale payments\n", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PollOnce verifies one batch of stale payments and returns how many it picked
+func (w *Poller) PollOnce(ctx context.Context) (int, error) {
+	now := time.Now()
+
+	stale, err := w.store.StaleCheckouts(now.Add(-w.config.MinAge), now, w.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range stale {
+		if ctx.Err() != nil {
+			return i, ctx.Err()
+		}
+		w.settle(ctx, &stale[i], now)
+	}
+	return len(stale), nil
+}
+
+func (w *Poller) settle(ctx context.Context, p *Payment, now time.Time) {
+	params := OperationParams{Actor: "poller", Source: SourcePoller}
+
+	// the bank always gets the last word, even past the TTL
+	settled, _, err := w.store.ApplyVerification(ctx, w.bank, p.ID, "poller", params)
+	if err != nil {
+		fmt.Printf("poller: verify %s: %v\n", p.ID, err)
+	}
+	if err == nil && settled.State != Initiated && settled.State != Pending && settled.State != Abandoned {
+		return
+	}
+
+	// only expire what the bank confirmed as unpaid, not what it failed to
+	// answer for; an outcome the payment cannot take still leaves it unpaid
+	answered := err == nil || errors.Is(err, ErrInvalidTranstion)
+	if answered && now.Sub(p.CreatedAt) >= w.config.TTL {
+		if _, err := w.store.Apply(ctx, w.bank, p.ID, "poller-"+p.ID+"-expire", OPExpire, params); err != nil {
+			fmt.Printf("poller: expire %s: %v\n", p.ID, err)
+		}
+		return
+	}
+
+	// still open: back off before asking again
+	attempts := p.VerifyAttempts + 1
+	next := now.Add(w.backoff(attempts))
+	if err := w.store.ScheduleVerification(p.ID, attempts, next); err != nil {
+		fmt.Printf("poller: schedule %s: %v\n", p.ID, err)
+	}
+}
+
+func (w *Poller) backoff(attempts int) time.Duration {
+	if len(w.config.Backoff) == 0 {
+		return w.config.Interval
+	}
+	if attempts > len(w.config.Backoff) {
+		attempts = len(w.config.Backoff)
+	}
+	return w.config.Backoff[attempts-1]
+}
+
+func (s *PaymentStoreDB) StaleCheckouts(createdBefore, now time.Time, limit int) ([]Payment, error) {
+	stale := []Payment{}
+	err := s.DB.
+		Where("state IN ?", []State{Initiated, Pending, Abandoned}).
+		Where("created_at < ?", createdBefore).
+		Where("next_verify_at IS NULL OR next_verify_at <= ?", now).
+		Order("created_at").
+		Limit(limit).
+		Find(&stale).Error
+	return stale, err
+}
+
+func (s *PaymentStoreDB) ScheduleVerification(paymentID string, attempts int, next time.Time) error {
+	return s.DB.Model(&Payment{}).Where("id = ?", paymentID).
+		Updates(map[string]interface{}{"verify_attempts": attempts, "next_verify_at": next}).Error
+}
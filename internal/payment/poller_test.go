@@ -0,0 +1,91 @@
+package payment_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/payment/paymenttest"
+)
+
+// the poller runs on the in-memory store: the database has every other
+// test's stale payments in it
+func TestPollerBacksOffThenExpires(t *testing.T) {
+	ctx := context.Background()
+	store := payment.NewPaymentStore()
+	bank := paymenttest.NewBank()
+	p := newPayment(t, store, 10000)
+
+	poller := payment.NewPoller(store, bank, payment.PollerConfig{
+		TTL:       time.Hour,
+		BatchSize: 10,
+		Backoff:   []time.Duration{time.Minute},
+	})
+
+	bank.VerifyNext(p.ID, payment.VerifyResponse{Status: payment.VerifyPending})
+	if n, err := poller.PollOnce(ctx); err != nil || n != 1 {
+		t.Fatalf("first round picked %d: %v", n, err)
+	}
+	got, err := store.Get(p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != payment.Pending || got.VerifyAttempts != 1 || got.NextVerifyAt == nil {
+		t.Fatalf("after a pending answer: %s, %d attempts, next %v", got.State, got.VerifyAttempts, got.NextVerifyAt)
+	}
+
+	// not due again until the backoff ran out
+	if n, err := poller.PollOnce(ctx); err != nil || n != 0 {
+		t.Fatalf("second round picked %d: %v", n, err)
+	}
+
+	expiring := payment.NewPoller(store, bank, payment.PollerConfig{BatchSize: 10})
+	if err := store.ScheduleVerification(p.ID, 1, time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	bank.VerifyNext(p.ID, payment.VerifyResponse{Status: payment.VerifyPending})
+	if n, err := expiring.PollOnce(ctx); err != nil || n != 1 {
+		t.Fatalf("expiring round picked %d: %v", n, err)
+	}
+	if got, _ := store.Get(p.ID); got.State != payment.Expired {
+		t.Fatalf("past the TTL: %s", got.State)
+	}
+}
+
+func TestSchedulerVoidsExpiredAuthorizations(t *testing.T) {
+	ctx := context.Background()
+	store := payment.NewPaymentStore()
+	bank := paymenttest.NewBank()
+	p := newPayment(t, store, 10000)
+
+	bank.VerifyNext(p.ID, payment.VerifyResponse{
+		Status:          payment.VerifyAuthorized,
+		Amount:          ngn(10000),
+		AuthorizedUntil: time.Now().Add(-time.Minute),
+	})
+	if _, _, err := store.ApplyVerification(ctx, bank, p.ID, "verify", payment.OperationParams{}); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := payment.NewAuthorizationScheduler(store, bank, payment.SchedulerConfig{BatchSize: 10})
+	if n, err := scheduler.RunOnce(ctx); err != nil || n != 1 {
+		t.Fatalf("voided %d: %v", n, err)
+	}
+	if got, _ := store.Get(p.ID); got.State != payment.Voided {
+		t.Fatalf("expired authorization: %s", got.State)
+	}
+}
+
+func TestWorkerIntervalsArePositive(t *testing.T) {
+	for _, v := range []string{"0", "-1m", "soon"} {
+		t.Setenv("POLLER_INTERVAL", v)
+		t.Setenv("SCHEDULER_INTERVAL", v)
+		if got := payment.PollerConfigFromEnv().Interval; got != time.Minute {
+			t.Errorf("POLLER_INTERVAL=%s: %s, want the default", v, got)
+		}
+		if got := payment.SchedulerConfigFromEnv().Interval; got != time.Minute {
+			t.Errorf("SCHEDULER_INTERVAL=%s: %s, want the default", v, got)
+		}
+	}
+}
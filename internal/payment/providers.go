@@ -0,0 +1,107 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// DefaultProvider takes the payments that do not name one
+const DefaultProvider = "paystack"
+
+var (
+	ErrUnknownProvider = fmt.Errorf("unknown payment provider")
+)
+
+// Providers is a Bank that hands every call to the provider of its payment.
+// Authorize uses the provider of the request; the other calls use the one
+// stored on the payment.
+type Providers struct {
+	Default string
+	banks   map[string]Bank
+
+	// providerOf returns the provider of a stored payment
+	providerOf func(paymentID string) (string, error)
+}
+
+// NewProviders routes calls by provider. Register the banks before use.
+func NewProviders(defaultProvider string, store Store) *Providers {
+	if defaultProvider == "" {
+		defaultProvider = DefaultProvider
+	}
+	return &Providers{
+		Default: defaultProvider,
+		banks:   make(map[string]Bank),
+		providerOf: func(paymentID string) (string, error) {
+			p, err := store.Get(paymentID)
+			if err != nil {
+				return "", err
+			}
+			return p.Provider, nil
+		},
+	}
+}
+
+func (p *Providers) Register(name string, bank Bank) {
+	p.banks[name] = bank
+}
+
+// Names lists the registered providers
+func (p *Providers) Names() []string {
+	names := make([]string, 0, len(p.banks))
+	for name := range p.banks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Bank returns the bank of a provider; empty means the default one
+func (p *Providers) Bank(name string) (Bank, string, error) {
+	if name == "" {
+		name = p.Default
+	}
+	bank, ok := p.banks[name]
+	if !ok {
+		return nil, name, fmt.Errorf("%w: %q", ErrUnknownProvider, name)
+	}
+	return bank, name, nil
+}
+
+func (p *Providers) Authorize(ctx context.Context, req AuthorizeRequest) (AuthorizeResponse, error) {
+	bank, name, err := p.Bank(req.Provider)
+	if err != nil {
+		return AuthorizeResponse{}, err
+	}
+	resp, err := bank.Authorize(ctx, req)
+	resp.Provider = name
+	return resp, err
+}
+
+func (p *Providers) Verify(ctx context.Context, reference string) (VerifyResponse, error) {
+	provider, err := p.providerOf(reference)
+	if err != nil {
+		return VerifyResponse{}, err
+	}
+	bank, _, err := p.Bank(provider)
+	if err != nil {
+		return VerifyResponse{}, err
+	}
+	return bank.Verify(ctx, reference)
+}
+
+func (p *Providers) Refund(ctx context.Context, req RefundRequest) (RefundResponse, error) {
+	bank, _, err := p.Bank(req.Provider)
+	if err != nil {
+		return RefundResponse{}, err
+	}
+	return bank.Refund(ctx, req)
+}
+
+func (p *Providers) Void(ctx context.Context, req VoidRequest) (VoidResponse, error) {
+	bank, _, err := p.Bank(req.Provider)
+	if err != nil {
+		return VoidResponse{}, err
+	}
+	return bank.Void(ctx, req)
+}
@@ -0,0 +1,77 @@
+package payment_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/payment/paymenttest"
+)
+
+func TestProvidersRouteByPayment(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store payment.Store) {
+		ctx := context.Background()
+		paystack, flutterwave := paymenttest.NewBank(), paymenttest.NewBank()
+		providers := payment.NewProviders("", store)
+		providers.Register("paystack", paystack)
+		providers.Register("flutterwave", flutterwave)
+
+		id := "pay-" + runID + "-" + strconv.Itoa(nextPayment())
+		resp, err := providers.Authorize(ctx, payment.AuthorizeRequest{Provider: "flutterwave", PaymentID: id, Amount: ngn(10000)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Provider != "flutterwave" {
+			t.Fatalf("authorized by %q", resp.Provider)
+		}
+		p, err := store.Create(id, ngn(10000), "usr_test", "order_test", resp.Provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, _, err := store.ApplyVerification(ctx, providers, p.ID, "verify", payment.OperationParams{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Apply(ctx, providers, p.ID, "ref", payment.OPRefund, payment.OperationParams{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if calls := paystack.Calls(); len(calls) != 0 {
+			t.Fatalf("paystack was called for a flutterwave payment: %v", calls)
+		}
+		for _, method := range []paymenttest.Method{paymenttest.MethodAuthorize, paymenttest.MethodVerify, paymenttest.MethodRefund} {
+			if len(flutterwave.Calls(method)) != 1 {
+				t.Fatalf("flutterwave %s calls: %v", method, flutterwave.Calls(method))
+			}
+		}
+	})
+}
+
+func TestProvidersDefault(t *testing.T) {
+	store := payment.NewPaymentStore()
+	providers := payment.NewProviders("", store)
+	providers.Register(payment.DefaultProvider, paymenttest.NewBank())
+
+	resp, err := providers.Authorize(context.Background(), payment.AuthorizeRequest{PaymentID: "pay_default", Amount: ngn(100)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Provider != payment.DefaultProvider {
+		t.Fatalf("authorized by %q", resp.Provider)
+	}
+
+	p, err := store.Create("pay_default", ngn(100), "usr_test", "order_test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Provider != payment.DefaultProvider {
+		t.Fatalf("stored provider %q", p.Provider)
+	}
+
+	_, err = providers.Authorize(context.Background(), payment.AuthorizeRequest{Provider: "stripe", PaymentID: "pay_other"})
+	if !errors.Is(err, payment.ErrUnknownProvider) {
+		t.Fatalf("expected ErrUnknownProvider, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package payment
+
+import (
+	"fmt"
+	"sort"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Replay folds the successful operations of a payment, oldest first, through
+// the state machine and returns the payment as its operation log describes it.
+// The stored State and amounts of p are ignored; hooks are not run. What the
+// log does not carry (the hold's expiry, the review reason, the poller's
+// schedule) is taken from p.
+func Replay(p *Payment, ops []PaymentOperation) (*Payment, error) {
+	ordered := make([]PaymentOperation, len(ops))
+	copy(ordered, ops)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].ID < ordered[j].ID })
+
+	replayed := NewPayment(p.ID, p.Amount)
+	replayed.UserID = p.UserID
+	replayed.OrderID = p.OrderID
+	replayed.Provider = p.Provider
+	replayed.CreatedAt = p.CreatedAt
+	replayed.UpdatedAt = p.UpdatedAt
+
+	// a bare machine: same table, no notifications or metrics
+	machine := NewStateMachine(Lifecycle.Transitions())
+	for _, op := range ordered {
+		if op.Result != "success" {
+			continue
+		}
+		params := OperationParams{
+			Amount:        op.Amount,
+			Final:         op.Final,
+			BankReference: op.BankReference,
+		}
+		if _, err := machine.Apply(replayed, Operation(op.Operation), params); err != nil {
+			return nil, fmt.Errorf("replay %s of payment %s: %w", op.OperationID, p.ID, err)
+		}
+	}
+
+	replayed.AuthorizedUntil = p.AuthorizedUntil
+	replayed.ReviewReason = p.ReviewReason
+	replayed.VerifyAttempts = p.VerifyAttempts
+	replayed.NextVerifyAt = p.NextVerifyAt
+	replayed.Operations = ops
+	return replayed, nil
+}
+
+// Inconsistency is a payment whose stored state disagrees with its operation log
+type Inconsistency struct {
+	PaymentID     string `json:"payment_id"`
+	StoredState   State  `json:"stored_state"`
+	ReplayedState State  `json:"replayed_state,omitempty"`
+	Error         string `json:"error,omitempty"` // the log itself cannot be replayed
+	Repaired      bool   `json:"repaired"`
+}
+
+// matches reports whether the stored columns agree with the replayed payment
+func (p *Payment) matches(replayed *Payment) bool {
+	return p.State == replayed.State &&
+		p.CapturedAmount == replayed.CapturedAmount &&
+		p.RefundedAmount == replayed.RefundedAmount &&
+		p.PendingRefundAmount == replayed.PendingRefundAmount &&
+		p.DisputedAmount == replayed.DisputedAmount &&
+		p.DisputedFrom == replayed.DisputedFrom
+}
+
+// adopt takes over the state and amounts of the replayed payment
+func (p *Payment) adopt(replayed *Payment) {
+	p.State = replayed.State
+	p.CapturedAmount = replayed.CapturedAmount
+	p.RefundedAmount = replayed.RefundedAmount
+	p.PendingRefundAmount = replayed.PendingRefundAmount
+	p.DisputedAmount = replayed.DisputedAmount
+	p.DisputedFrom = replayed.DisputedFrom
+}
+
+// CheckConsistency replays every payment and reports the ones whose stored
+// state disagrees with their operations. With repair set, the stored state
+// and amounts are overwritten with the replayed ones.
+func (s *PaymentStoreDB) CheckConsistency(repair bool) ([]Inconsistency, error) {
+	found := []Inconsistency{}
+
+	var batch []Payment
+	err := s.DB.Preload("Operations").FindInBatches(&batch, 100, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			p := &batch[i]
+			replayed, err := Replay(p, p.Operations)
+			if err != nil {
+				found = append(found, Inconsistency{PaymentID: p.ID, StoredState: p.State, Error: err.Error()})
+				continue
+			}
+			if p.matches(replayed) {
+				continue
+			}
+
+			issue := Inconsistency{PaymentID: p.ID, StoredState: p.State, ReplayedState: replayed.State}
+			if repair {
+				if err := s.repair(p.ID); err != nil {
+					issue.Error = err.Error()
+				} else {
+					issue.Repaired = true
+				}
+			}
+			found = append(found, issue)
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// repair overwrites the stored state of a payment with its replayed state.
+// The row is locked and replayed again so a concurrent Apply is not lost.
+func (s *PaymentStoreDB) repair(paymentID string) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		var p Payment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&p, "id = ?", paymentID).Error; err != nil {
+			return notFound(err)
+		}
+
+		var ops []PaymentOperation
+		if err := tx.Where("payment_id = ?", paymentID).Order("id").Find(&ops).Error; err != nil {
+			return err
+		}
+
+		replayed, err := Replay(&p, ops)
+		if err != nil {
+			return err
+		}
+		p.adopt(replayed)
+		return tx.Save(&p).Error
+	})
+}
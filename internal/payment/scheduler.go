@@ -0,0 +1,91 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/env"
+)
+
+// SchedulerConfig tunes the voiding of expired authorizations
+type SchedulerConfig struct {
+	Interval  time.Duration // how often the scheduler looks for expired authorizations
+	BatchSize int           // authorizations voided per round
+}
+
+// SchedulerConfigFromEnv reads SCHEDULER_INTERVAL and SCHEDULER_BATCH_SIZE
+func SchedulerConfigFromEnv() SchedulerConfig {
+	return SchedulerConfig{
+		Interval:  env.Interval("SCHEDULER_INTERVAL", time.Minute),
+		BatchSize: env.Int("SCHEDULER_BATCH_SIZE", 50),
+	}
+}
+
+// AuthorizationScheduler voids authorizations that ran past AuthorizedUntil
+// without being captured, so held funds do not linger on the customer's card.
+// A partially captured payment keeps what was captured and releases the rest.
+type AuthorizationScheduler struct {
+	store  Store
+	bank   Bank
+	config SchedulerConfig
+}
+
+func NewAuthorizationScheduler(store Store, bank Bank, config SchedulerConfig) *AuthorizationScheduler {
+	return &AuthorizationScheduler{store: store, bank: bank, config: config}
+}
+
+// Run voids expired authorizations until ctx is cancelled
+func (w *AuthorizationScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := w.RunOnce(ctx); err != nil {
+			fmt.Printf("scheduler: %v\n", err)
+		} else if n > 0 {
+			fmt.Printf("scheduler: voided %d expired authorizations\n", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce voids one batch of expired authorizations and returns how many succeeded
+func (w *AuthorizationScheduler) RunOnce(ctx context.Context) (int, error) {
+	expired, err := w.store.ExpiredAuthorizations(time.Now(), w.config.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	voided := 0
+	for _, p := range expired {
+		if ctx.Err() != nil {
+			return voided, ctx.Err()
+		}
+
+		// one void per payment: a retry after a failed bank call reuses the operation
+		params := OperationParams{Actor: "scheduler", Source: SourceScheduler}
+		if _, err := w.store.Apply(ctx, w.bank, p.ID, "scheduler-"+p.ID+"-void", OPVoid, params); err != nil {
+			fmt.Printf("scheduler: void %s: %v\n", p.ID, err)
+			continue
+		}
+		voided++
+	}
+	return voided, nil
+}
+
+func (s *PaymentStoreDB) ExpiredAuthorizations(now time.Time, limit int) ([]Payment, error) {
+	expired := []Payment{}
+	err := s.DB.
+		Where("state IN ?", []State{Authorized, PartiallyCaptured}).
+		Where("authorized_until < ?", now).
+		Order("authorized_until").
+		Limit(limit).
+		Find(&expired).Error
+	return expired, err
+}
@@ -0,0 +1,259 @@
+package payment
+
+import (
+	"fmt"
+	"sync"
+)
+
+// GuardFunc decides whether a transition applies to a payment.
+// It sees the payment before the operation changes it.
+type GuardFunc func(p *Payment, params OperationParams) bool
+
+// Transition is one row of the payment lifecycle table
+type Transition struct {
+	From      State     `json:"from"`
+	Operation Operation `json:"operation"`
+	To        State     `json:"to"`
+	Guard     string    `json:"guard,omitempty"` // human readable condition
+
+	Check GuardFunc `json:"-"`
+}
+
+// BeforeHook runs before a transition is applied; an error rejects the operation
+type BeforeHook func(p *Payment, t Transition, params OperationParams) error
+
+// AfterHook runs once a transition has been applied, e.g. for notifications and metrics
+type AfterHook func(p *Payment, t Transition, res OperationResult)
+
+// StateMachine applies operations to payments according to a transition table
+type StateMachine struct {
+	mu          sync.RWMutex
+	transitions []Transition
+	before      []BeforeHook
+	after       []AfterHook
+}
+
+func NewStateMachine(transitions []Transition) *StateMachine {
+	return &StateMachine{transitions: transitions}
+}
+
+// Lifecycle is the state machine every payment goes through
+var Lifecycle = NewStateMachine(transitionTable)
+
+// AllStates lists the payment states in lifecycle order
+var AllStates = []State{
+	Initiated,
+	Pending,
+	Abandoned,
+	Failed,
+	NeedsReview,
+	Expired,
+	Authorized,
+	PartiallyCaptured,
+	Captured,
+	Voided,
+	RefundPending,
+	PartiallyRefunded,
+	Refunded,
+	Disputed,
+	ChargedBack,
+}
+
+var transitionTable = []Transition{
+	{From: Initiated, Operation: OPAuthorize, To: Authorized},
+	{From: Pending, Operation: OPAuthorize, To: Authorized},
+	{From: Abandoned, Operation: OPAuthorize, To: Authorized},
+
+	// verifying a checkout that has not succeeded yet never ends it for good,
+	// except for an outright failure
+	{From: Initiated, Operation: OPMarkPending, To: Pending},
+	{From: Pending, Operation: OPMarkPending, To: Pending},
+	{From: Abandoned, Operation: OPMarkPending, To: Pending},
+	{From: Initiated, Operation: OPAbandon, To: Abandoned},
+	{From: Pending, Operation: OPAbandon, To: Abandoned},
+	{From: Initiated, Operation: OPFail, To: Failed},
+	{From: Pending, Operation: OPFail, To: Failed},
+	{From: Abandoned, Operation: OPFail, To: Failed},
+	{From: Initiated, Operation: OPExpire, To: Expired},
+	{From: Pending, Operation: OPExpire, To: Expired},
+	{From: Abandoned, Operation: OPExpire, To: Expired},
+
+	// a charge that does not match the payment waits for the operations team,
+	// who either accept it (capture) or reject it (fail)
+	{From: Initiated, Operation: OPFlagForReview, To: NeedsReview},
+	{From: Pending, Operation: OPFlagForReview, To: NeedsReview},
+	{From: Abandoned, Operation: OPFlagForReview, To: NeedsReview},
+	{From: NeedsReview, Operation: OPCapture, To: Captured, Guard: "reviewed and accepted"},
+	{From: NeedsReview, Operation: OPFail, To: Failed, Guard: "reviewed and rejected"},
+
+	// the checkout callback captures straight from initiated, pending or abandoned
+	{From: Initiated, Operation: OPCapture, To: Captured, Guard: "full or final capture", Check: isFullCapture},
+	{From: Initiated, Operation: OPCapture, To: PartiallyCaptured, Guard: "partial capture", Check: not(isFullCapture)},
+	{From: Pending, Operation: OPCapture, To: Captured, Guard: "full or final capture", Check: isFullCapture},
+	{From: Pending, Operation: OPCapture, To: PartiallyCaptured, Guard: "partial capture", Check: not(isFullCapture)},
+	{From: Abandoned, Operation: OPCapture, To: Captured, Guard: "full or final capture", Check: isFullCapture},
+	{From: Abandoned, Operation: OPCapture, To: PartiallyCaptured, Guard: "partial capture", Check: not(isFullCapture)},
+	{From: Authorized, Operation: OPCapture, To: Captured, Guard: "full or final capture", Check: isFullCapture},
+	{From: Authorized, Operation: OPCapture, To: PartiallyCaptured, Guard: "partial capture", Check: not(isFullCapture)},
+	{From: PartiallyCaptured, Operation: OPCapture, To: Captured, Guard: "full or final capture", Check: isFullCapture},
+	{From: PartiallyCaptured, Operation: OPCapture, To: PartiallyCaptured, Guard: "partial capture", Check: not(isFullCapture)},
+
+	{From: Authorized, Operation: OPVoid, To: Voided},
+	{From: PartiallyCaptured, Operation: OPVoid, To: Captured, Guard: "releases the uncaptured remainder"},
+
+	{From: Captured, Operation: OPRefund, To: RefundPending},
+	{From: PartiallyRefunded, Operation: OPRefund, To: RefundPending},
+
+	{From: RefundPending, Operation: OPRefundProcessed, To: Refunded, Guard: "everything captured is refunded", Check: isFullyRefunded},
+	{From: RefundPending, Operation: OPRefundProcessed, To: PartiallyRefunded, Guard: "part of the capture is still kept", Check: not(isFullyRefunded)},
+	{From: RefundPending, Operation: OPRefundFailed, To: Captured, Guard: "no earlier refund", Check: hasNoRefunds},
+	{From: RefundPending, Operation: OPRefundFailed, To: PartiallyRefunded, Guard: "earlier refunds settled", Check: not(hasNoRefunds)},
+
+	// there is no refund row out of disputed: refunds wait for the outcome,
+	// though one sent before the dispute still settles. A lost dispute that
+	// took back only part of the capture leaves the rest refundable.
+	{From: Captured, Operation: OPDispute, To: Disputed},
+	{From: PartiallyCaptured, Operation: OPDispute, To: Disputed},
+	{From: RefundPending, Operation: OPDispute, To: Disputed},
+	{From: PartiallyRefunded, Operation: OPDispute, To: Disputed},
+	{From: Refunded, Operation: OPDispute, To: Disputed},
+	{From: Disputed, Operation: OPRefundProcessed, To: Disputed, Guard: "refund sent before the dispute", Check: hasPendingRefund},
+	{From: Disputed, Operation: OPRefundFailed, To: Disputed, Guard: "refund sent before the dispute", Check: hasPendingRefund},
+	{From: Disputed, Operation: OPWinDispute, To: RefundPending, Guard: "a refund is still pending", Check: hasPendingRefund},
+	{From: Disputed, Operation: OPWinDispute, To: Refunded, Guard: "everything captured is refunded", Check: isFullyRefunded},
+	{From: Disputed, Operation: OPWinDispute, To: PartiallyCaptured, Guard: "disputed while partially captured", Check: disputedFrom(PartiallyCaptured)},
+	{From: Disputed, Operation: OPWinDispute, To: Captured, Guard: "no earlier refund", Check: hasNoRefunds},
+	{From: Disputed, Operation: OPWinDispute, To: PartiallyRefunded, Guard: "earlier refunds settled", Check: not(hasNoRefunds)},
+	{From: Disputed, Operation: OPChargeback, To: ChargedBack},
+	{From: ChargedBack, Operation: OPRefundProcessed, To: ChargedBack, Guard: "refund sent before the dispute", Check: hasPendingRefund},
+	{From: ChargedBack, Operation: OPRefundFailed, To: ChargedBack, Guard: "refund sent before the dispute", Check: hasPendingRefund},
+	{From: ChargedBack, Operation: OPRefund, To: ChargedBack, Guard: "part of the capture is still kept", Check: keepsUnrefunded},
+}
+
+// Transitions returns a copy of the transition table
+func (m *StateMachine) Transitions() []Transition {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make([]Transition, len(m.transitions))
+	copy(out, m.transitions)
+	return out
+}
+
+func (m *StateMachine) BeforeTransition(h BeforeHook) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.before = append(m.before, h)
+}
+
+func (m *StateMachine) AfterTransition(h AfterHook) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.after = append(m.after, h)
+}
+
+// Find returns the transition an operation would take from the payment's current state
+func (m *StateMachine) Find(p *Payment, operation Operation, params OperationParams) (Transition, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, t := range m.transitions {
+		if t.From != p.State || t.Operation != operation {
+			continue
+		}
+		if t.Check == nil || t.Check(p, params) {
+			return t, nil
+		}
+	}
+	return Transition{}, fmt.Errorf("%w: cannot %s from %s", ErrInvalidTranstion, operation, p.State)
+}
+
+// Apply runs an operation on a payment: it picks the transition from the table,
+// runs the before hooks, updates the amounts, moves the state and runs the after hooks
+func (m *StateMachine) Apply(p *Payment, operation Operation, params OperationParams) (OperationResult, error) {
+	effect, ok := operationEffects[operation]
+	if !ok {
+		return OperationResult{}, fmt.Errorf("unknowk operation: %s", operation)
+	}
+
+	// amounts without a currency are in the payment's currency
+	if params.Amount.Currency == "" {
+		params.Amount.Currency = p.Amount.Currency
+	}
+
+	t, err := m.Find(p, operation, params)
+	if err != nil {
+		return OperationResult{}, err
+	}
+
+	m.mu.RLock()
+	before, after := m.before, m.after
+	m.mu.RUnlock()
+
+	for _, h := range before {
+		if err := h(p, t, params); err != nil {
+			return OperationResult{}, err
+		}
+	}
+
+	amount, err := effect(p, params)
+	if err != nil {
+		return OperationResult{}, err
+	}
+	p.State = t.To
+
+	res := OperationResult{
+		Operation: operation,
+		State:     p.State,
+		Amount:    amount,
+	}
+	for _, h := range after {
+		h(p, t, res)
+	}
+	return res, nil
+}
+
+// guards
+
+func not(g GuardFunc) GuardFunc {
+	return func(p *Payment, params OperationParams) bool {
+		return !g(p, params)
+	}
+}
+
+func isFullCapture(p *Payment, params OperationParams) bool {
+	if params.Final || params.Amount.IsZero() {
+		return true
+	}
+	remaining, err := p.Amount.Sub(p.CapturedAmount)
+	return err == nil && params.Amount == remaining
+}
+
+func isFullyRefunded(p *Payment, _ OperationParams) bool {
+	refunded, err := p.RefundedAmount.Add(p.PendingRefundAmount)
+	return err == nil && refunded == p.CapturedAmount
+}
+
+func hasNoRefunds(p *Payment, _ OperationParams) bool {
+	return p.RefundedAmount.IsZero()
+}
+
+func hasPendingRefund(p *Payment, _ OperationParams) bool {
+	return !p.PendingRefundAmount.IsZero()
+}
+
+// keepsUnrefunded tells a payment with captured money left to refund and no
+// refund pending
+func keepsUnrefunded(p *Payment, _ OperationParams) bool {
+	if !p.PendingRefundAmount.IsZero() {
+		return false
+	}
+	kept, err := p.CapturedAmount.Sub(p.RefundedAmount)
+	return err == nil && kept.Amount > 0
+}
+
+func disputedFrom(state State) GuardFunc {
+	return func(p *Payment, _ OperationParams) bool {
+		return p.DisputedFrom == state
+	}
+}
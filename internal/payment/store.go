@@ -1,50 +1,501 @@
 package payment
 
-// type PaymentStore struct {
-// 	Mu       sync.RWMutex
-// 	Payments map[string]*StoredPayment
-// }
-
-// type StoredPayment struct {
-// 	Mu      sync.Mutex
-// 	Payment *Payment
-// }
-
-// func NewPaymentStore() *PaymentStore {
-// 	return &PaymentStore{
-// 		Payments: make(map[string]*StoredPayment),
-// 	}
-// }
-
-// func (s *PaymentStore) Create(id string, amount int64) *Payment {
-// 	s.Mu.Lock()
-// 	defer s.Mu.Unlock()
-// 	p := NewPayment(id, amount)
-// 	s.Payments[id] = &StoredPayment{Payment: p}
-// 	return p
-// }
-
-// func (s *PaymentStore) Get(id string) (*StoredPayment, bool) {
-// 	s.Mu.Lock()
-// 	defer s.Mu.Unlock()
-
-// 	p, ok := s.Payments[id]
-// 	return p, ok
-// }
-
-// func (s *PaymentStore) Apply(
-// 	bank Bank,
-// 	paymentId string,
-// 	operationId string,
-// 	operation Operation,
-// ) error {
-// 	stored, ok := s.Get(paymentId)
-// 	if !ok {
-// 		return fmt.Errorf("payment not found")
-// 	}
-
-// 	stored.Mu.Lock()
-// 	defer stored.Mu.Unlock()
-
-// 	return stored.Payment.ApplyOperation(operationId, operation)
-// }
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/ledger"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrPaymentNotFound = fmt.Errorf("payment not found: %w", gorm.ErrRecordNotFound)
+)
+
+// notFound reports a missing payment row as ErrPaymentNotFound
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrPaymentNotFound
+	}
+	return err
+}
+
+// Store keeps payments and applies operations to them. PaymentStoreDB keeps
+// them in Postgres; PaymentStore keeps them in memory, for tests and for
+// running the HTTP layer without a database.
+//
+// Only PaymentStoreDB announces changes: it writes the domain events to the
+// outbox and queues the merchant webhook deliveries in the transaction of the
+// change. PaymentStore keeps the journal but announces nothing, so tests of
+// events and deliveries run against Postgres.
+type Store interface {
+	// Create stores a new payment; an empty provider means DefaultProvider
+	Create(id string, amount Money, userId, orderId, provider string) (*Payment, error)
+	Get(id string) (*Payment, error)
+	// GetByBankReference finds the payment of a provider that has an
+	// operation with the reference, e.g. the refund a provider webhook is about
+	GetByBankReference(provider, reference string) (*Payment, error)
+
+	// List returns every payment with its operations, oldest first
+	List() ([]Payment, error)
+
+	Apply(ctx context.Context, bank Bank, paymentID, operationID string, operation Operation, params OperationParams) (*Payment, error)
+	ApplyVerification(ctx context.Context, bank Bank, paymentID, opPrefix string, params OperationParams) (*Payment, VerifyResponse, error)
+
+	Timeline(paymentID string) ([]PaymentStateTransition, error)
+	NeedingReview() ([]Payment, error)
+	CheckConsistency(repair bool) ([]Inconsistency, error)
+
+	Journal(paymentID string) ([]ledger.JournalEntry, error)
+	Balances() ([]ledger.Balance, error)
+
+	// StaleCheckouts lists initiated, pending and abandoned payments created
+	// before createdBefore whose next verification is due at now, oldest first
+	StaleCheckouts(createdBefore, now time.Time, limit int) ([]Payment, error)
+	// ScheduleVerification records when the poller verifies a payment again
+	ScheduleVerification(paymentID string, attempts int, next time.Time) error
+	// ExpiredAuthorizations lists the holds that ran out before now, oldest first
+	ExpiredAuthorizations(now time.Time, limit int) ([]Payment, error)
+}
+
+var (
+	_ Store = (*PaymentStoreDB)(nil)
+	_ Store = (*PaymentStore)(nil)
+)
+
+// PaymentStore is an in-memory payment store. Operations on one payment are
+// serialized by its own lock, so different payments never wait on each other.
+// It writes no outbox messages and queues no webhook deliveries.
+type PaymentStore struct {
+	Mu       sync.RWMutex
+	Payments map[string]*StoredPayment
+	order    []string // payment IDs, oldest first
+
+	lastID uint // row IDs of operations, transitions and journal entries
+}
+
+type StoredPayment struct {
+	Mu      sync.Mutex
+	Payment *Payment
+
+	Transitions []PaymentStateTransition
+	Journal     []ledger.JournalEntry
+}
+
+func NewPaymentStore() *PaymentStore {
+	return &PaymentStore{
+		Payments: make(map[string]*StoredPayment),
+	}
+}
+
+func (s *PaymentStore) Create(id string, amount Money, userId, orderId, provider string) (*Payment, error) {
+	if _, err := NewMoney(amount.Amount, string(amount.Currency)); err != nil {
+		return nil, err
+	}
+
+	p := NewPayment(id, amount)
+	p.UserID = userId
+	p.OrderID = orderId
+	if provider != "" {
+		p.Provider = provider
+	}
+	p.CreatedAt = time.Now()
+	p.UpdatedAt = p.CreatedAt
+
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	if _, ok := s.Payments[id]; ok {
+		return nil, fmt.Errorf("payment %s already exists", id)
+	}
+	s.Payments[id] = &StoredPayment{Payment: p}
+	s.order = append(s.order, id)
+	return p.clone(), nil
+}
+
+// stored looks a payment up; its own lock is not taken
+func (s *PaymentStore) stored(id string) (*StoredPayment, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	stored, ok := s.Payments[id]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	return stored, nil
+}
+
+// all returns the stored payments, oldest first
+func (s *PaymentStore) all() []*StoredPayment {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	all := make([]*StoredPayment, 0, len(s.order))
+	for _, id := range s.order {
+		all = append(all, s.Payments[id])
+	}
+	return all
+}
+
+func (s *PaymentStore) nextID() uint {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	s.lastID++
+	return s.lastID
+}
+
+func (s *PaymentStore) Get(id string) (*Payment, error) {
+	stored, err := s.stored(id)
+	if err != nil {
+		return nil, err
+	}
+	stored.Mu.Lock()
+	defer stored.Mu.Unlock()
+	return stored.Payment.clone(), nil
+}
+
+func (s *PaymentStore) GetByBankReference(provider, reference string) (*Payment, error) {
+	if reference == "" {
+		return nil, ErrPaymentNotFound
+	}
+	for _, stored := range s.all() {
+		stored.Mu.Lock()
+		p := stored.Payment.clone()
+		stored.Mu.Unlock()
+
+		if p.Provider != provider {
+			continue
+		}
+		for _, op := range p.Operations {
+			if op.BankReference == reference {
+				return p, nil
+			}
+		}
+	}
+	return nil, ErrPaymentNotFound
+}
+
+func (s *PaymentStore) List() ([]Payment, error) {
+	payments := []Payment{}
+	for _, stored := range s.all() {
+		stored.Mu.Lock()
+		payments = append(payments, *stored.Payment.clone())
+		stored.Mu.Unlock()
+	}
+	return payments, nil
+}
+
+// Apply works like PaymentStoreDB.Apply: the operation runs on a copy that
+// only replaces the stored payment once the bank call succeeded, a retry of
+// the same operation ID gets the first response back, and failed attempts
+// are recorded.
+func (s *PaymentStore) Apply(
+	ctx context.Context,
+	bank Bank,
+	paymentID string,
+	operationID string,
+	operation Operation,
+	params OperationParams,
+) (*Payment, error) {
+	stored, err := s.stored(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	stored.Mu.Lock()
+	defer stored.Mu.Unlock()
+
+	if params.Amount.Currency == "" {
+		params.Amount.Currency = stored.Payment.Amount.Currency
+	}
+	fingerprint := Fingerprint(operation, params)
+	attempt := PaymentOperation{
+		PaymentID:   paymentID,
+		OperationID: operationID,
+		Operation:   string(operation),
+		Amount:      params.Amount,
+		Final:       params.Final,
+		Source:      params.Source,
+		Fingerprint: fingerprint,
+		Attempts:    1,
+	}
+
+	//  Check if the operation was already applied
+	if i := stored.operation(operationID); i >= 0 {
+		op := stored.Payment.Operations[i]
+		if op.Result != "failed" {
+			replayed, err := op.replayResponse(fingerprint)
+			if err != nil || replayed != nil {
+				return replayed, err
+			}
+			return stored.Payment.clone(), nil
+		}
+		if op.Fingerprint != "" && op.Fingerprint != fingerprint {
+			return nil, fmt.Errorf("%w: %s", ErrIdempotencyConflict, operationID)
+		}
+		if !op.Retryable {
+			return nil, op.failureError()
+		}
+		attempt.Attempts = op.Attempts + 1
+		stored.Payment.Operations = append(stored.Payment.Operations[:i], stored.Payment.Operations[i+1:]...)
+	}
+
+	p := stored.Payment.clone()
+	if err := s.apply(ctx, bank, stored, p, attempt, params); err != nil {
+		return nil, err
+	}
+	return p.clone(), nil
+}
+
+// apply runs an operation on p and, if it succeeds, stores p with the
+// operation, its transition and its journal entry. A failed attempt is
+// recorded on the stored payment instead.
+func (s *PaymentStore) apply(ctx context.Context, bank Bank, stored *StoredPayment, p *Payment, attempt PaymentOperation, params OperationParams) error {
+	fail := func(err error, latency time.Duration) {
+		f := classifyFailure(err, latency)
+		failed := attempt
+		failed.ID = s.nextID()
+		failed.Result = "failed"
+		failed.ErrorCode = f.Code
+		failed.ErrorMessage = f.Message
+		failed.Retryable = f.Retryable
+		failed.LatencyMs = f.Latency.Milliseconds()
+		failed.CreatedAt = time.Now()
+		stored.Payment.Operations = append(stored.Payment.Operations, failed)
+	}
+
+	operation := Operation(attempt.Operation)
+	from := p.State
+	res, err := p.ApplyOperation(attempt.OperationID, operation, params)
+	if err != nil {
+		fail(err, 0)
+		return err
+	}
+
+	//  Move the money before anything is stored, so a failed call changes nothing
+	var latency time.Duration
+	switch operation {
+	case OPRefund:
+		started := time.Now()
+		refund, err := bank.Refund(ctx, RefundRequest{
+			Provider:    p.Provider,
+			OperationID: attempt.OperationID,
+			Reference:   p.ID,
+			Amount:      res.Amount,
+		})
+		latency = time.Since(started)
+		if err != nil {
+			fail(err, latency)
+			return fmt.Errorf("bank refund failed: %w", err)
+		}
+		params.BankReference = refund.Reference
+	case OPVoid:
+		started := time.Now()
+		void, err := bank.Void(ctx, VoidRequest{
+			Provider:    p.Provider,
+			OperationID: attempt.OperationID,
+			Reference:   p.ID,
+			Amount:      res.Amount,
+		})
+		latency = time.Since(started)
+		if err != nil {
+			fail(err, latency)
+			return fmt.Errorf("bank void failed: %w", err)
+		}
+		params.BankReference = void.Reference
+	}
+
+	now := time.Now()
+	op := attempt
+	op.ID = s.nextID()
+	op.Amount = res.Amount
+	op.Result = "success"
+	op.BankReference = params.BankReference
+	op.LatencyMs = latency.Milliseconds()
+	op.CreatedAt = now
+	p.Operations = append(p.Operations, op)
+	p.UpdatedAt = now
+
+	transition := PaymentStateTransition{
+		ID:          s.nextID(),
+		PaymentID:   p.ID,
+		OperationID: attempt.OperationID,
+		Operation:   string(operation),
+		FromState:   from,
+		ToState:     res.State,
+		Actor:       params.Actor,
+		Source:      params.Source,
+		CreatedAt:   now,
+	}
+
+	if entry := journalEntry(p, attempt.OperationID, from, res); entry != nil && len(entry.Lines) > 0 {
+		if err := entry.Validate(); err != nil {
+			return err
+		}
+		entry.ID = s.nextID()
+		entry.CreatedAt = now
+		for i := range entry.Lines {
+			entry.Lines[i].ID = s.nextID()
+			entry.Lines[i].EntryID = entry.ID
+		}
+		stored.Journal = append(stored.Journal, *entry)
+	}
+
+	//  Remember the response so a retry gets exactly the same one
+	response, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	p.Operations[len(p.Operations)-1].Response = string(response)
+
+	stored.Payment = p
+	stored.Transitions = append(stored.Transitions, transition)
+	return nil
+}
+
+// operation returns the index of an operation ID, or -1
+func (stored *StoredPayment) operation(operationID string) int {
+	for i, op := range stored.Payment.Operations {
+		if op.OperationID == operationID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *PaymentStore) ApplyVerification(
+	ctx context.Context,
+	bank Bank,
+	paymentID string,
+	opPrefix string,
+	params OperationParams,
+) (*Payment, VerifyResponse, error) {
+	return applyVerification(ctx, s, bank, paymentID, opPrefix, params)
+}
+
+func (s *PaymentStore) Timeline(paymentID string) ([]PaymentStateTransition, error) {
+	stored, err := s.stored(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	stored.Mu.Lock()
+	defer stored.Mu.Unlock()
+	return append([]PaymentStateTransition{}, stored.Transitions...), nil
+}
+
+func (s *PaymentStore) NeedingReview() ([]Payment, error) {
+	payments := []Payment{}
+	for _, stored := range s.all() {
+		stored.Mu.Lock()
+		if stored.Payment.State == NeedsReview {
+			payments = append(payments, *stored.Payment.clone())
+		}
+		stored.Mu.Unlock()
+	}
+	return payments, nil
+}
+
+func (s *PaymentStore) CheckConsistency(repair bool) ([]Inconsistency, error) {
+	found := []Inconsistency{}
+	for _, stored := range s.all() {
+		stored.Mu.Lock()
+		p := stored.Payment
+		replayed, err := Replay(p, p.Operations)
+		switch {
+		case err != nil:
+			found = append(found, Inconsistency{PaymentID: p.ID, StoredState: p.State, Error: err.Error()})
+		case !p.matches(replayed):
+			issue := Inconsistency{PaymentID: p.ID, StoredState: p.State, ReplayedState: replayed.State}
+			if repair {
+				p.adopt(replayed)
+				issue.Repaired = true
+			}
+			found = append(found, issue)
+		}
+		stored.Mu.Unlock()
+	}
+	return found, nil
+}
+
+func (s *PaymentStore) Journal(paymentID string) ([]ledger.JournalEntry, error) {
+	stored, err := s.stored(paymentID)
+	if err != nil {
+		return nil, err
+	}
+	stored.Mu.Lock()
+	defer stored.Mu.Unlock()
+	return append([]ledger.JournalEntry{}, stored.Journal...), nil
+}
+
+func (s *PaymentStore) Balances() ([]ledger.Balance, error) {
+	var lines []ledger.JournalLine
+	for _, stored := range s.all() {
+		stored.Mu.Lock()
+		for _, e := range stored.Journal {
+			lines = append(lines, e.Lines...)
+		}
+		stored.Mu.Unlock()
+	}
+	return ledger.Sum(lines), nil
+}
+
+func (s *PaymentStore) StaleCheckouts(createdBefore, now time.Time, limit int) ([]Payment, error) {
+	stale := []Payment{}
+	for _, stored := range s.all() {
+		if len(stale) == limit {
+			break
+		}
+		stored.Mu.Lock()
+		p := stored.Payment
+		if (p.State == Initiated || p.State == Pending || p.State == Abandoned) &&
+			p.CreatedAt.Before(createdBefore) &&
+			(p.NextVerifyAt == nil || !p.NextVerifyAt.After(now)) {
+			stale = append(stale, *p.clone())
+		}
+		stored.Mu.Unlock()
+	}
+	return stale, nil
+}
+
+func (s *PaymentStore) ScheduleVerification(paymentID string, attempts int, next time.Time) error {
+	stored, err := s.stored(paymentID)
+	if err != nil {
+		return err
+	}
+	stored.Mu.Lock()
+	defer stored.Mu.Unlock()
+	stored.Payment.VerifyAttempts = attempts
+	stored.Payment.NextVerifyAt = &next
+	return nil
+}
+
+func (s *PaymentStore) ExpiredAuthorizations(now time.Time, limit int) ([]Payment, error) {
+	expired := []Payment{}
+	for _, stored := range s.all() {
+		stored.Mu.Lock()
+		p := stored.Payment
+		if (p.State == Authorized || p.State == PartiallyCaptured) &&
+			p.AuthorizedUntil != nil && p.AuthorizedUntil.Before(now) {
+			expired = append(expired, *p.clone())
+		}
+		stored.Mu.Unlock()
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].AuthorizedUntil.Before(*expired[j].AuthorizedUntil)
+	})
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+	return expired, nil
+}
+
+// clone copies a payment and its operations, so callers of the in-memory
+// store never share them with it
+func (p *Payment) clone() *Payment {
+	c := *p
+	c.Operations = append([]PaymentOperation{}, p.Operations...)
+	return &c
+}
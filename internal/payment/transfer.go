@@ -0,0 +1,55 @@
+package payment
+
+import (
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+type TransferStatus string
+
+const (
+	TransferSucceeded TransferStatus = "succeeded"
+	TransferFailed    TransferStatus = "failed"
+)
+
+// Transfer is a payout to the merchant's bank account. Payouts are started
+// from the provider's dashboard; only their outcome is reported to us.
+type Transfer struct {
+	ID                uint           `json:"id" gorm:"primaryKey"`
+	Provider          string         `json:"provider" gorm:"not null;uniqueIndex:idx_transfers_provider_ref"`
+	Reference         string         `json:"reference" gorm:"not null;uniqueIndex:idx_transfers_provider_ref"`
+	ProviderReference string         `json:"provider_reference"` // e.g. Paystack's transfer code
+	Status            TransferStatus `json:"status" gorm:"not null;index"`
+	Reason            string         `json:"reason,omitempty"` // why it failed
+	Amount            Money          `json:"amount" gorm:"embedded"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TransferStore keeps the outcome of payouts. PaymentStoreDB is one; the
+// in-memory store keeps none.
+type TransferStore interface {
+	RecordTransfer(t Transfer) (*Transfer, error)
+}
+
+var _ TransferStore = (*PaymentStoreDB)(nil)
+
+// RecordTransfer stores the outcome of a transfer. A transfer reported again
+// takes the latest outcome, e.g. a failed payout retried from the dashboard.
+func (s *PaymentStoreDB) RecordTransfer(t Transfer) (*Transfer, error) {
+	err := s.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "provider"}, {Name: "reference"}},
+		DoUpdates: clause.AssignmentColumns([]string{"provider_reference", "status", "reason", "amount", "currency", "updated_at"}),
+	}).Create(&t).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var stored Transfer
+	if err := s.DB.First(&stored, "provider = ? AND reference = ?", t.Provider, t.Reference).Error; err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
@@ -0,0 +1,37 @@
+package payment_test
+
+import (
+	"testing"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+)
+
+func TestRecordTransfer(t *testing.T) {
+	store := openPostgres(t).(*payment.PaymentStoreDB)
+	reference := "trf-" + runID
+
+	failed, err := store.RecordTransfer(payment.Transfer{
+		Provider:  "paystack",
+		Reference: reference,
+		Status:    payment.TransferFailed,
+		Reason:    "Account resolution failed",
+		Amount:    ngn(50000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// retried from the dashboard, reported again under the same reference
+	succeeded, err := store.RecordTransfer(payment.Transfer{
+		Provider:  "paystack",
+		Reference: reference,
+		Status:    payment.TransferSucceeded,
+		Amount:    ngn(50000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if succeeded.ID != failed.ID || succeeded.Status != payment.TransferSucceeded || succeeded.Reason != "" {
+		t.Fatalf("unexpected transfer %+v after %+v", succeeded, failed)
+	}
+}
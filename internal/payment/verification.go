@@ -0,0 +1,129 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ApplyVerification asks the bank how the checkout of a payment went and
+// applies the matching operation. A checkout that is still going on is only
+// marked pending, so it can be verified again later instead of being ended;
+// a charge whose amount or currency differs from the payment goes to review.
+// opPrefix tells the callers apart in the operation IDs ("verify", "webhook"...).
+func (s *PaymentStoreDB) ApplyVerification(
+	ctx context.Context,
+	bank Bank,
+	paymentID string,
+	opPrefix string,
+	params OperationParams,
+) (*Payment, VerifyResponse, error) {
+	return applyVerification(ctx, s, bank, paymentID, opPrefix, params)
+}
+
+// applyVerification is ApplyVerification for any store
+func applyVerification(
+	ctx context.Context,
+	s Store,
+	bank Bank,
+	paymentID string,
+	opPrefix string,
+	params OperationParams,
+) (*Payment, VerifyResponse, error) {
+	stored, err := s.Get(paymentID)
+	if err != nil {
+		return nil, VerifyResponse{}, notFound(err)
+	}
+
+	verifyResp, err := bank.Verify(ctx, paymentID)
+	if err != nil {
+		return nil, VerifyResponse{}, err
+	}
+
+	// a successful charge for another amount or currency is never captured
+	operation := OperationForVerification(verifyResp.Status)
+	params.AuthorizedUntil = verifyResp.AuthorizedUntil
+	mismatch := (operation == OPCapture || operation == OPAuthorize) && verifyResp.Amount != stored.Amount
+	if mismatch {
+		operation = OPFlagForReview
+		params.Reason = fmt.Sprintf("bank charged %s, payment is for %s", verifyResp.Amount, stored.Amount)
+	}
+
+	// verifying again to the same outcome changes nothing, e.g. the poller
+	// finding an abandoned checkout still abandoned, or the webhook of a
+	// charge the callback already captured
+	if reached(stored.State, operation) {
+		return stored, verifyResp, nil
+	}
+
+	// one operation ID per outcome and round: a pending checkout can still
+	// succeed later, and pending -> abandoned -> pending -> abandoned is four
+	// operations, not two replayed ones
+	opID := fmt.Sprintf("%s-%s-%d-%s", opPrefix, paymentID, stored.applied(), operation)
+
+	p, err := s.Apply(ctx, bank, paymentID, opID, operation, params)
+	if errors.Is(err, ErrInvalidTranstion) {
+		// another verification of the same checkout may have got there first
+		if current, getErr := s.Get(paymentID); getErr == nil && reached(current.State, operation) {
+			return current, verifyResp, nil
+		}
+	}
+	if err != nil {
+		return nil, verifyResp, err
+	}
+
+	if mismatch && stored.State != NeedsReview {
+		RaiseAlert(Alert{
+			PaymentID: paymentID,
+			Kind:      "amount_mismatch",
+			Message:   params.Reason,
+		})
+	}
+	return p, verifyResp, nil
+}
+
+// charged are the states of a payment whose checkout went through
+var charged = []State{PartiallyCaptured, Captured, RefundPending, PartiallyRefunded, Refunded, Disputed, ChargedBack}
+
+// reachedStates are the states in which a payment already is where a verified
+// outcome leads, or past it. The callback, the webhook and the poller all
+// verify the same checkout, in any order; the later ones change nothing.
+var reachedStates = map[Operation][]State{
+	OPMarkPending:   append([]State{Pending, Failed, NeedsReview, Expired, Authorized, Voided}, charged...),
+	OPAbandon:       append([]State{Abandoned, Failed, NeedsReview, Expired, Authorized, Voided}, charged...),
+	OPFail:          {Failed, Expired},
+	OPFlagForReview: append([]State{NeedsReview, Failed}, charged...),
+	OPAuthorize:     append([]State{Authorized, Voided, NeedsReview}, charged...),
+	OPCapture:       append([]State{NeedsReview}, charged...),
+}
+
+// reached tells whether a payment is already where a verified outcome leads,
+// or past it. A payment in review is left to the operations team.
+func reached(state State, operation Operation) bool {
+	for _, s := range reachedStates[operation] {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// applied counts the operations that went through on a payment so far
+func (p *Payment) applied() int {
+	n := 0
+	for _, op := range p.Operations {
+		if op.Result == "success" {
+			n++
+		}
+	}
+	return n
+}
+
+// NeedingReview lists the payments parked in needs_review, oldest first
+func (s *PaymentStoreDB) NeedingReview() ([]Payment, error) {
+	var payments []Payment
+	if err := s.DB.Where("state = ?", NeedsReview).Order("created_at").Find(&payments).Error; err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
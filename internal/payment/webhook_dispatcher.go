@@ -0,0 +1,301 @@
+package payment
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/env"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// headers of every delivery
+	WebhookSignatureHeader = "X-Webhook-Signature" // t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookEventHeader     = "X-Webhook-Event"
+
+	// a dispatcher holding a delivery for longer than this is assumed dead
+	deliveryLockTimeout = 5 * time.Minute
+
+	// how much of a response body is kept in the delivery log
+	maxLoggedResponse = 1024
+)
+
+// SignWebhook signs a delivery body for the given time. Receivers recompute it
+// with their endpoint secret and compare, and reject old timestamps.
+func SignWebhook(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks a signature header made by SignWebhook that
+// is at most tolerance old
+func VerifyWebhookSignature(secret, header string, body []byte, tolerance time.Duration) bool {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			t = v
+		case "v1":
+			v1 = v
+		}
+	}
+	unix, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return false
+	}
+	signedAt := time.Unix(unix, 0)
+	if age := time.Since(signedAt); age > tolerance || age < -tolerance {
+		return false
+	}
+	expected := SignWebhook(secret, signedAt, body)
+	return hmac.Equal([]byte("t="+t+",v1="+v1), []byte(expected))
+}
+
+// WebhookDispatcherConfig tunes the delivery of merchant webhooks
+type WebhookDispatcherConfig struct {
+	Interval     time.Duration // how often the dispatcher looks for due deliveries
+	BatchSize    int           // deliveries sent per round
+	Timeout      time.Duration // for one attempt
+	MaxAttempts  int           // a delivery failing this often is given up
+	BackoffBase  time.Duration // first retry delay, doubled on every attempt
+	BackoffMax   time.Duration // retry delays never grow beyond this
+	DisableAfter int           // failed attempts in a row, across deliveries, that disable an endpoint
+}
+
+// WebhookDispatcherConfigFromEnv reads MERCHANT_WEBHOOK_INTERVAL, MERCHANT_WEBHOOK_BATCH_SIZE,
+// MERCHANT_WEBHOOK_TIMEOUT, MERCHANT_WEBHOOK_MAX_ATTEMPTS, MERCHANT_WEBHOOK_BACKOFF_BASE,
+// MERCHANT_WEBHOOK_BACKOFF_MAX and MERCHANT_WEBHOOK_DISABLE_AFTER
+func WebhookDispatcherConfigFromEnv() WebhookDispatcherConfig {
+	return WebhookDispatcherConfig{
+		Interval:     env.Interval("MERCHANT_WEBHOOK_INTERVAL", 10*time.Second),
+		BatchSize:    env.Int("MERCHANT_WEBHOOK_BATCH_SIZE", 20),
+		Timeout:      env.Duration("MERCHANT_WEBHOOK_TIMEOUT", 10*time.Second),
+		MaxAttempts:  env.Int("MERCHANT_WEBHOOK_MAX_ATTEMPTS", 12),
+		BackoffBase:  env.Duration("MERCHANT_WEBHOOK_BACKOFF_BASE", 30*time.Second),
+		BackoffMax:   env.Duration("MERCHANT_WEBHOOK_BACKOFF_MAX", 6*time.Hour),
+		DisableAfter: env.Int("MERCHANT_WEBHOOK_DISABLE_AFTER", 50),
+	}
+}
+
+// WebhookDispatcher sends the deliveries queued by Apply to the merchants'
+// endpoints, retries failures with exponential backoff and disables
+// endpoints that keep failing.
+type WebhookDispatcher struct {
+	db     *gorm.DB
+	client *http.Client
+	config WebhookDispatcherConfig
+}
+
+func NewWebhookDispatcher(db *gorm.DB, config WebhookDispatcherConfig) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:     db,
+		client: &http.Client{Timeout: config.Timeout},
+		config: config,
+	}
+}
+
+// Run delivers until ctx is cancelled
+func (w *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.DeliverOnce(ctx); err != nil {
+			fmt.Printf("merchant webhooks: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DeliverOnce sends one batch of due deliveries and returns how many it picked
+func (w *WebhookDispatcher) DeliverOnce(ctx context.Context) (int, error) {
+	deliveries, err := w.claim()
+	if err != nil {
+		return 0, err
+	}
+
+	for n := range deliveries {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		d := &deliveries[n]
+
+		var endpoint WebhookEndpoint
+		if err := w.db.First(&endpoint, "id = ?", d.EndpointID).Error; err != nil {
+			fmt.Printf("merchant webhooks: endpoint of delivery %d: %v\n", d.ID, err)
+			continue
+		}
+		if !endpoint.Enabled {
+			// disabled since the batch was claimed: wait until it is enabled again
+			w.db.Model(&WebhookDelivery{}).Where("id = ?", d.ID).Update("locked_at", nil)
+			continue
+		}
+		attempt := w.send(ctx, &endpoint, d)
+		if err := w.record(&endpoint, d, attempt); err != nil {
+			fmt.Printf("merchant webhooks: save delivery %d: %v\n", d.ID, err)
+		}
+	}
+	return len(deliveries), nil
+}
+
+// claim locks a batch of due deliveries to enabled endpoints. Rows locked by
+// another dispatcher are skipped; deliveries left by a dead one are taken over.
+func (w *WebhookDispatcher) claim() ([]WebhookDelivery, error) {
+	now := time.Now()
+
+	var deliveries []WebhookDelivery
+	err := w.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("status = ?", DeliveryPending).
+			Where("next_attempt_at IS NULL OR next_attempt_at <= ?", now).
+			Where("locked_at IS NULL OR locked_at < ?", now.Add(-deliveryLockTimeout)).
+			Where("endpoint_id IN (?)", tx.Model(&WebhookEndpoint{}).Select("id").Where("enabled = ?", true)).
+			Order("id").
+			Limit(w.config.BatchSize).
+			Find(&deliveries).Error
+		if err != nil || len(deliveries) == 0 {
+			return err
+		}
+
+		ids := make([]uint, len(deliveries))
+		for n := range deliveries {
+			ids[n] = deliveries[n].ID
+		}
+		return tx.Model(&WebhookDelivery{}).Where("id IN ?", ids).Update("locked_at", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// send makes one signed attempt of a delivery; any 2xx answer is a success
+func (w *WebhookDispatcher) send(ctx context.Context, endpoint *WebhookEndpoint, d *WebhookDelivery) WebhookDeliveryAttempt {
+	var attempt WebhookDeliveryAttempt
+	body := []byte(d.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-payment-webhooks/1.0")
+	req.Header.Set(WebhookIDHeader, d.EventID)
+	req.Header.Set(WebhookEventHeader, d.EventType)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(endpoint.Secret, time.Now(), body))
+
+	started := time.Now()
+	resp, err := w.client.Do(req)
+	attempt.DurationMs = time.Since(started).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	logged, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedResponse))
+	attempt.StatusCode = resp.StatusCode
+	attempt.Response = string(logged)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("endpoint answered %d", resp.StatusCode)
+	}
+	return attempt
+}
+
+// record logs an attempt and moves the delivery and its endpoint on
+func (w *WebhookDispatcher) record(endpoint *WebhookEndpoint, d *WebhookDelivery, attempt WebhookDeliveryAttempt) error {
+	now := time.Now()
+	attempts := d.Attempts + 1
+	updates := map[string]interface{}{
+		"attempts":         attempts,
+		"locked_at":        nil,
+		"last_status_code": attempt.StatusCode,
+		"last_error":       attempt.Error,
+	}
+
+	disabled := false
+	err := w.db.Transaction(func(tx *gorm.DB) error {
+		attempt.DeliveryID = d.ID
+		if err := tx.Create(&attempt).Error; err != nil {
+			return err
+		}
+
+		if attempt.Error == "" {
+			updates["status"] = DeliveryDelivered
+			updates["delivered_at"] = now
+			if err := tx.Model(&WebhookDelivery{}).Where("id = ?", d.ID).Updates(updates).Error; err != nil {
+				return err
+			}
+			return tx.Model(&WebhookEndpoint{}).Where("id = ?", endpoint.ID).Update("consecutive_failures", 0).Error
+		}
+
+		if attempts >= w.config.MaxAttempts {
+			updates["status"] = DeliveryDead
+		} else {
+			updates["next_attempt_at"] = now.Add(w.backoff(attempts))
+		}
+		if err := tx.Model(&WebhookDelivery{}).Where("id = ?", d.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		// an endpoint that keeps failing is switched off until the merchant fixes it
+		if err := tx.Model(&WebhookEndpoint{}).Where("id = ?", endpoint.ID).
+			Update("consecutive_failures", gorm.Expr("consecutive_failures + 1")).Error; err != nil {
+			return err
+		}
+		if err := tx.First(endpoint, "id = ?", endpoint.ID).Error; err != nil {
+			return err
+		}
+		if w.config.DisableAfter <= 0 || endpoint.ConsecutiveFailures < w.config.DisableAfter || !endpoint.Enabled {
+			return nil
+		}
+		disabled = true
+		return tx.Model(&WebhookEndpoint{}).Where("id = ?", endpoint.ID).
+			Updates(map[string]interface{}{"enabled": false, "disabled_at": now}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	if disabled {
+		RaiseAlert(Alert{
+			PaymentID: d.PaymentID,
+			Kind:      "webhook_endpoint_disabled",
+			Message:   fmt.Sprintf("webhook endpoint %d (%s) disabled after %d failed deliveries in a row: %s", endpoint.ID, endpoint.URL, w.config.DisableAfter, attempt.Error),
+		})
+	}
+	return nil
+}
+
+// backoff doubles the delay on every attempt, up to BackoffMax
+func (w *WebhookDispatcher) backoff(attempts int) time.Duration {
+	delay := w.config.BackoffBase
+	for i := 1; i < attempts && delay < w.config.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > w.config.BackoffMax {
+		delay = w.config.BackoffMax
+	}
+	return delay
+}
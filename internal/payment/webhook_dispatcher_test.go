@@ -0,0 +1,125 @@
+package payment
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookDeliveryIsSigned(t *testing.T) {
+	const secret = "whsec_test"
+	payload := `{"id":"evt_p1_op1","type":"payment.captured"}`
+
+	var got struct {
+		body      string
+		signature string
+		id        string
+		event     string
+	}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got.body = string(body)
+		got.signature = r.Header.Get(WebhookSignatureHeader)
+		got.id = r.Header.Get(WebhookIDHeader)
+		got.event = r.Header.Get(WebhookEventHeader)
+		w.Write([]byte("ok"))
+	}))
+	defer receiver.Close()
+
+	w := NewWebhookDispatcher(nil, WebhookDispatcherConfig{Timeout: time.Second})
+	attempt := w.send(context.Background(),
+		&WebhookEndpoint{URL: receiver.URL, Secret: secret},
+		&WebhookDelivery{EventID: "evt_p1_op1", EventType: "payment.captured", Payload: payload},
+	)
+
+	if attempt.Error != "" || attempt.StatusCode != 200 || attempt.Response != "ok" {
+		t.Fatalf("attempt = %+v, want a 200 with body ok", attempt)
+	}
+	if got.body != payload || got.id != "evt_p1_op1" || got.event != "payment.captured" {
+		t.Fatalf("receiver got %+v", got)
+	}
+	if !VerifyWebhookSignature(secret, got.signature, []byte(got.body), time.Minute) {
+		t.Fatalf("signature %q does not verify", got.signature)
+	}
+	if VerifyWebhookSignature("whsec_other", got.signature, []byte(got.body), time.Minute) {
+		t.Fatal("signature verifies with another secret")
+	}
+	if VerifyWebhookSignature(secret, got.signature, []byte(got.body+" "), time.Minute) {
+		t.Fatal("signature verifies for another body")
+	}
+}
+
+func TestWebhookDeliveryFailures(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("try later"))
+	}))
+	defer receiver.Close()
+
+	w := NewWebhookDispatcher(nil, WebhookDispatcherConfig{Timeout: 50 * time.Millisecond})
+	delivery := &WebhookDelivery{Payload: "{}"}
+
+	tests := []struct {
+		name       string
+		url        string
+		wantStatus int
+	}{
+		{name: "server error", url: receiver.URL, wantStatus: 503},
+		{name: "timeout", url: receiver.URL + "/slow", wantStatus: 0},
+		{name: "unreachable", url: "http://127.0.0.1:1", wantStatus: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempt := w.send(context.Background(), &WebhookEndpoint{URL: tt.url, Secret: "s"}, delivery)
+			if attempt.Error == "" {
+				t.Fatalf("attempt = %+v, want an error", attempt)
+			}
+			if attempt.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", attempt.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	w := NewWebhookDispatcher(nil, WebhookDispatcherConfig{BackoffBase: 30 * time.Second, BackoffMax: 5 * time.Minute})
+
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, d := range want {
+		if got := w.backoff(i + 1); got != d {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, d)
+		}
+	}
+}
+
+func TestWebhookSignatureTooOld(t *testing.T) {
+	body := []byte("{}")
+	header := SignWebhook("s", time.Now().Add(-10*time.Minute), body)
+	if VerifyWebhookSignature("s", header, body, 5*time.Minute) {
+		t.Fatal("a 10 minute old signature verifies with a 5 minute tolerance")
+	}
+}
+
+func TestWebhookEndpointSubscriptions(t *testing.T) {
+	tests := []struct {
+		types string
+		event string
+		want  bool
+	}{
+		{"*", "payment.captured", true},
+		{"payment.captured, payment.refunded", "payment.refunded", true},
+		{"payment.captured", "payment.failed", false},
+	}
+	for _, tt := range tests {
+		e := &WebhookEndpoint{EventTypes: tt.types}
+		if got := e.subscribed(tt.event); got != tt.want {
+			t.Errorf("%q subscribed to %s = %v, want %v", tt.types, tt.event, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package payment
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DeliveryPending   = "pending" // waiting for its first or next attempt
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead" // out of retries, only a redelivery sends it again
+)
+
+// WebhookEndpoint is a merchant URL that is told about payment state changes
+type WebhookEndpoint struct {
+	ID          uint   `json:"id" gorm:"primaryKey"`
+	URL         string `json:"url" gorm:"not null"`
+	Description string `json:"description"`
+	Secret      string `json:"-" gorm:"not null"` // signs every delivery, shown once when the endpoint is created
+
+	// event types such as payment.captured, or * for all of them
+	EventTypes string `json:"event_types" gorm:"not null;default:'*'"`
+
+	Enabled             bool       `json:"enabled" gorm:"not null;default:true"`
+	ConsecutiveFailures int        `json:"consecutive_failures" gorm:"not null;default:0"`
+	DisabledAt          *time.Time `json:"disabled_at"`
+	CreatedBy           string     `json:"created_by"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (e *WebhookEndpoint) subscribed(eventType string) bool {
+	for _, t := range strings.Split(e.EventTypes, ",") {
+		if t = strings.TrimSpace(t); t == "*" || t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one event to send to one endpoint
+type WebhookDelivery struct {
+	ID         uint   `json:"id" gorm:"primaryKey"`
+	EndpointID uint   `json:"endpoint_id" gorm:"not null;index"`
+	EventID    string `json:"event_id" gorm:"not null;index"` // the same for every endpoint, lets receivers dedupe
+	EventType  string `json:"event_type" gorm:"not null"`
+	PaymentID  string `json:"payment_id" gorm:"not null;index"`
+	Payload    string `json:"payload" gorm:"type:text;not null"`
+
+	Status         string     `json:"status" gorm:"not null;index"` // pending, delivered, dead
+	Attempts       int        `json:"attempts" gorm:"not null;default:0"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at"`
+	LockedAt       *time.Time `json:"-"`
+	LastStatusCode int        `json:"last_status_code"`
+	LastError      string     `json:"last_error"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+
+	Log []WebhookDeliveryAttempt `json:"log,omitempty" gorm:"foreignKey:DeliveryID"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookDeliveryAttempt logs one try of a delivery
+type WebhookDeliveryAttempt struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	DeliveryID uint      `json:"-" gorm:"not null;index"`
+	StatusCode int       `json:"status_code"` // zero when the endpoint never answered
+	Error      string    `json:"error,omitempty"`
+	Response   string    `json:"response,omitempty" gorm:"type:text"` // start of the response body
+	DurationMs int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// enqueueWebhooks queues a delivery of a state change to every enabled
+// endpoint subscribed to it. It runs in the transaction of the change, so a
+// rolled back operation is never announced.
+func enqueueWebhooks(tx *gorm.DB, event PaymentEvent) error {
+	var endpoints []WebhookEndpoint
+	if err := tx.Where("enabled = ?", true).Find(&endpoints).Error; err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range endpoints {
+		if !e.subscribed(event.Type) {
+			continue
+		}
+		delivery := WebhookDelivery{
+			EndpointID: e.ID,
+			EventID:    event.ID,
+			EventType:  event.Type,
+			PaymentID:  event.Data.PaymentID,
+			Payload:    string(body),
+			Status:     DeliveryPending,
+		}
+		if err := tx.Create(&delivery).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookEndpointStore keeps the merchant endpoints and what was delivered to
+// them. PaymentStoreDB is one; the in-memory store keeps none.
+type WebhookEndpointStore interface {
+	CreateWebhookEndpoint(rawURL, description string, eventTypes []string, createdBy string) (*WebhookEndpoint, string, error)
+	WebhookEndpoints() ([]WebhookEndpoint, error)
+	SetWebhookEndpointEnabled(id uint, enabled bool) (*WebhookEndpoint, error)
+	DeleteWebhookEndpoint(id uint) error
+	WebhookDeliveries(endpointID uint, status string, limit int) ([]WebhookDelivery, error)
+	WebhookDelivery(id uint) (*WebhookDelivery, error)
+	Redeliver(id uint) (*WebhookDelivery, error)
+}
+
+var _ WebhookEndpointStore = (*PaymentStoreDB)(nil)
+
+// CreateWebhookEndpoint registers an endpoint with a fresh signing secret.
+// The secret is returned only here.
+func (s *PaymentStoreDB) CreateWebhookEndpoint(rawURL, description string, eventTypes []string, createdBy string) (*WebhookEndpoint, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, "", fmt.Errorf("invalid webhook url: %q", rawURL)
+	}
+
+	types := "*"
+	if len(eventTypes) > 0 {
+		for _, t := range eventTypes {
+			if t != "*" && !knownEventType(t) {
+				return nil, "", fmt.Errorf("unknown event type: %s", t)
+			}
+		}
+		types = strings.Join(eventTypes, ",")
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, "", err
+	}
+	secret := "whsec_" + hex.EncodeToString(raw)
+
+	e := WebhookEndpoint{
+		URL:         u.String(),
+		Description: description,
+		Secret:      secret,
+		EventTypes:  types,
+		Enabled:     true,
+		CreatedBy:   createdBy,
+	}
+	if err := s.DB.Create(&e).Error; err != nil {
+		return nil, "", err
+	}
+	return &e, secret, nil
+}
+
+func knownEventType(t string) bool {
+	if t == EventPaymentCreated {
+		return true
+	}
+	for _, state := range AllStates {
+		if EventType(state) == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *PaymentStoreDB) WebhookEndpoints() ([]WebhookEndpoint, error) {
+	endpoints := []WebhookEndpoint{}
+	if err := s.DB.Order("id").Find(&endpoints).Error; err != nil {
+		return nil, err
+	}
+	return endpoints, nil
+}
+
+// SetWebhookEndpointEnabled turns an endpoint off or back on. Turning it on
+// forgets earlier failures, and its pending deliveries go out again.
+func (s *PaymentStoreDB) SetWebhookEndpointEnabled(id uint, enabled bool) (*WebhookEndpoint, error) {
+	updates := map[string]interface{}{"enabled": enabled}
+	if enabled {
+		updates["consecutive_failures"] = 0
+		updates["disabled_at"] = nil
+	} else {
+		updates["disabled_at"] = time.Now()
+	}
+
+	res := s.DB.Model(&WebhookEndpoint{}).Where("id = ?", id).Updates(updates)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var e WebhookEndpoint
+	if err := s.DB.First(&e, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// DeleteWebhookEndpoint removes an endpoint and the deliveries still waiting for it
+func (s *PaymentStoreDB) DeleteWebhookEndpoint(id uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		res := tx.Delete(&WebhookEndpoint{}, "id = ?", id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Where("endpoint_id = ? AND status = ?", id, DeliveryPending).Delete(&WebhookDelivery{}).Error
+	})
+}
+
+// WebhookDeliveries lists the deliveries of an endpoint, newest first
+func (s *PaymentStoreDB) WebhookDeliveries(endpointID uint, status string, limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	q := s.DB.Where("endpoint_id = ?", endpointID).Order("id DESC").Limit(limit)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if err := q.Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// WebhookDelivery returns a delivery with the log of its attempts
+func (s *PaymentStoreDB) WebhookDelivery(id uint) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	if err := s.DB.Preload("Log", func(tx *gorm.DB) *gorm.DB { return tx.Order("id") }).
+		First(&d, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// Redeliver sends a delivery again, whatever its status, with a full set of retries
+func (s *PaymentStoreDB) Redeliver(id uint) (*WebhookDelivery, error) {
+	res := s.DB.Model(&WebhookDelivery{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":          DeliveryPending,
+		"attempts":        0,
+		"next_attempt_at": nil,
+		"locked_at":       nil,
+	})
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return s.WebhookDelivery(id)
+}
@@ -0,0 +1,278 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/env"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	WebhookReceived   = "received"   // stored, waiting to be processed
+	WebhookProcessing = "processing" // claimed by a worker
+	WebhookProcessed  = "processed"
+	WebhookFailed     = "failed" // will be retried
+	WebhookDead       = "dead"   // out of retries, only a replay picks it up again
+
+	// a worker holding an event for longer than this is assumed dead
+	webhookLockTimeout = 5 * time.Minute
+)
+
+// WebhookEvent is a verified provider webhook, stored raw before it is processed
+type WebhookEvent struct {
+	ID uint `gorm:"primaryKey"`
+
+	// a provider sends the same event more than once; the first copy wins
+	Provider  string `gorm:"not null;uniqueIndex:idx_webhook_events_dedup"`
+	Event     string `gorm:"not null;uniqueIndex:idx_webhook_events_dedup"` // e.g. charge.success
+	EventID   string `gorm:"not null;uniqueIndex:idx_webhook_events_dedup"` // the provider's id of the object
+	Reference string `gorm:"not null;uniqueIndex:idx_webhook_events_dedup"`
+	Payload   string `gorm:"type:text;not null"`
+
+	Status        string `gorm:"not null;index"` // received, processing, processed, failed, dead
+	Attempts      int    `gorm:"not null;default:0"`
+	LastError     string
+	NextAttemptAt *time.Time
+	LockedAt      *time.Time
+	ProcessedAt   *time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (WebhookEvent) TableName() string {
+	return "webhook_events"
+}
+
+// WebhookHandler processes one stored event. It must be safe to run more than
+// once for the same event: retries and replays run it again.
+type WebhookHandler func(ctx context.Context, e *WebhookEvent) error
+
+// WebhookInboxConfig tunes the processing of stored webhooks
+type WebhookInboxConfig struct {
+	Interval    time.Duration   // how often the inbox looks for due events
+	BatchSize   int             // events processed per round
+	MaxAttempts int             // an event failing this often is dead-lettered
+	Backoff     []time.Duration // wait before retrying a failed event; the last step repeats
+}
+
+// WebhookInboxConfigFromEnv reads WEBHOOK_INTERVAL, WEBHOOK_BATCH_SIZE,
+// WEBHOOK_MAX_ATTEMPTS and WEBHOOK_BACKOFF (e.g. "30s,1m,5m,15m,1h")
+func WebhookInboxConfigFromEnv() WebhookInboxConfig {
+	return WebhookInboxConfig{
+		Interval:    env.Interval("WEBHOOK_INTERVAL", 30*time.Second),
+		BatchSize:   env.Int("WEBHOOK_BATCH_SIZE", 20),
+		MaxAttempts: env.Int("WEBHOOK_MAX_ATTEMPTS", 8),
+		Backoff: env.Durations("WEBHOOK_BACKOFF", []time.Duration{
+			30 * time.Second, time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour,
+		}),
+	}
+}
+
+// WebhookInbox stores webhooks as they arrive and processes them in the
+// background, so an event is never lost to a bug or a database hiccup:
+// failures are retried with backoff and dead-lettered after MaxAttempts.
+type WebhookInbox struct {
+	db       *gorm.DB
+	config   WebhookInboxConfig
+	handlers map[string]WebhookHandler
+	wake     chan struct{}
+}
+
+func NewWebhookInbox(db *gorm.DB, config WebhookInboxConfig) *WebhookInbox {
+	return &WebhookInbox{
+		db:       db,
+		config:   config,
+		handlers: map[string]WebhookHandler{},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Handle sets the handler for a provider's events. Call it before Run.
+func (i *WebhookInbox) Handle(provider string, h WebhookHandler) {
+	i.handlers[provider] = h
+}
+
+// Receive stores an event and reports whether it is new; a duplicate of an
+// event already stored is dropped
+func (i *WebhookInbox) Receive(e *WebhookEvent) (bool, error) {
+	e.Status = WebhookReceived
+	res := i.db.Clauses(clause.OnConflict{DoNothing: true}).Create(e)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	i.notify()
+	return true, nil
+}
+
+// notify wakes the worker without waiting for the next tick
+func (i *WebhookInbox) notify() {
+	select {
+	case i.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run processes events until ctx is cancelled
+func (i *WebhookInbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(i.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := i.ProcessOnce(ctx); err != nil {
+			fmt.Printf("webhooks: %v\n", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-i.wake:
+		}
+	}
+}
+
+// ProcessOnce processes one batch of due events and returns how many it picked
+func (i *WebhookInbox) ProcessOnce(ctx context.Context) (int, error) {
+	events, err := i.claim()
+	if err != nil {
+		return 0, err
+	}
+
+	for n := range events {
+		if ctx.Err() != nil {
+			return n, ctx.Err()
+		}
+		i.process(ctx, &events[n])
+	}
+	return len(events), nil
+}
+
+// claim marks a batch of due events as processing. Rows locked by another
+// worker are skipped; events left processing by a dead worker are taken over.
+func (i *WebhookInbox) claim() ([]WebhookEvent, error) {
+	now := time.Now()
+
+	var events []WebhookEvent
+	err := i.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("(status IN ? AND (next_attempt_at IS NULL OR next_attempt_at <= ?)) OR (status = ? AND locked_at < ?)",
+				[]string{WebhookReceived, WebhookFailed}, now, WebhookProcessing, now.Add(-webhookLockTimeout)).
+			Order("id").
+			Limit(i.config.BatchSize).
+			Find(&events).Error
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		ids := make([]uint, len(events))
+		for n := range events {
+			ids[n] = events[n].ID
+			events[n].Status = WebhookProcessing
+			events[n].LockedAt = &now
+		}
+		return tx.Model(&WebhookEvent{}).Where("id IN ?", ids).
+			Updates(map[string]interface{}{"status": WebhookProcessing, "locked_at": now}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (i *WebhookInbox) process(ctx context.Context, e *WebhookEvent) {
+	attempts := e.Attempts + 1
+	updates := map[string]interface{}{"attempts": attempts, "locked_at": nil}
+
+	err := fmt.Errorf("no handler for %s webhooks", e.Provider)
+	if h, ok := i.handlers[e.Provider]; ok {
+		err = h(ctx, e)
+	}
+
+	now := time.Now()
+	switch {
+	case err == nil:
+		updates["status"] = WebhookProcessed
+		updates["processed_at"] = now
+		updates["last_error"] = ""
+	case !classifyFailure(err, 0).Retryable || attempts >= i.config.MaxAttempts:
+		// the same event would fail again: park it until someone replays it
+		fmt.Printf("webhooks: %s %s dead after %d attempts: %v\n", e.Provider, e.Event, attempts, err)
+		updates["status"] = WebhookDead
+		updates["last_error"] = err.Error()
+	default:
+		updates["status"] = WebhookFailed
+		updates["last_error"] = err.Error()
+		updates["next_attempt_at"] = now.Add(i.backoff(attempts))
+	}
+
+	if err := i.db.Model(&WebhookEvent{}).Where("id = ?", e.ID).Updates(updates).Error; err != nil {
+		fmt.Printf("webhooks: save event %d: %v\n", e.ID, err)
+	}
+}
+
+func (i *WebhookInbox) backoff(attempts int) time.Duration {
+	if len(i.config.Backoff) == 0 {
+		return i.config.Interval
+	}
+	if attempts > len(i.config.Backoff) {
+		attempts = len(i.config.Backoff)
+	}
+	return i.config.Backoff[attempts-1]
+}
+
+// Events lists stored events, newest first, optionally only those in one status
+func (i *WebhookInbox) Events(status string, limit int) ([]WebhookEvent, error) {
+	events := []WebhookEvent{}
+	q := i.db.Order("id DESC").Limit(limit)
+	if status != "" {
+		q = q.Where("status = ?", status)
+	}
+	if err := q.Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Replay queues a single event to be processed again, whatever its status
+func (i *WebhookInbox) Replay(id uint) error {
+	res := i.db.Model(&WebhookEvent{}).Where("id = ?", id).Updates(replayUpdates())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	i.notify()
+	return nil
+}
+
+// ReplayFailed queues every failed and dead event again and returns how many
+func (i *WebhookInbox) ReplayFailed() (int64, error) {
+	res := i.db.Model(&WebhookEvent{}).
+		Where("status IN ?", []string{WebhookFailed, WebhookDead}).
+		Updates(replayUpdates())
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	if res.RowsAffected > 0 {
+		i.notify()
+	}
+	return res.RowsAffected, nil
+}
+
+// a replayed event starts over with a full set of retries
+func replayUpdates() map[string]interface{} {
+	return map[string]interface{}{
+		"status":          WebhookReceived,
+		"attempts":        0,
+		"next_attempt_at": nil,
+		"locked_at":       nil,
+	}
+}
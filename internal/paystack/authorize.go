@@ -6,6 +6,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/Investorharry19/go-payment/internal/payment"
 )
@@ -13,6 +15,7 @@ import (
 type initializeRequest struct {
 	Email       string `json:"email"`
 	Amount      int64  `json:"amount"`
+	Currency    string `json:"currency,omitempty"`
 	CallbackURL string `json:"callback_url"`
 	Reference   string `json:"reference"`
 }
@@ -33,7 +36,8 @@ func (p *PaystackClient) Authorize(
 
 	payload := initializeRequest{
 		Email:       req.Email,
-		Amount:      req.Amount,
+		Amount:      req.Amount.Amount,
+		Currency:    string(req.Amount.Currency),
 		CallbackURL: req.CallbackURL,
 		Reference:   req.PaymentID, // your internal payment ID
 	}
@@ -62,19 +66,12 @@ func (p *PaystackClient) Authorize(
 
 	resp, err := p.http.Do(httpReq)
 	if err != nil {
-		return payment.AuthorizeResponse{}, fmt.Errorf("paystack request failed: %w", err)
+		return payment.AuthorizeResponse{}, requestError(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		var errResp struct {
-			Status  bool   `json:"status"`
-			Message string `json:"message"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
-			return payment.AuthorizeResponse{}, fmt.Errorf("paystack returned status %d, failed to decode error: %w", resp.StatusCode, err)
-		}
-		return payment.AuthorizeResponse{}, fmt.Errorf("paystack error: %s", errResp.Message)
+		return payment.AuthorizeResponse{}, statusError(resp)
 	}
 
 	var psResp initializeResponse
@@ -83,7 +80,7 @@ func (p *PaystackClient) Authorize(
 	}
 
 	if !psResp.Status {
-		return payment.AuthorizeResponse{}, fmt.Errorf("paystack error: %s", psResp.Message)
+		return payment.AuthorizeResponse{}, providerError(psResp.Message)
 	}
 
 	return payment.AuthorizeResponse{
@@ -109,26 +106,19 @@ func (p *PaystackClient) Verify(
 
 	resp, err := p.http.Do(httpReq)
 	if err != nil {
-		return payment.VerifyResponse{}, fmt.Errorf("paystack request failed: %w", err)
+		return payment.VerifyResponse{}, requestError(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		var errResp struct {
-			Status  bool   `json:"status"`
-			Message string `json:"message"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
-			return payment.VerifyResponse{}, fmt.Errorf("paystack returned status %d, failed to decode error: %w", resp.StatusCode, err)
-		}
-		return payment.VerifyResponse{}, fmt.Errorf("paystack error: %s", errResp.Message)
+		return payment.VerifyResponse{}, statusError(resp)
 	}
 
 	var psResp struct {
 		Status  bool   `json:"status"`
 		Message string `json:"message"`
 		Data    struct {
-			Status    string `json:"status"` // "success", "failed", etc
+			Status    string `json:"status"` // see verifyStatus
 			Reference string `json:"reference"`
 			Amount    int64  `json:"amount"`
 			Currency  string `json:"currency"`
@@ -140,26 +130,48 @@ func (p *PaystackClient) Verify(
 	}
 
 	if !psResp.Status {
-		return payment.VerifyResponse{}, fmt.Errorf("paystack error: %s", psResp.Message)
+		return payment.VerifyResponse{}, providerError(psResp.Message)
 	}
 
 	// Map Paystack data to internal domain
 	return payment.VerifyResponse{
-		Reference: psResp.Data.Reference,
-		Status:    psResp.Data.Status,
-		Amount:    psResp.Data.Amount,
-		Currency:  psResp.Data.Currency,
+		Reference:      psResp.Data.Reference,
+		Status:         verifyStatus(psResp.Data.Status),
+		ProviderStatus: psResp.Data.Status,
+		Amount: payment.Money{
+			Amount:   psResp.Data.Amount,
+			Currency: payment.Currency(strings.ToUpper(psResp.Data.Currency)),
+		},
 	}, nil
 }
 
+// verifyStatus maps Paystack's transaction statuses to checkout outcomes.
+// Anything unknown is treated as still pending so it gets verified again.
+func verifyStatus(status string) payment.VerifyStatus {
+	switch status {
+	case "success":
+		return payment.VerifySuccess
+	case "abandoned":
+		return payment.VerifyAbandoned
+	case "failed", "reversed":
+		return payment.VerifyFailed
+	default: // "ongoing", "pending", "processing", "queued"
+		return payment.VerifyPending
+	}
+}
+
 func (p *PaystackClient) Refund(
 	ctx context.Context,
 	req payment.RefundRequest,
 ) (payment.RefundResponse, error) {
 
+	// Paystack identifies the refunded transaction by its reference;
+	// amount 0 (omitted) refunds whatever is left on the transaction
 	payload := map[string]interface{}{
-		"reference": req.Reference,
-		"amount":    req.Amount,
+		"transaction": req.Reference,
+	}
+	if req.Amount.Amount > 0 {
+		payload["amount"] = req.Amount.Amount
 	}
 
 	body, err := json.Marshal(payload)
@@ -179,30 +191,24 @@ func (p *PaystackClient) Refund(
 
 	httpReq.Header.Set("Authorization", "Bearer "+p.secretKey)
 	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Idempotency-Key", req.OperationID)
 
 	resp, err := p.http.Do(httpReq)
 	if err != nil {
-		return payment.RefundResponse{}, fmt.Errorf("paystack refund request failed: %w", err)
+		return payment.RefundResponse{}, requestError(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		var errResp struct {
-			Status  bool   `json:"status"`
-			Message string `json:"message"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil {
-			return payment.RefundResponse{}, fmt.Errorf("paystack returned status %d, failed to decode error: %w", resp.StatusCode, err)
-		}
-		return payment.RefundResponse{}, fmt.Errorf("paystack error: %s", errResp.Message)
+		return payment.RefundResponse{}, statusError(resp)
 	}
 
 	var psResp struct {
 		Status  bool   `json:"status"`
 		Message string `json:"message"`
 		Data    struct {
-			Reference string `json:"reference"`
-			Status    string `json:"status"`
+			ID     int64  `json:"id"`
+			Status string `json:"status"` // "pending", "processing", "processed", "failed"
 		} `json:"data"`
 	}
 
@@ -211,11 +217,22 @@ func (p *PaystackClient) Refund(
 	}
 
 	if !psResp.Status {
-		return payment.RefundResponse{}, fmt.Errorf("paystack refund error: %s", psResp.Message)
+		return payment.RefundResponse{}, providerError(psResp.Message)
 	}
 
+	// the refund id is what Paystack's refund.* webhooks point back to
 	return payment.RefundResponse{
-		Reference: psResp.Data.Reference,
+		Reference: strconv.FormatInt(psResp.Data.ID, 10),
 		Status:    psResp.Data.Status,
 	}, nil
 }
+
+// Void releases an authorization. Paystack charges the customer at checkout
+// and has no separate hold to release, so there is nothing to call: whatever
+// was not captured was never taken.
+func (p *PaystackClient) Void(
+	ctx context.Context,
+	req payment.VoidRequest,
+) (payment.VoidResponse, error) {
+	return payment.VoidResponse{Reference: req.Reference, Status: "voided"}, nil
+}
@@ -1,8 +1,13 @@
 package paystack
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
 )
 
 type PaystackClient struct {
@@ -11,12 +16,65 @@ type PaystackClient struct {
 	http      *http.Client
 }
 
-func NewPaystackClient(secretKey string) *PaystackClient {
+// DefaultBaseURL is Paystack's live API
+const DefaultBaseURL = "https://api.paystack.co"
+
+// NewPaystackClient talks to Paystack at baseURL, or at DefaultBaseURL when
+// it is empty. Point it at cmd/paystack-sim to work offline.
+func NewPaystackClient(secretKey, baseURL string) *PaystackClient {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
 	return &PaystackClient{
 		secretKey: secretKey,
-		baseURL:   "https://api.paystack.co",
+		baseURL:   strings.TrimRight(baseURL, "/"),
 		http: &http.Client{
 			Timeout: 10 * time.Second,
 		},
 	}
 }
+
+// requestError wraps a request that never got an answer from Paystack;
+// those are always worth retrying
+func requestError(err error) error {
+	return &payment.BankError{
+		Provider:  "paystack",
+		Code:      "network_error",
+		Message:   err.Error(),
+		Retryable: true,
+		Err:       err,
+	}
+}
+
+// statusError decodes the body of a non-2xx Paystack response
+func statusError(resp *http.Response) error {
+	var errResp struct {
+		Status  bool   `json:"status"`
+		Message string `json:"message"`
+		Code    string `json:"code"`
+	}
+	message := fmt.Sprintf("paystack returned status %d", resp.StatusCode)
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err == nil && errResp.Message != "" {
+		message = errResp.Message
+	}
+	code := errResp.Code
+	if code == "" {
+		code = fmt.Sprintf("http_%d", resp.StatusCode)
+	}
+
+	return &payment.BankError{
+		Provider:  "paystack",
+		Code:      code,
+		Message:   message,
+		Retryable: resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+	}
+}
+
+// providerError is a 2xx answer with "status": false
+func providerError(message string) error {
+	return &payment.BankError{
+		Provider: "paystack",
+		Code:     "provider_error",
+		Message:  message,
+	}
+}
@@ -0,0 +1,288 @@
+package paystack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+)
+
+// webhookEnvelope is what every Paystack webhook shares; Data is decoded by
+// the handler of the event
+type webhookEnvelope struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// chargeData is sent with charge.* events
+type chargeData struct {
+	ID        json.Number `json:"id"`
+	Reference string      `json:"reference"`
+	Status    string      `json:"status"`
+	Amount    int64       `json:"amount"`
+	Currency  string      `json:"currency"`
+}
+
+// refundData is sent with refund.* events
+type refundData struct {
+	ID                   json.Number `json:"id"`
+	Status               string      `json:"status"`
+	Amount               int64       `json:"amount"`
+	Currency             string      `json:"currency"`
+	TransactionReference string      `json:"transaction_reference"`
+	RefundReference      string      `json:"refund_reference"`
+}
+
+// reference is the id of the refund on Paystack's side
+func (d refundData) reference() string {
+	if d.RefundReference != "" {
+		return d.RefundReference
+	}
+	return d.ID.String()
+}
+
+// disputeData is sent with charge.dispute.* events
+type disputeData struct {
+	ID           json.Number `json:"id"`
+	Status       string      `json:"status"`     // awaiting-merchant-feedback, resolved, ...
+	Resolution   string      `json:"resolution"` // merchant-accepted, declined, ...
+	Category     string      `json:"category"`
+	RefundAmount int64       `json:"refund_amount"`
+	Currency     string      `json:"currency"`
+	DueAt        string      `json:"dueAt"`
+	Transaction  struct {
+		ID        json.Number `json:"id"`
+		Reference string      `json:"reference"`
+		Amount    int64       `json:"amount"`
+		Currency  string      `json:"currency"`
+	} `json:"transaction"`
+}
+
+// transferData is sent with transfer.* events
+type transferData struct {
+	ID           json.Number `json:"id"`
+	Reference    string      `json:"reference"`
+	TransferCode string      `json:"transfer_code"`
+	Status       string      `json:"status"`
+	Reason       string      `json:"reason"`
+	Amount       int64       `json:"amount"`
+	Currency     string      `json:"currency"`
+}
+
+func (d transferData) transfer(status payment.TransferStatus) payment.Transfer {
+	t := payment.Transfer{
+		Provider:          "paystack",
+		Reference:         d.Reference,
+		ProviderReference: d.TransferCode,
+		Status:            status,
+		Amount:            payment.Money{Amount: d.Amount, Currency: payment.Currency(strings.ToUpper(d.Currency))},
+	}
+	if status == payment.TransferFailed {
+		t.Reason = d.Reason
+	}
+	return t
+}
+
+// ParseWebhook turns a verified webhook body into an inbox event. Paystack
+// retries deliveries, so the event id and reference are what dedupes them.
+func ParseWebhook(body []byte) (*payment.WebhookEvent, error) {
+	var envelope webhookEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Event == "" {
+		return nil, fmt.Errorf("webhook without an event")
+	}
+
+	// every payload carries one of these, whatever the event
+	var ids struct {
+		ID              json.Number `json:"id"`
+		Reference       string      `json:"reference"`
+		RefundReference string      `json:"refund_reference"`
+		Transaction     struct {
+			Reference string `json:"reference"`
+		} `json:"transaction"`
+	}
+	if len(envelope.Data) > 0 {
+		if err := json.Unmarshal(envelope.Data, &ids); err != nil {
+			return nil, err
+		}
+	}
+
+	reference := ids.Reference
+	if reference == "" {
+		reference = ids.RefundReference
+	}
+	if reference == "" {
+		reference = ids.Transaction.Reference
+	}
+	return &payment.WebhookEvent{
+		Provider:  "paystack",
+		Event:     envelope.Event,
+		EventID:   ids.ID.String(),
+		Reference: reference,
+		Payload:   string(body),
+	}, nil
+}
+
+// webhookHandlers processes the stored Paystack webhooks, one handler per event
+type webhookHandlers struct {
+	store     payment.Store
+	disputes  payment.DisputeStore
+	transfers payment.TransferStore
+	bank      payment.Bank
+}
+
+// on adapts a handler of one event's data to the dispatcher
+func on[T any](h func(ctx context.Context, data T) error) func(context.Context, json.RawMessage) error {
+	return func(ctx context.Context, raw json.RawMessage) error {
+		var data T
+		if err := json.Unmarshal(raw, &data); err != nil {
+			// a payload that does not decode will not decode on a retry either
+			return fmt.Errorf("%w: %v", payment.ErrOperationFailed, err)
+		}
+		return h(ctx, data)
+	}
+}
+
+// NewWebhookHandler dispatches stored Paystack webhooks by event name.
+// Events without a handler are acknowledged and ignored, and so are disputes
+// and transfers when the store keeps none, like the in-memory one.
+func NewWebhookHandler(store payment.Store, bank payment.Bank) payment.WebhookHandler {
+	h := &webhookHandlers{store: store, bank: bank}
+	dispatch := map[string]func(context.Context, json.RawMessage) error{
+		"charge.success":   on(h.chargeSuccess),
+		"refund.pending":   on(h.refundPending),
+		"refund.processed": on(h.refundSettled("refund.processed", payment.OPRefundProcessed)),
+		"refund.failed":    on(h.refundSettled("refund.failed", payment.OPRefundFailed)),
+	}
+	if disputes, ok := store.(payment.DisputeStore); ok {
+		h.disputes = disputes
+		dispatch["charge.dispute.create"] = on(h.disputeCreated)
+		dispatch["charge.dispute.resolve"] = on(h.disputeResolved)
+	}
+	if transfers, ok := store.(payment.TransferStore); ok {
+		h.transfers = transfers
+		dispatch["transfer.success"] = on(h.transferSucceeded)
+		dispatch["transfer.failed"] = on(h.transferFailed)
+	}
+
+	return func(ctx context.Context, e *payment.WebhookEvent) error {
+		var envelope webhookEnvelope
+		if err := json.Unmarshal([]byte(e.Payload), &envelope); err != nil {
+			return fmt.Errorf("%w: %v", payment.ErrOperationFailed, err)
+		}
+
+		handle, ok := dispatch[envelope.Event]
+		if !ok {
+			fmt.Printf("paystack: ignoring %s webhook\n", envelope.Event)
+			return nil
+		}
+		return handle(ctx, envelope.Data)
+	}
+}
+
+// chargeSuccess is only a hint: the charge is verified with Paystack before
+// anything is captured, and a mismatch goes to review
+func (h *webhookHandlers) chargeSuccess(ctx context.Context, data chargeData) error {
+	_, _, err := h.store.ApplyVerification(
+		ctx,
+		h.bank,
+		data.Reference,
+		"webhook",
+		payment.OperationParams{Actor: "paystack", Source: payment.SourceWebhook},
+	)
+	return err
+}
+
+// refundPending confirms a refund we sent. One we do not know about was
+// started outside the API, e.g. from the Paystack dashboard.
+func (h *webhookHandlers) refundPending(ctx context.Context, data refundData) error {
+	p, err := h.store.Get(data.TransactionReference)
+	if err != nil {
+		return err
+	}
+	if p.State != payment.RefundPending {
+		payment.RaiseAlert(payment.Alert{
+			PaymentID: p.ID,
+			Kind:      "untracked_refund",
+			Message:   fmt.Sprintf("Paystack refund %s of %d %s started while the payment is %s", data.reference(), data.Amount, data.Currency, p.State),
+		})
+	}
+	return nil
+}
+
+// refundSettled settles the pending refund of a payment either way
+func (h *webhookHandlers) refundSettled(event string, operation payment.Operation) func(context.Context, refundData) error {
+	return func(ctx context.Context, data refundData) error {
+		refundRef := data.reference()
+		opID := fmt.Sprintf("webhook-%s-%s", event, refundRef)
+		_, err := h.store.Apply(ctx, h.bank, data.TransactionReference, opID, operation, payment.OperationParams{
+			BankReference: refundRef,
+			Actor:         "paystack",
+			Source:        payment.SourceWebhook,
+		})
+		return err
+	}
+}
+
+// disputeCreated records the chargeback, which blocks refunds of the payment
+// until it is resolved
+func (h *webhookHandlers) disputeCreated(ctx context.Context, data disputeData) error {
+	params := payment.DisputeParams{
+		Provider:          "paystack",
+		ProviderReference: data.ID.String(),
+		PaymentID:         data.Transaction.Reference,
+		Reason:            data.Category,
+		AwaitingEvidence:  data.Status == "awaiting-merchant-feedback",
+		Actor:             "paystack",
+		Source:            payment.SourceWebhook,
+	}
+	if data.RefundAmount > 0 {
+		params.Amount = payment.Money{Amount: data.RefundAmount, Currency: payment.Currency(strings.ToUpper(data.Currency))}
+	}
+	if due, err := time.Parse(time.RFC3339, data.DueAt); err == nil {
+		params.DueBy = &due
+	}
+
+	d, err := h.disputes.OpenDispute(ctx, h.bank, params)
+	if err != nil {
+		return err
+	}
+	payment.RaiseAlert(payment.Alert{
+		PaymentID: d.PaymentID,
+		Kind:      "dispute_opened",
+		Message:   fmt.Sprintf("Paystack dispute %s (%s) of %s opened, respond by %s", data.ID, data.Category, d.Amount, data.DueAt),
+	})
+	return nil
+}
+
+// disputeResolved closes the dispute: declined means the merchant won, any
+// other resolution means the money goes back to the customer
+func (h *webhookHandlers) disputeResolved(ctx context.Context, data disputeData) error {
+	won := data.Resolution == "declined"
+	_, err := h.disputes.ResolveDispute(ctx, h.bank, "paystack", data.ID.String(), won, "paystack", payment.SourceWebhook)
+	return err
+}
+
+// transferSucceeded records a payout to the merchant. Payouts are made from
+// the Paystack dashboard; we only keep their outcome.
+func (h *webhookHandlers) transferSucceeded(ctx context.Context, data transferData) error {
+	_, err := h.transfers.RecordTransfer(data.transfer(payment.TransferSucceeded))
+	return err
+}
+
+// transferFailed records a failed payout, which still needs someone to look at it
+func (h *webhookHandlers) transferFailed(ctx context.Context, data transferData) error {
+	if _, err := h.transfers.RecordTransfer(data.transfer(payment.TransferFailed)); err != nil {
+		return err
+	}
+	payment.RaiseAlert(payment.Alert{
+		Kind:    "transfer_failed",
+		Message: fmt.Sprintf("Paystack transfer %s of %d %s failed: %s", data.Reference, data.Amount, data.Currency, data.Reason),
+	})
+	return nil
+}
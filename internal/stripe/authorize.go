@@ -0,0 +1,206 @@
+package stripe
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+)
+
+// Stripe amounts are in the smallest unit of the currency, zero-decimal
+// currencies (UGX, RWF, XOF) included, which is how Money keeps them too.
+
+// Authorize opens a Stripe Checkout Session for the payment. The card is
+// charged when the customer completes the checkout, like a Paystack or
+// Flutterwave checkout: captures are not sent to the bank, so a PaymentIntent
+// with manual capture would never be captured. The payment ID goes into the
+// metadata of the PaymentIntent, which is how Verify and Refund find it.
+// The cancel button returns to the callback flagged as cancelled, so the
+// checkout is abandoned right away instead of when the session expires.
+func (s *StripeClient) Authorize(
+	ctx context.Context,
+	req payment.AuthorizeRequest,
+) (payment.AuthorizeResponse, error) {
+
+	form := url.Values{
+		"mode":                 {"payment"},
+		"success_url":          {withQuery(req.CallbackURL, url.Values{"reference": {req.PaymentID}})},
+		"cancel_url":           {withQuery(req.CallbackURL, url.Values{"reference": {req.PaymentID}, "cancelled": {"true"}})},
+		"client_reference_id":  {req.PaymentID},
+		"metadata[payment_id]": {req.PaymentID},
+		"payment_intent_data[metadata][payment_id]":     {req.PaymentID},
+		"line_items[0][quantity]":                       {"1"},
+		"line_items[0][price_data][currency]":           {strings.ToLower(string(req.Amount.Currency))},
+		"line_items[0][price_data][unit_amount]":        {strconv.FormatInt(req.Amount.Amount, 10)},
+		"line_items[0][price_data][product_data][name]": {"Payment " + req.PaymentID},
+	}
+	if req.Email != "" {
+		form.Set("customer_email", req.Email)
+	}
+
+	var session struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err := s.call(ctx, http.MethodPost, "/v1/checkout/sessions", req.OperationID, form, &session); err != nil {
+		return payment.AuthorizeResponse{}, err
+	}
+
+	return payment.AuthorizeResponse{
+		Reference:        session.ID,
+		AuthorizationURL: session.URL,
+	}, nil
+}
+
+// withQuery adds parameters to the callback URL: the payment ID is how the
+// callback knows which payment to verify
+func withQuery(callback string, params url.Values) string {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return callback
+	}
+	q := u.Query()
+	for key, values := range params {
+		q[key] = values
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// paymentIntent is a PaymentIntent as far as we read it
+type paymentIntent struct {
+	ID             string            `json:"id"`
+	Status         string            `json:"status"` // see verifyStatus
+	Amount         int64             `json:"amount"`
+	AmountReceived int64             `json:"amount_received"`
+	Currency       string            `json:"currency"`
+	Created        int64             `json:"created"`
+	Metadata       map[string]string `json:"metadata"`
+}
+
+// findPaymentIntent looks up the PaymentIntent of a payment by its metadata.
+// There is none until the customer submits the checkout, and a retried
+// checkout may leave several: a succeeded one wins, otherwise the latest.
+// Stripe's search can lag a few seconds behind; not found is not final.
+func (s *StripeClient) findPaymentIntent(ctx context.Context, paymentID string) (pi paymentIntent, found bool, err error) {
+	query := "metadata['payment_id']:'" + strings.ReplaceAll(paymentID, "'", `\'`) + "'"
+
+	var result struct {
+		Data []paymentIntent `json:"data"`
+	}
+	if err := s.call(ctx, http.MethodGet, "/v1/payment_intents/search", "", url.Values{"query": {query}}, &result); err != nil {
+		return paymentIntent{}, false, err
+	}
+
+	for _, candidate := range result.Data {
+		switch {
+		case !found:
+			pi, found = candidate, true
+		case pi.Status == "succeeded":
+		case candidate.Status == "succeeded" || candidate.Created > pi.Created:
+			pi = candidate
+		}
+	}
+	return pi, found, nil
+}
+
+func (s *StripeClient) Verify(
+	ctx context.Context,
+	reference string,
+) (payment.VerifyResponse, error) {
+
+	pi, found, err := s.findPaymentIntent(ctx, reference)
+	if err != nil {
+		return payment.VerifyResponse{}, err
+	}
+	if !found {
+		return payment.VerifyResponse{
+			Reference:      reference,
+			Status:         payment.VerifyPending,
+			ProviderStatus: "not_found",
+		}, nil
+	}
+
+	// what was received is what we got; before that, what is asked
+	amount := pi.AmountReceived
+	if pi.Status != "succeeded" {
+		amount = pi.Amount
+	}
+	return payment.VerifyResponse{
+		Reference:      reference,
+		Status:         verifyStatus(pi.Status),
+		ProviderStatus: pi.Status,
+		Amount: payment.Money{
+			Amount:   amount,
+			Currency: payment.Currency(strings.ToUpper(pi.Currency)),
+		},
+	}, nil
+}
+
+// verifyStatus maps PaymentIntent statuses to checkout outcomes. A declined
+// card leaves the intent in requires_payment_method while the customer may
+// still try another one, so it stays pending until the checkout expires.
+func verifyStatus(status string) payment.VerifyStatus {
+	switch status {
+	case "succeeded":
+		return payment.VerifySuccess
+	case "canceled":
+		return payment.VerifyAbandoned
+	default: // "requires_payment_method", "requires_confirmation", "requires_action", "processing"
+		return payment.VerifyPending
+	}
+}
+
+// Refund refunds the succeeded PaymentIntent of a payment. Amount 0 refunds
+// whatever is left on it.
+func (s *StripeClient) Refund(
+	ctx context.Context,
+	req payment.RefundRequest,
+) (payment.RefundResponse, error) {
+
+	pi, found, err := s.findPaymentIntent(ctx, req.Reference)
+	if err != nil {
+		return payment.RefundResponse{}, err
+	}
+	if !found || pi.Status != "succeeded" {
+		return payment.RefundResponse{}, &payment.BankError{
+			Provider: "stripe",
+			Code:     "charge_not_found",
+			Message:  "No succeeded payment for " + req.Reference,
+		}
+	}
+
+	form := url.Values{
+		"payment_intent":       {pi.ID},
+		"metadata[payment_id]": {req.Reference},
+	}
+	if req.Amount.Amount > 0 {
+		form.Set("amount", strconv.FormatInt(req.Amount.Amount, 10))
+	}
+
+	var refund struct {
+		ID     string `json:"id"`
+		Status string `json:"status"` // "pending", "succeeded", "failed", "canceled"
+	}
+	if err := s.call(ctx, http.MethodPost, "/v1/refunds", req.OperationID, form, &refund); err != nil {
+		return payment.RefundResponse{}, err
+	}
+
+	// the refund id is what Stripe's refund.* webhooks point back to
+	return payment.RefundResponse{
+		Reference: refund.ID,
+		Status:    refund.Status,
+	}, nil
+}
+
+// Void releases an authorization. Checkout charges the customer when the
+// session completes, so there is no hold to release.
+func (s *StripeClient) Void(
+	ctx context.Context,
+	req payment.VoidRequest,
+) (payment.VoidResponse, error) {
+	return payment.VoidResponse{Reference: req.Reference, Status: "voided"}, nil
+}
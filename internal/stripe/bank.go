@@ -0,0 +1,126 @@
+package stripe
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+)
+
+type StripeClient struct {
+	secretKey string
+	baseURL   string
+	http      *http.Client
+}
+
+// DefaultBaseURL is Stripe's live API
+const DefaultBaseURL = "https://api.stripe.com"
+
+// NewStripeClient talks to Stripe at baseURL, or at DefaultBaseURL when it
+// is empty
+func NewStripeClient(secretKey, baseURL string) *StripeClient {
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	return &StripeClient{
+		secretKey: secretKey,
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// requestError wraps a request that never got an answer from Stripe; those
+// are always worth retrying
+func requestError(err error) error {
+	return &payment.BankError{
+		Provider:  "stripe",
+		Code:      "network_error",
+		Message:   err.Error(),
+		Retryable: true,
+		Err:       err,
+	}
+}
+
+// statusError decodes the body of a non-2xx Stripe response. Stripe says
+// itself whether a request is worth retrying in Stripe-Should-Retry.
+func statusError(resp *http.Response) error {
+	var errResp struct {
+		Error struct {
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	message := fmt.Sprintf("stripe returned status %d", resp.StatusCode)
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err == nil && errResp.Error.Message != "" {
+		message = errResp.Error.Message
+	}
+	code := errResp.Error.Code
+	if code == "" {
+		code = errResp.Error.Type
+	}
+	if code == "" {
+		code = fmt.Sprintf("http_%d", resp.StatusCode)
+	}
+
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	switch resp.Header.Get("Stripe-Should-Retry") {
+	case "true":
+		retryable = true
+	case "false":
+		retryable = false
+	}
+
+	return &payment.BankError{
+		Provider:  "stripe",
+		Code:      code,
+		Message:   message,
+		Retryable: retryable,
+	}
+}
+
+// call sends a form-encoded request to Stripe and decodes a 2xx answer into out
+func (s *StripeClient) call(ctx context.Context, method, path, idempotencyKey string, form url.Values, out interface{}) error {
+	var body *strings.Reader
+	if method == http.MethodGet {
+		if len(form) > 0 {
+			path += "?" + form.Encode()
+		}
+		body = strings.NewReader("")
+	} else {
+		body = strings.NewReader(form.Encode())
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, s.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("create http request: %w", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+s.secretKey)
+	if method != http.MethodGet {
+		httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idempotencyKey != "" {
+		httpReq.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := s.http.Do(httpReq)
+	if err != nil {
+		return requestError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return statusError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode stripe response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package stripe_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/stripe"
+)
+
+// fakeStripe answers the form-encoded endpoints the client uses.
+// PaymentIntents are found by the payment_id in their metadata, like
+// Stripe's search does.
+type fakeStripe struct {
+	intents  map[string][]map[string]interface{}
+	sessions []url.Values
+	refunds  []url.Values
+	keys     []string
+	fail     int // answer the next request with this status
+}
+
+func newFakeStripe(t *testing.T) (*fakeStripe, *stripe.StripeClient) {
+	s := &fakeStripe{intents: make(map[string][]map[string]interface{})}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/checkout/sessions", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.sessions = append(s.sessions, r.PostForm)
+		s.keys = append(s.keys, r.Header.Get("Idempotency-Key"))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":  "cs_test_1",
+			"url": "https://checkout.stripe.com/c/pay/cs_test_1",
+		})
+	})
+	mux.HandleFunc("GET /v1/payment_intents/search", func(w http.ResponseWriter, r *http.Request) {
+		var data []map[string]interface{}
+		for id, intents := range s.intents {
+			if r.URL.Query().Get("query") == "metadata['payment_id']:'"+id+"'" {
+				data = intents
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"object": "search_result", "data": data})
+	})
+	mux.HandleFunc("POST /v1/refunds", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.refunds = append(s.refunds, r.PostForm)
+		s.keys = append(s.keys, r.Header.Get("Idempotency-Key"))
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "re_1", "status": "pending"})
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk_test_x" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if s.fail != 0 {
+			w.WriteHeader(s.fail)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": map[string]interface{}{"type": "api_error", "message": "Something went wrong"},
+			})
+			s.fail = 0
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return s, stripe.NewStripeClient("sk_test_x", server.URL)
+}
+
+func TestAuthorizeOpensCheckoutSession(t *testing.T) {
+	s, client := newFakeStripe(t)
+
+	resp, err := client.Authorize(context.Background(), payment.AuthorizeRequest{
+		PaymentID:   "pay_1",
+		OperationID: "op-pay_1",
+		Amount:      payment.Money{Amount: 2500, Currency: payment.USD},
+		Email:       "customer@example.com",
+		CallbackURL: "http://localhost:8080/v1/payments/callback/verify",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Reference != "cs_test_1" || resp.AuthorizationURL != "https://checkout.stripe.com/c/pay/cs_test_1" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	form := s.sessions[0]
+	want := map[string]string{
+		"mode":                "payment",
+		"client_reference_id": "pay_1",
+		"payment_intent_data[metadata][payment_id]": "pay_1",
+		"line_items[0][price_data][currency]":       "usd",
+		"line_items[0][price_data][unit_amount]":    "2500",
+		"customer_email":                            "customer@example.com",
+		"success_url":                               "http://localhost:8080/v1/payments/callback/verify?reference=pay_1",
+		"cancel_url":                                "http://localhost:8080/v1/payments/callback/verify?cancelled=true&reference=pay_1",
+	}
+	for key, value := range want {
+		if got := form.Get(key); got != value {
+			t.Errorf("%s = %q, want %q", key, got, value)
+		}
+	}
+	if s.keys[0] != "op-pay_1" {
+		t.Errorf("Idempotency-Key %q", s.keys[0])
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		intents []map[string]interface{}
+		status  payment.VerifyStatus
+		amount  int64
+	}{
+		{
+			name:    "succeeded",
+			intents: []map[string]interface{}{{"id": "pi_1", "status": "succeeded", "amount": 2500, "amount_received": 2500, "currency": "usd"}},
+			status:  payment.VerifySuccess,
+			amount:  2500,
+		},
+		{
+			name:    "declined card, customer may try again",
+			intents: []map[string]interface{}{{"id": "pi_1", "status": "requires_payment_method", "amount": 2500, "currency": "usd"}},
+			status:  payment.VerifyPending,
+			amount:  2500,
+		},
+		{
+			name:    "canceled",
+			intents: []map[string]interface{}{{"id": "pi_1", "status": "canceled", "amount": 2500, "currency": "usd"}},
+			status:  payment.VerifyAbandoned,
+			amount:  2500,
+		},
+		{
+			name: "succeeded wins over a later attempt",
+			intents: []map[string]interface{}{
+				{"id": "pi_1", "status": "succeeded", "amount": 2500, "amount_received": 2500, "currency": "usd", "created": 1},
+				{"id": "pi_2", "status": "canceled", "amount": 2500, "currency": "usd", "created": 2},
+			},
+			status: payment.VerifySuccess,
+			amount: 2500,
+		},
+		{
+			name:   "checkout not submitted yet",
+			status: payment.VerifyPending,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, client := newFakeStripe(t)
+			if tt.intents != nil {
+				s.intents["pay_1"] = tt.intents
+			}
+
+			resp, err := client.Verify(context.Background(), "pay_1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != tt.status {
+				t.Fatalf("status %s, want %s", resp.Status, tt.status)
+			}
+			if resp.Amount.Amount != tt.amount {
+				t.Fatalf("amount %d, want %d", resp.Amount.Amount, tt.amount)
+			}
+		})
+	}
+}
+
+func TestRefundTheSucceededIntent(t *testing.T) {
+	s, client := newFakeStripe(t)
+	s.intents["pay_1"] = []map[string]interface{}{{"id": "pi_1", "status": "succeeded", "amount": 2500, "amount_received": 2500, "currency": "usd"}}
+
+	resp, err := client.Refund(context.Background(), payment.RefundRequest{
+		OperationID: "op-refund",
+		Reference:   "pay_1",
+		Amount:      payment.Money{Amount: 1000, Currency: payment.USD},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Reference != "re_1" || resp.Status != "pending" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	form := s.refunds[0]
+	if form.Get("payment_intent") != "pi_1" || form.Get("amount") != "1000" || form.Get("metadata[payment_id]") != "pay_1" {
+		t.Fatalf("unexpected refund request %v", form)
+	}
+	if s.keys[0] != "op-refund" {
+		t.Fatalf("Idempotency-Key %q", s.keys[0])
+	}
+}
+
+func TestRefundWithoutPayment(t *testing.T) {
+	_, client := newFakeStripe(t)
+
+	_, err := client.Refund(context.Background(), payment.RefundRequest{Reference: "pay_1"})
+	var bankErr *payment.BankError
+	if !errors.As(err, &bankErr) || bankErr.Retryable {
+		t.Fatalf("expected a final bank error, got %v", err)
+	}
+}
+
+func TestStripeErrors(t *testing.T) {
+	tests := []struct {
+		status        int
+		wantRetryable bool
+	}{
+		{status: http.StatusInternalServerError, wantRetryable: true},
+		{status: http.StatusTooManyRequests, wantRetryable: true},
+		{status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			s, client := newFakeStripe(t)
+			s.fail = tt.status
+
+			_, err := client.Verify(context.Background(), "pay_1")
+			var bankErr *payment.BankError
+			if !errors.As(err, &bankErr) {
+				t.Fatalf("expected a bank error, got %v", err)
+			}
+			if bankErr.Retryable != tt.wantRetryable || bankErr.Message != "Something went wrong" {
+				t.Fatalf("unexpected error %+v", bankErr)
+			}
+		})
+	}
+}
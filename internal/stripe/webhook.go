@@ -0,0 +1,240 @@
+package stripe
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+)
+
+var (
+	ErrInvalidSignature = fmt.Errorf("invalid stripe signature")
+)
+
+// SignatureTolerance is how old a signed webhook may be, Stripe's default
+const SignatureTolerance = 5 * time.Minute
+
+// VerifySignature checks the Stripe-Signature header of a webhook: an
+// HMAC-SHA256 of "<t>.<body>" with the endpoint's signing secret, in one or
+// more v1 entries. Old timestamps are refused so a captured delivery cannot
+// be replayed.
+func VerifySignature(body []byte, header, secret string, tolerance time.Duration, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == "" || len(signatures) == 0 {
+		return fmt.Errorf("%w: malformed header", ErrInvalidSignature)
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed timestamp", ErrInvalidSignature)
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("%w: timestamp outside the tolerance", ErrInvalidSignature)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// event is what every Stripe webhook shares; Data.Object is decoded by the
+// handler of the event type
+type event struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// sessionData is the Checkout Session of checkout.session.* events
+type sessionData struct {
+	ID                string `json:"id"`
+	ClientReferenceID string `json:"client_reference_id"`
+}
+
+// refundData is the Refund of refund.* events
+type refundData struct {
+	ID       string            `json:"id"`
+	Status   string            `json:"status"` // "pending", "succeeded", "failed", "canceled"
+	Metadata map[string]string `json:"metadata"`
+}
+
+// ParseWebhook turns a verified webhook body into an inbox event. Stripe
+// retries deliveries with the same event id, which is what dedupes them.
+func ParseWebhook(body []byte) (*payment.WebhookEvent, error) {
+	var e event
+	if err := json.Unmarshal(body, &e); err != nil {
+		return nil, err
+	}
+	if e.Type == "" {
+		return nil, fmt.Errorf("webhook without a type")
+	}
+
+	// the payment is the client reference of a session, or in the metadata
+	var ids struct {
+		ClientReferenceID string            `json:"client_reference_id"`
+		Metadata          map[string]string `json:"metadata"`
+	}
+	if len(e.Data.Object) > 0 {
+		if err := json.Unmarshal(e.Data.Object, &ids); err != nil {
+			return nil, err
+		}
+	}
+	reference := ids.ClientReferenceID
+	if reference == "" {
+		reference = ids.Metadata["payment_id"]
+	}
+	return &payment.WebhookEvent{
+		Provider:  "stripe",
+		Event:     e.Type,
+		EventID:   e.ID,
+		Reference: reference,
+		Payload:   string(body),
+	}, nil
+}
+
+// webhookHandlers processes the stored Stripe webhooks
+type webhookHandlers struct {
+	store payment.Store
+	bank  payment.Bank
+}
+
+// decode reads the object of an event; one that does not decode will not
+// decode on a retry either
+func decode(raw json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("%w: %v", payment.ErrOperationFailed, err)
+	}
+	return nil
+}
+
+// NewWebhookHandler dispatches stored Stripe webhooks by event type. Events
+// without a handler are acknowledged and ignored.
+func NewWebhookHandler(store payment.Store, bank payment.Bank) payment.WebhookHandler {
+	h := &webhookHandlers{store: store, bank: bank}
+
+	return func(ctx context.Context, e *payment.WebhookEvent) error {
+		var ev event
+		if err := decode([]byte(e.Payload), &ev); err != nil {
+			return err
+		}
+
+		switch ev.Type {
+		case "checkout.session.completed", "checkout.session.async_payment_succeeded", "checkout.session.async_payment_failed":
+			var data sessionData
+			if err := decode(ev.Data.Object, &data); err != nil {
+				return err
+			}
+			return h.sessionCompleted(ctx, data)
+		case "checkout.session.expired":
+			var data sessionData
+			if err := decode(ev.Data.Object, &data); err != nil {
+				return err
+			}
+			return h.sessionExpired(ctx, data)
+		case "refund.created", "refund.updated", "refund.failed":
+			var data refundData
+			if err := decode(ev.Data.Object, &data); err != nil {
+				return err
+			}
+			return h.refundUpdated(ctx, data)
+		default:
+			return nil
+		}
+	}
+}
+
+// sessionCompleted is only a hint: the PaymentIntent is verified with Stripe
+// before anything is captured, and a mismatch goes to review
+func (h *webhookHandlers) sessionCompleted(ctx context.Context, data sessionData) error {
+	_, _, err := h.store.ApplyVerification(
+		ctx,
+		h.bank,
+		data.ClientReferenceID,
+		"webhook",
+		payment.OperationParams{Actor: "stripe", Source: payment.SourceWebhook},
+	)
+	return err
+}
+
+// sessionExpired abandons the checkout: an expired session cannot be paid,
+// and it may never have had a PaymentIntent to verify. A payment the poller
+// already abandoned, or that another session paid, is left alone, and so is
+// a session of no payment of ours.
+func (h *webhookHandlers) sessionExpired(ctx context.Context, data sessionData) error {
+	p, err := h.store.Get(data.ClientReferenceID)
+	if errors.Is(err, payment.ErrPaymentNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if p.State != payment.Initiated && p.State != payment.Pending {
+		return nil
+	}
+
+	opID := "webhook-checkout.session.expired-" + data.ID
+	_, err = h.store.Apply(ctx, h.bank, data.ClientReferenceID, opID, payment.OPAbandon, payment.OperationParams{
+		BankReference: data.ID,
+		Actor:         "stripe",
+		Source:        payment.SourceWebhook,
+	})
+	return err
+}
+
+// refundUpdated settles the pending refund of a payment once Stripe has
+// decided either way; a refund still pending waits for its next update.
+// Refunds made from the Stripe dashboard carry no payment ID and were never
+// pending here, so they are left alone.
+func (h *webhookHandlers) refundUpdated(ctx context.Context, data refundData) error {
+	if data.Metadata["payment_id"] == "" {
+		return nil
+	}
+
+	var operation payment.Operation
+	switch data.Status {
+	case "succeeded":
+		operation = payment.OPRefundProcessed
+	case "failed", "canceled":
+		operation = payment.OPRefundFailed
+	default:
+		return nil
+	}
+
+	opID := fmt.Sprintf("webhook-refund.%s-%s", data.Status, data.ID)
+	_, err := h.store.Apply(ctx, h.bank, data.Metadata["payment_id"], opID, operation, payment.OperationParams{
+		BankReference: data.ID,
+		Actor:         "stripe",
+		Source:        payment.SourceWebhook,
+	})
+	return err
+}
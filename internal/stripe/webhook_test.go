@@ -0,0 +1,159 @@
+package stripe_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Investorharry19/go-payment/internal/payment"
+	"github.com/Investorharry19/go-payment/internal/payment/paymenttest"
+	"github.com/Investorharry19/go-payment/internal/stripe"
+)
+
+func signature(secret string, at time.Time, body []byte) string {
+	t := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"id":"evt_1","type":"checkout.session.completed"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		header string
+		valid  bool
+	}{
+		{name: "valid", header: signature("whsec_test", now, body), valid: true},
+		{name: "rolled secret", header: signature("whsec_test", now, body) + ",v1=00ff", valid: true},
+		{name: "other secret", header: signature("whsec_other", now, body)},
+		{name: "too old", header: signature("whsec_test", now.Add(-10*time.Minute), body)},
+		{name: "malformed", header: "v1=abc"},
+		{name: "tampered timestamp", header: strings.Replace(signature("whsec_test", now, body), strconv.FormatInt(now.Unix(), 10), strconv.FormatInt(now.Unix()+1, 10), 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := stripe.VerifySignature(body, tt.header, "whsec_test", stripe.SignatureTolerance, now)
+			if tt.valid && err != nil {
+				t.Fatalf("valid signature refused: %v", err)
+			}
+			if !tt.valid && !errors.Is(err, stripe.ErrInvalidSignature) {
+				t.Fatalf("expected ErrInvalidSignature, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		reference string
+	}{
+		{
+			name:      "checkout session",
+			body:      `{"id":"evt_1","type":"checkout.session.completed","data":{"object":{"id":"cs_1","client_reference_id":"pay_1"}}}`,
+			reference: "pay_1",
+		},
+		{
+			name:      "refund",
+			body:      `{"id":"evt_1","type":"refund.updated","data":{"object":{"id":"re_1","status":"succeeded","metadata":{"payment_id":"pay_1"}}}}`,
+			reference: "pay_1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := stripe.ParseWebhook([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Provider != "stripe" || e.EventID != "evt_1" || e.Reference != tt.reference {
+				t.Fatalf("unexpected event %+v", e)
+			}
+		})
+	}
+}
+
+func TestRefundWebhooks(t *testing.T) {
+	ctx := context.Background()
+	store := payment.NewPaymentStore()
+	bank := paymenttest.NewBank()
+	handle := stripe.NewWebhookHandler(store, bank)
+
+	p, err := store.Create("pay_1", payment.Money{Amount: 2500, Currency: payment.USD}, "usr_1", "ord_1", "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bank.VerifyNext(p.ID, payment.VerifyResponse{Status: payment.VerifySuccess, Amount: p.Amount})
+	if _, _, err := store.ApplyVerification(ctx, bank, p.ID, "verify", payment.OperationParams{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Apply(ctx, bank, p.ID, "op-refund", payment.OPRefund, payment.OperationParams{Amount: payment.Money{Amount: 1000}}); err != nil {
+		t.Fatal(err)
+	}
+
+	deliver := func(body string) error {
+		e, err := stripe.ParseWebhook([]byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handle(ctx, e)
+	}
+
+	// a refund made from the dashboard is none of ours
+	if err := deliver(`{"id":"evt_1","type":"refund.updated","data":{"object":{"id":"re_dashboard","status":"succeeded","metadata":{}}}}`); err != nil {
+		t.Fatalf("dashboard refund: %v", err)
+	}
+	if got, _ := store.Get(p.ID); got.State != payment.RefundPending {
+		t.Fatalf("after a dashboard refund: %s", got.State)
+	}
+
+	if err := deliver(`{"id":"evt_2","type":"refund.updated","data":{"object":{"id":"re_1","status":"succeeded","metadata":{"payment_id":"pay_1"}}}}`); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get(p.ID); got.State != payment.PartiallyRefunded {
+		t.Fatalf("after our refund succeeded: %s", got.State)
+	}
+}
+
+func TestExpiredSessionWebhooks(t *testing.T) {
+	ctx := context.Background()
+	store := payment.NewPaymentStore()
+	handle := stripe.NewWebhookHandler(store, paymenttest.NewBank())
+
+	p, err := store.Create("pay_1", payment.Money{Amount: 2500, Currency: payment.USD}, "usr_1", "ord_1", "stripe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliver := func(body string) error {
+		e, err := stripe.ParseWebhook([]byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handle(ctx, e)
+	}
+
+	// a session of another integration on the same account is none of ours
+	if err := deliver(`{"id":"evt_1","type":"checkout.session.expired","data":{"object":{"id":"cs_other","client_reference_id":"pay_other"}}}`); err != nil {
+		t.Fatalf("unknown payment: %v", err)
+	}
+
+	if err := deliver(`{"id":"evt_2","type":"checkout.session.expired","data":{"object":{"id":"cs_1","client_reference_id":"pay_1"}}}`); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get(p.ID); got.State != payment.Abandoned {
+		t.Fatalf("after the session expired: %s", got.State)
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 
 	"github.com/Investorharry19/go-payment/docs"
 	_ "github.com/Investorharry19/go-payment/docs" // import generated docs
+	"github.com/Investorharry19/go-payment/internal/flutterwave"
 	"github.com/Investorharry19/go-payment/internal/http"
+	"github.com/Investorharry19/go-payment/internal/ledger"
+	"github.com/Investorharry19/go-payment/internal/outbox"
 	"github.com/Investorharry19/go-payment/internal/payment"
 	"github.com/Investorharry19/go-payment/internal/paystack"
+	"github.com/Investorharry19/go-payment/internal/stripe"
 	"github.com/Investorharry19/go-payment/middlewares"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -42,7 +47,7 @@ func main() {
 		panic(err)
 	}
 
-	app := fiber.New()
+	app := fiber.New(fiber.Config{BodyLimit: http.BodyLimit})
 
 	env := os.Getenv("ENV")
 	// Configure Swagger based on environment
@@ -74,22 +79,80 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	fmt.Println("Connected to database successfully!")
+
+	// Run migrations before any worker queries the tables
+	if err := db.AutoMigrate(&payment.Payment{}, &payment.PaymentOperation{}, &payment.PaymentStateTransition{}, &ledger.JournalEntry{}, &ledger.JournalLine{}, &payment.WebhookEvent{}, &payment.Dispute{}, &payment.DisputeEvidence{}, &payment.Transfer{}, &payment.WebhookEndpoint{}, &payment.WebhookDelivery{}, &payment.WebhookDeliveryAttempt{}, &outbox.Message{}, &middlewares.IdempotencyKey{}); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Migrations completed!")
+
+	// log every state change of a payment
+	payment.Lifecycle.AfterTransition(func(p *payment.Payment, t payment.Transition, res payment.OperationResult) {
+		fmt.Printf("payment %s: %s %s -> %s (%s)\n", p.ID, t.Operation, t.From, t.To, res.Amount)
+	})
+
+	// how long a hold lasts when the provider does not say
+	payment.AuthorizationTTL = payment.AuthorizationTTLFromEnv()
+
+	// the fee kept on every capture, booked in the ledger
+	payment.FeeBasisPoints = payment.FeeBasisPointsFromEnv()
+
+	// until paging is wired up, alerts go to the logs
+	payment.OnAlert(func(a payment.Alert) {
+		fmt.Printf("ALERT [%s] payment %s: %s\n", a.Kind, a.PaymentID, a.Message)
+	})
 
 	store := payment.NewPaymentStoreDB(db)
-	bank := paystack.NewPaystackClient(os.Getenv("PAYSTACK_SECRET_KEY"))
+	store.EventSourced = os.Getenv("EVENT_SOURCED") == "true"
+	// every payment keeps the provider it was created with; PAYMENT_PROVIDER
+	// picks the one for payments that do not name it
+	bank := payment.NewProviders(os.Getenv("PAYMENT_PROVIDER"), store)
+	// PAYSTACK_BASE_URL=http://localhost:4010 uses the local simulator, see cmd/paystack-sim
+	bank.Register("paystack", paystack.NewPaystackClient(os.Getenv("PAYSTACK_SECRET_KEY"), os.Getenv("PAYSTACK_BASE_URL")))
+	if key := os.Getenv("FLUTTERWAVE_SECRET_KEY"); key != "" {
+		bank.Register("flutterwave", flutterwave.NewFlutterwaveClient(key, os.Getenv("FLUTTERWAVE_BASE_URL")))
+	}
+	if key := os.Getenv("STRIPE_SECRET_KEY"); key != "" {
+		bank.Register("stripe", stripe.NewStripeClient(key, os.Getenv("STRIPE_BASE_URL")))
+	}
+	fmt.Printf("Payment providers: %v, default %s\n", bank.Names(), bank.Default)
 
-	http.RegisterPaymentRoutes(app, store, bank)
-	http.RegisterUserRoutes(app)
+	// settle checkouts whose webhook and callback never arrived
+	go payment.NewPoller(store, bank, payment.PollerConfigFromEnv()).Run(context.Background())
 
-	// Run migrations at startup
+	// release authorizations nobody captured in time
+	go payment.NewAuthorizationScheduler(store, bank, payment.SchedulerConfigFromEnv()).Run(context.Background())
 
-	go func() {
-		if err := db.AutoMigrate(&payment.Payment{}, &payment.PaymentOperation{}); err != nil {
-			log.Fatal(err)
-		}
-		fmt.Println("Migrations completed!")
-	}()
-	fmt.Println("Connected to database successfully!")
+	// verified webhooks are stored first, then processed with retries
+	inbox := payment.NewWebhookInbox(db, payment.WebhookInboxConfigFromEnv())
+	inbox.Handle("paystack", paystack.NewWebhookHandler(store, bank))
+	inbox.Handle("flutterwave", flutterwave.NewWebhookHandler(store, bank))
+	inbox.Handle("stripe", stripe.NewWebhookHandler(store, bank))
+	go inbox.Run(context.Background())
+
+	// tell merchants about payment state changes
+	go payment.NewWebhookDispatcher(db, payment.WebhookDispatcherConfigFromEnv()).Run(context.Background())
+
+	// publish the domain events written to the outbox
+	publisher, err := outbox.PublisherFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if publisher != nil {
+		go outbox.NewRelay(db, publisher, outbox.RelayConfigFromEnv()).Run(context.Background())
+	} else {
+		fmt.Println("OUTBOX_PUBLISHER not set, domain events stay in the outbox table")
+	}
+
+	// every POST route replays its stored response for a repeated Idempotency-Key
+	idempotency := middlewares.IdempotencyMiddleware(db)
+
+	http.RegisterPaymentRoutes(app, store, bank, inbox, idempotency)
+	http.RegisterWebhookRoutes(app, store, inbox, idempotency)
+	http.RegisterDisputeRoutes(app, store, idempotency)
+	http.RegisterLedgerRoutes(app, store)
+	http.RegisterUserRoutes(app)
 
 	fmt.Println("Server started on :8080")
 	if err := app.Listen(":8080"); err != nil {
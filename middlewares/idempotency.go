@@ -0,0 +1,149 @@
+package middlewares
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	idempotencyInProgress = "in_progress"
+	idempotencyCompleted  = "completed"
+
+	// a request holding a key for longer than this is assumed dead
+	idempotencyLockTimeout = time.Minute
+)
+
+// IdempotencyKey stores the outcome of a request made with an Idempotency-Key header
+type IdempotencyKey struct {
+	Key   string `gorm:"primaryKey"`
+	Scope string `gorm:"primaryKey"` // sub METHOD /path, a key is only valid for one caller and route
+
+	Fingerprint string `gorm:"not null"` // hash of the request body
+	Status      string `gorm:"not null"` // in_progress, completed
+
+	StatusCode  int
+	ContentType string
+	Body        []byte
+
+	LockedAt  time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (IdempotencyKey) TableName() string {
+	return "idempotency_keys"
+}
+
+// IdempotencyMiddleware makes a route safe to retry. The first request with a
+// given Idempotency-Key header locks the key and its response is stored; a
+// retry with the same key and body gets that response replayed, while a retry
+// with another body or one made before the first finished gets 409 Conflict.
+// Requests without the header pass through untouched. Keys are scoped to the
+// caller's JWT subject, so it must run after JWTMiddleware.
+func IdempotencyMiddleware(db *gorm.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get("Idempotency-Key")
+		if key == "" {
+			return c.Next()
+		}
+
+		scope := Subject(c) + " " + c.Method() + " " + c.Path()
+		sum := sha256.Sum256(c.Body())
+		fingerprint := hex.EncodeToString(sum[:])
+
+		acquired, err := lockIdempotencyKey(db, key, scope, fingerprint)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if !acquired {
+			var stored IdempotencyKey
+			if err := db.First(&stored, "key = ? AND scope = ?", key, scope).Error; err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			if stored.Fingerprint != fingerprint {
+				return c.Status(409).JSON(fiber.Map{"error": "Idempotency-Key already used with a different request"})
+			}
+			if stored.Status != idempotencyCompleted {
+				return c.Status(409).JSON(fiber.Map{"error": "a request with this Idempotency-Key is still in progress"})
+			}
+
+			c.Set("Idempotent-Replayed", "true")
+			c.Set(fiber.HeaderContentType, stored.ContentType)
+			return c.Status(stored.StatusCode).Send(stored.Body)
+		}
+
+		// a key that cannot be released stays in progress until the lock
+		// times out, and retries get 409 until then
+		release := func() {
+			if err := db.Delete(&IdempotencyKey{}, "key = ? AND scope = ?", key, scope).Error; err != nil {
+				fmt.Printf("idempotency: release key %q of %s: %v\n", key, scope, err)
+			}
+		}
+
+		// the handler failed before writing a response: let the client retry
+		if err := c.Next(); err != nil {
+			release()
+			return err
+		}
+
+		// server errors are not final either
+		status := c.Response().StatusCode()
+		if status >= 500 {
+			release()
+			return nil
+		}
+
+		body := append([]byte(nil), c.Response().Body()...)
+		err = db.Model(&IdempotencyKey{}).
+			Where("key = ? AND scope = ?", key, scope).
+			Updates(map[string]interface{}{
+				"status":       idempotencyCompleted,
+				"status_code":  status,
+				"content_type": string(c.Response().Header.ContentType()),
+				"body":         body,
+			}).Error
+		if err != nil {
+			// the response is already built, only the replay is lost
+			fmt.Printf("idempotency: store response of key %q of %s: %v\n", key, scope, err)
+			release()
+		}
+		return nil
+	}
+}
+
+// lockIdempotencyKey claims a key for this request. The primary key makes the
+// insert the lock; a key left in progress by a dead request is taken over.
+func lockIdempotencyKey(db *gorm.DB, key, scope, fingerprint string) (bool, error) {
+	now := time.Now()
+	row := IdempotencyKey{
+		Key:         key,
+		Scope:       scope,
+		Fingerprint: fingerprint,
+		Status:      idempotencyInProgress,
+		LockedAt:    now,
+	}
+
+	res := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&row)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 1 {
+		return true, nil
+	}
+
+	res = db.Model(&IdempotencyKey{}).
+		Where("key = ? AND scope = ? AND fingerprint = ? AND status = ? AND locked_at < ?",
+			key, scope, fingerprint, idempotencyInProgress, now.Add(-idempotencyLockTimeout)).
+		Update("locked_at", now)
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
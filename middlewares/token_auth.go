@@ -51,3 +51,17 @@ func JWTMiddleware() fiber.Handler {
 		return c.Next()
 	}
 }
+
+// Subject returns the "sub" claim of the JWT attached by JWTMiddleware,
+// or an empty string when the route is not authenticated
+func Subject(c *fiber.Ctx) string {
+	claims, ok := c.Locals("jwt_claims").(jwt.Claims)
+	if !ok {
+		return ""
+	}
+	sub, err := claims.GetSubject()
+	if err != nil {
+		return ""
+	}
+	return sub
+}